@@ -31,6 +31,10 @@
 //	// Delete
 //	err := client.Delete("mykey")
 //
+//	// Stream a large value without holding it in memory
+//	err := client.SetStream("backup.tar", file)
+//	n, err := client.GetStream("backup.tar", out)
+//
 //	// Health check
 //	health, err := client.Health()
 package minivault
@@ -51,6 +55,14 @@ const (
 	OpHealth = 0x05
 	OpAuth   = 0x06
 
+	OpSetBegin  = 0x13
+	OpSetChunk  = 0x14
+	OpSetEnd    = 0x15
+	OpGetStream = 0x16
+
+	// StreamChunkSize is the chunk size SetStream uploads with
+	StreamChunkSize = 256 * 1024
+
 	StatusSuccess = 0x00
 	StatusError   = 0xFF
 )
@@ -282,3 +294,95 @@ func (c *BinaryClient) Exists(key string) (bool, error) {
 	}
 	return data != nil, nil
 }
+
+func frame(op byte, key string, value []byte) []byte {
+	request := make([]byte, 1+2+len(key)+4+1+len(value))
+	request[0] = op
+	binary.LittleEndian.PutUint16(request[1:], uint16(len(key)))
+	copy(request[3:], key)
+	binary.LittleEndian.PutUint32(request[3+len(key):], uint32(len(value)))
+	copy(request[3+len(key)+5:], value)
+	return request
+}
+
+// SetStream stores the value read from r in chunks, so it never has to fit in memory
+func (c *BinaryClient) SetStream(key string, r io.Reader) error {
+	conn, err := c.connect()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if err := c.authenticate(conn); err != nil {
+		return err
+	}
+
+	if _, err := c.sendRequest(conn, frame(OpSetBegin, key, nil)); err != nil {
+		return fmt.Errorf("SET_BEGIN failed: %w", err)
+	}
+
+	buf := make([]byte, StreamChunkSize)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			if _, err := c.sendRequest(conn, frame(OpSetChunk, "", buf[:n])); err != nil {
+				return fmt.Errorf("SET_CHUNK failed: %w", err)
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if _, err := c.sendRequest(conn, []byte{OpSetEnd, 0, 0}); err != nil {
+		return fmt.Errorf("SET_END failed: %w", err)
+	}
+	c.log("Streamed value for key: %s", key)
+	return nil
+}
+
+// GetStream copies a value to w chunk by chunk and returns the number of bytes written
+func (c *BinaryClient) GetStream(key string, w io.Writer) (int64, error) {
+	conn, err := c.connect()
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	if err := c.authenticate(conn); err != nil {
+		return 0, err
+	}
+
+	request := make([]byte, 3+len(key))
+	request[0] = OpGetStream
+	binary.LittleEndian.PutUint16(request[1:], uint16(len(key)))
+	copy(request[3:], key)
+	conn.SetDeadline(time.Now().Add(c.timeout))
+	if _, err := conn.Write(request); err != nil {
+		return 0, fmt.Errorf("failed to write request: %w", err)
+	}
+
+	var total int64
+	header := make([]byte, 5)
+	for {
+		conn.SetDeadline(time.Now().Add(c.timeout))
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return total, fmt.Errorf("failed to read chunk header: %w", err)
+		}
+		if header[0] != StatusSuccess {
+			return total, fmt.Errorf("server returned error status: 0x%x", header[0])
+		}
+		n := binary.LittleEndian.Uint32(header[1:])
+		if n == 0 {
+			return total, nil
+		}
+		m, err := io.CopyN(w, conn, int64(n))
+		total += m
+		if err != nil {
+			return total, fmt.Errorf("failed to read chunk: %w", err)
+		}
+	}
+}
@@ -105,7 +105,7 @@ func (c *HTTPClient) log(format string, args ...interface{}) {
 
 // Get retrieves a value for a key (automatically unwraps from JSON response)
 func (c *HTTPClient) Get(key string) (interface{}, error) {
-	url := fmt.Sprintf("%s/%s", c.baseURL, key)
+	url := fmt.Sprintf("%s/%s?format=json", c.baseURL, key)
 
 	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, url, nil)
 	if err != nil {
@@ -165,7 +165,7 @@ func (c *HTTPClient) GetJSON(key string, v interface{}) error {
 
 // Set stores a value for a key (automatically wraps in JSON request)
 func (c *HTTPClient) Set(key string, value interface{}) error {
-	url := fmt.Sprintf("%s/%s", c.baseURL, key)
+	url := fmt.Sprintf("%s/%s?format=json", c.baseURL, key)
 
 	reqBody := map[string]interface{}{"value": value}
 	jsonData, err := json.Marshal(reqBody)
@@ -15,7 +15,7 @@ class MiniVault:
     def get(self, key: str) -> Optional[Any]:
         """Get a value (automatically unwraps from JSON response)"""
         try:
-            url = f"{self.base_url}/{key}"
+            url = f"{self.base_url}/{key}?format=json"
             response = self.session.get(url, timeout=self.timeout)
 
             if response.status_code == 404:
@@ -39,7 +39,7 @@ class MiniVault:
     def set(self, key: str, value: Any) -> bool:
         """Set a value (automatically wraps in JSON request)"""
         try:
-            url = f"{self.base_url}/{key}"
+            url = f"{self.base_url}/{key}?format=json"
             headers = {'Content-Type': 'application/json'}
 
             if self.api_key:
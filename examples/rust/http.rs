@@ -37,7 +37,7 @@ impl MiniVault {
     }
 
     pub async fn get(&self, key: &str) -> Result<Option<Vec<u8>>, Box<dyn std::error::Error>> {
-        let url = format!("{}/{}", self.base_url, key);
+        let url = format!("{}/{}?format=json", self.base_url, key);
         let response = self.client.get(&url).send().await?;
 
         match response.status() {
@@ -58,7 +58,7 @@ impl MiniVault {
     }
 
     pub async fn set(&self, key: &str, data: Vec<u8>) -> Result<(), Box<dyn std::error::Error>> {
-        let url = format!("{}/{}", self.base_url, key);
+        let url = format!("{}/{}?format=json", self.base_url, key);
         let mut request = self.client.put(&url).body(data);
 
         if let Some(api_key) = &self.api_key {
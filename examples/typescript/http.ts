@@ -33,7 +33,7 @@ export class MiniVault {
 
   async get<T = any>(key: string): Promise<T | null> {
     try {
-      const url = `${this.baseUrl}/${key}`;
+      const url = `${this.baseUrl}/${key}?format=json`;
       const controller = new AbortController();
       const timeoutId = setTimeout(() => controller.abort(), this.timeout);
 
@@ -71,7 +71,7 @@ export class MiniVault {
 
   async set(key: string, value: any): Promise<boolean> {
     try {
-      const url = `${this.baseUrl}/${key}`;
+      const url = `${this.baseUrl}/${key}?format=json`;
       const controller = new AbortController();
       const timeoutId = setTimeout(() => controller.abort(), this.timeout);
 
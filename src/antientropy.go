@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	antiEntropyBatch = 4 * 1024 * 1024
+	// how long a peer's tree is kept for its LEAF_ITEMS call.
+	aeTreeTTL = 30 * time.Second
+)
+
+// aeCache keeps key owners, as indexes into nodes, until membership changes,
+// and the tree built for each peer's TREE call.
+type aeCache struct {
+	mu     sync.Mutex
+	nodes  []string
+	owners map[string][ReplicaCount]int16
+	trees  map[string]aeTree
+}
+
+type aeTree struct {
+	t     *merkleTree
+	built time.Time
+}
+
+func (a *aeCache) ownersOf(nodes, keys []string) [][ReplicaCount]int16 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if !slices.Equal(a.nodes, nodes) || len(a.owners) > 2*len(keys)+1024 {
+		a.nodes = nodes
+		a.owners = make(map[string][ReplicaCount]int16, len(keys))
+	}
+	out := make([][ReplicaCount]int16, len(keys))
+	for i, key := range keys {
+		o, ok := a.owners[key]
+		if !ok {
+			for j := range o {
+				o[j] = -1
+			}
+			for j, n := range placement(key, nodes, ReplicaCount) {
+				o[j] = int16(slices.Index(nodes, n))
+			}
+			a.owners[key] = o
+		}
+		out[i] = o
+	}
+	return out
+}
+
+func (c *Cluster) owners(key string, nodes ...string) bool {
+	owners := c.hash(key, ReplicaCount)
+	for _, n := range nodes {
+		if !slices.Contains(owners, n) {
+			return false
+		}
+	}
+	return true
+}
+
+// merkleFor covers the keys this node holds that peer also owns, tombstones
+// included.
+func (c *Cluster) merkleFor(peer string) *merkleTree {
+	keys, metas := c.storage.index.snapshot()
+	nodes := c.getNodes()
+	slices.Sort(nodes)
+	owners := c.ae.ownersOf(nodes, keys)
+	self, other := int16(slices.Index(nodes, c.self)), int16(slices.Index(nodes, peer))
+	now := time.Now()
+
+	leaves := make([]uint64, merkleLeaves)
+	items := make([][]merkleItem, merkleLeaves)
+	for i, key := range keys {
+		m := metas[i]
+		if expired(m.expires, now) || self < 0 || other < 0 ||
+			!slices.Contains(owners[i][:], self) || !slices.Contains(owners[i][:], other) {
+			continue
+		}
+		l := leafOf(m.h)
+		leaves[l] ^= itemDigest(m.h, m.ver)
+		items[l] = append(items[l], merkleItem{key: key, ver: m.ver})
+	}
+
+	t := buildMerkle(leaves)
+	t.items = items
+	return t
+}
+
+func (c *Cluster) treeFor(peer string) *merkleTree {
+	t := c.merkleFor(peer)
+	now := time.Now()
+
+	c.ae.mu.Lock()
+	defer c.ae.mu.Unlock()
+	if c.ae.trees == nil {
+		c.ae.trees = make(map[string]aeTree)
+	}
+	for p, at := range c.ae.trees {
+		if now.Sub(at.built) > aeTreeTTL {
+			delete(c.ae.trees, p)
+		}
+	}
+	c.ae.trees[peer] = aeTree{t: t, built: now}
+	return t
+}
+
+func (c *Cluster) leafItems(peer string, leaves []int) []merkleItem {
+	c.ae.mu.Lock()
+	at, ok := c.ae.trees[peer]
+	delete(c.ae.trees, peer)
+	c.ae.mu.Unlock()
+
+	t := at.t
+	if !ok || time.Since(at.built) > aeTreeTTL {
+		t = c.merkleFor(peer)
+	}
+	var items []merkleItem
+	for _, l := range leaves {
+		if l >= 0 && l < merkleLeaves {
+			items = append(items, t.items[l]...)
+		}
+	}
+	return items
+}
+
+func (c *Cluster) antiEntropy(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		for _, peer := range c.getNodes() {
+			if peer == c.self {
+				continue
+			}
+			n, err := c.syncPeer(peer)
+			if err != nil {
+				log.Printf("anti-entropy %s: %v", peer, err)
+				continue
+			}
+			c.aeRepaired.Add(int64(n))
+		}
+		c.aeRounds.Add(1)
+		c.aeLast.Store(time.Now().Unix())
+	}
+}
+
+// syncPeer only pushes; peer's own rounds cover the other direction.
+func (c *Cluster) syncPeer(peer string) (int, error) {
+	local := c.merkleFor(peer)
+
+	leaves, err := c.client.Tree(peer, c.self, c.authKey)
+	if err != nil {
+		return 0, err
+	}
+	if len(leaves) != merkleLeaves {
+		return 0, fmt.Errorf("tree size mismatch")
+	}
+	tree := buildMerkle(leaves)
+	if tree.root() == local.root() {
+		return 0, nil
+	}
+
+	diff := local.diff(tree)
+	remote, err := c.client.LeafItems(peer, c.self, c.authKey, diff)
+	if err != nil {
+		return 0, err
+	}
+	have := make(map[string]version, len(remote))
+	for _, it := range remote {
+		have[it.key] = it.ver
+	}
+
+	sent := 0
+	var batch [][]byte
+	size := 0
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := c.client.SyncBatch(peer, c.authKey, batch); err != nil {
+			return err
+		}
+		sent += len(batch)
+		batch, size = batch[:0], 0
+		return nil
+	}
+
+	for _, l := range diff {
+		for _, it := range local.items[l] {
+			if v, ok := have[it.key]; ok && !v.less(it.ver) {
+				continue
+			}
+			data, ok := c.storage.lookup(it.key)
+			if !ok {
+				continue
+			}
+			batch = append(batch, data)
+			size += len(data)
+			if size >= antiEntropyBatch {
+				if err := flush(); err != nil {
+					return sent, err
+				}
+			}
+		}
+	}
+	return sent, flush()
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestAntiEntropy(t *testing.T) {
+	nodes := startCluster(t, 3, 1)
+	for i := range 200 {
+		if err := nodes[0].v.cluster.write(fmt.Sprintf("k%d", i), []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, "replication", func() bool {
+		keys, _ := nodes[2].v.storage.Scan("", "", 1000)
+		return len(keys) == 200
+	})
+	for i := 0; i < 200; i += 7 {
+		k := fmt.Sprintf("k%d", i)
+		nodes[2].v.storage.remove(k, hash64str(k))
+	}
+	if err := nodes[1].v.storage.Set("k3", []byte("newer")); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := nodes[0].v.cluster.syncPeer(nodes[2].addr); err != nil || n != 29 {
+		t.Fatalf("pushed %d keys, %v", n, err)
+	}
+	if n, err := nodes[1].v.cluster.syncPeer(nodes[2].addr); err != nil || n != 1 {
+		t.Fatalf("pushed %d keys, %v", n, err)
+	}
+	if v, _ := nodes[2].v.storage.Get("k3"); string(v) != "newer" {
+		t.Fatalf("k3: %q", v)
+	}
+	if n, err := nodes[0].v.cluster.syncPeer(nodes[2].addr); err != nil || n != 0 {
+		t.Fatalf("pushed %d keys once in sync, %v", n, err)
+	}
+}
+
+func TestAntiEntropyPartialOwnership(t *testing.T) {
+	nodes := startCluster(t, 5, 1)
+	c := nodes[0].v.cluster
+	for i := range 300 {
+		if err := nodes[i%5].v.cluster.write(fmt.Sprintf("c%d", i), []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	holds := func(n *testNode, k string) bool {
+		_, ok := n.v.storage.lookup(k)
+		return ok
+	}
+	waitFor(t, "replication", func() bool {
+		for i := range 300 {
+			k := fmt.Sprintf("c%d", i)
+			for _, n := range nodes {
+				if holds(n, k) != c.owners(k, n.addr) {
+					return false
+				}
+			}
+		}
+		return true
+	})
+	// every fifth key is left on its first owner only.
+	for i := 0; i < 300; i += 5 {
+		k := fmt.Sprintf("c%d", i)
+		kept := false
+		for _, n := range nodes {
+			if c.owners(k, n.addr) {
+				if kept {
+					n.v.storage.remove(k, hash64str(k))
+				}
+				kept = true
+			}
+		}
+	}
+
+	for _, n := range nodes {
+		for _, p := range nodes {
+			if n == p {
+				continue
+			}
+			if _, err := n.v.cluster.syncPeer(p.addr); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for i := range 300 {
+		k := fmt.Sprintf("c%d", i)
+		for _, n := range nodes {
+			if holds(n, k) != c.owners(k, n.addr) {
+				t.Fatalf("%s on %s: held %v", k, n.addr, holds(n, k))
+			}
+		}
+	}
+	c.ae.mu.Lock()
+	cached := len(c.ae.owners)
+	c.ae.mu.Unlock()
+	if cached == 0 {
+		t.Fatal("no owners cached")
+	}
+}
+
+func TestLeafItemsFromTree(t *testing.T) {
+	nodes := startCluster(t, 3, 1)
+	c := nodes[0].v.cluster
+	peer := nodes[1].addr
+	for i := range 50 {
+		if err := c.write(fmt.Sprintf("a%d", i), []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	held := func(n int) func() bool {
+		return func() bool {
+			keys, _ := nodes[0].v.storage.Scan("", "", 1000)
+			return len(keys) == n
+		}
+	}
+	waitFor(t, "local writes", held(50))
+	var all []int
+	for l := range merkleLeaves {
+		all = append(all, l)
+	}
+
+	c.treeFor(peer)
+	for i := range 50 {
+		if err := c.write(fmt.Sprintf("b%d", i), []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, "local writes", held(100))
+	if n := len(c.leafItems(peer, all)); n != 50 {
+		t.Fatalf("%d items from the tree built for TREE, want 50", n)
+	}
+	if n := len(c.leafItems(peer, all)); n != 100 {
+		t.Fatalf("%d items without one, want 100", n)
+	}
+}
@@ -0,0 +1,432 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Backend stores encoded records by key hash. locking, the index and the
+// cache stay in Storage.
+type Backend interface {
+	Get(h uint64) ([]byte, error)
+	Set(h uint64, data []byte) error
+	Delete(h uint64) error
+	// Batch applies all writes or, after a crash, none.
+	Batch(writes []walEntry) error
+	Scan(fn func(h uint64)) error
+	Open(h uint64) (io.ReadCloser, error)
+	// Create returns a temp file for a streamed record, which Commit moves
+	// into place.
+	Create(h uint64) (*os.File, error)
+	Commit(h uint64, tmp string, head record) error
+	Stats() map[string]interface{}
+	Close() error
+}
+
+// OpenBackend opens "files", "segments" or "memory" on dir.
+func OpenBackend(name, dir string, mode durability) (Backend, error) {
+	switch name {
+	case "files":
+		return newFileBackend(dir, mode)
+	case "segments":
+		return newSegmentBackend(filepath.Join(dir, "segments"), mode)
+	case "memory":
+		return newMemBackend(), nil
+	}
+	return nil, fmt.Errorf("unknown engine: %s (use: files, segments, memory)", name)
+}
+
+// fileBackend keeps a file per record behind a wal. keys says which files
+// exist, so a read never opens one that doesn't.
+type fileBackend struct {
+	dir      string
+	wal      *wal
+	report   replayReport
+	keys     *hashIndex
+	keysFrom string
+
+	// writes hold ckpt shared until their file is written, so a checkpoint
+	// taking it knows where in the log the written files end.
+	ckpt        sync.RWMutex
+	dmu         sync.Mutex
+	dirty       map[uint64]bool
+	checkpoints atomic.Int64
+	done        chan struct{}
+	wg          sync.WaitGroup
+}
+
+func newFileBackend(dir string, mode durability) (*fileBackend, error) {
+	w, err := newWAL(dir, mode)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &fileBackend{dir: dir, wal: w, dirty: make(map[uint64]bool), done: make(chan struct{})}
+	replayed, err := e.replay()
+	if err != nil {
+		return nil, err
+	}
+	if e.report.records > 0 || e.report.lostBytes > 0 {
+		log.Printf("wal: %s", e.report)
+	}
+	w.seq = e.report.lastSeq
+	if err := w.truncate(); err != nil {
+		return nil, err
+	}
+	if err := e.loadKeys(replayed); err != nil {
+		return nil, err
+	}
+
+	e.wg.Add(1)
+	go e.checkpointer()
+	return e, nil
+}
+
+func (e *fileBackend) checkpointer() {
+	defer e.wg.Done()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	last := time.Now()
+
+	for {
+		select {
+		case <-ticker.C:
+			size := e.wal.size()
+			if size < walCheckpointBytes && (size == 0 || time.Since(last) < walCheckpointInterval) {
+				continue
+			}
+			if err := e.checkpoint(); err != nil {
+				log.Printf("wal checkpoint: %v", err)
+			}
+			last = time.Now()
+		case <-e.done:
+			return
+		}
+	}
+}
+
+// checkpoint fsyncs the files written since the last one, then cuts the log
+// entries that covered them.
+func (e *fileBackend) checkpoint() error {
+	e.ckpt.Lock()
+	e.dmu.Lock()
+	dirty := e.dirty
+	e.dirty = make(map[uint64]bool)
+	e.dmu.Unlock()
+	off := e.wal.size()
+	e.ckpt.Unlock()
+
+	err := e.syncFiles(dirty)
+	if err == nil {
+		err = e.wal.cut(off)
+	}
+	if err != nil {
+		e.dmu.Lock()
+		for h := range dirty {
+			e.dirty[h] = true
+		}
+		e.dmu.Unlock()
+		return err
+	}
+	e.checkpoints.Add(1)
+	return nil
+}
+
+func (e *fileBackend) syncFiles(hashes map[uint64]bool) error {
+	dirs := make(map[string]bool)
+	for h := range hashes {
+		path := e.path(h)
+		dirs[filepath.Dir(path)] = true
+		if err := syncFile(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	for dir := range dirs {
+		if err := syncDir(dir); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *fileBackend) markDirty(h uint64) {
+	e.dmu.Lock()
+	e.dirty[h] = true
+	e.dmu.Unlock()
+}
+
+func (e *fileBackend) loadKeys(replayed []uint64) error {
+	keys, err := loadHashIndex(filepath.Join(e.dir, hashIndexFile))
+	if err == nil {
+		e.keys, e.keysFrom = keys, "snapshot"
+		for _, h := range replayed {
+			if info, err := os.Stat(e.path(h)); err == nil {
+				keys.put(h, info.Size())
+			} else {
+				keys.del(h)
+			}
+		}
+		return nil
+	}
+	if !os.IsNotExist(err) {
+		log.Printf("hash index: %v, scanning %s", err, e.dir)
+	}
+
+	e.keys, e.keysFrom = newHashIndex(), "scan"
+	return e.walk(func(h uint64, size int64) {
+		e.keys.put(h, size)
+	})
+}
+
+func (e *fileBackend) replay() ([]uint64, error) {
+	entries := make(map[uint64][]byte)
+	rep, err := e.wal.replay(func(seq, h uint64, data []byte) error {
+		entries[h] = data
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	e.report = rep
+
+	dirs := make(map[string]bool)
+	hashes := make([]uint64, 0, len(entries))
+	for h, data := range entries {
+		hashes = append(hashes, h)
+		dirs[filepath.Dir(e.path(h))] = true
+		if data == nil {
+			os.Remove(e.path(h))
+			continue
+		}
+		rec := decodeRecord(data)
+		if rec.external {
+			// the value went straight to its file before this was logged.
+			continue
+		}
+		if cur, err := readRecordHead(e.path(h)); err == nil && cur.storedAt(h) && rec.ver.less(cur.ver) {
+			continue
+		}
+		if err := e.writeFile(h, data, true); err != nil {
+			return nil, err
+		}
+	}
+
+	for dir := range dirs {
+		if err := syncDir(dir); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	return hashes, nil
+}
+
+func (e *fileBackend) path(h uint64) string {
+	hex := fmtHex(h)
+	return filepath.Join(e.dir, hex[:2], hex)
+}
+
+// writeFile only creates the subdirectory once a write into it failed.
+func (e *fileBackend) writeFile(h uint64, data []byte, sync bool) error {
+	path := e.path(h)
+	f, err := os.CreateTemp(filepath.Dir(path), fmtHex(h)+"-*.tmp")
+	if os.IsNotExist(err) {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		f, err = os.CreateTemp(filepath.Dir(path), fmtHex(h)+"-*.tmp")
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(data)
+	if err == nil && sync {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+func syncFile(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// Batch doesn't sync the files: until a checkpoint does, the wal is the copy
+// that counts.
+func (e *fileBackend) Batch(entries []walEntry) error {
+	e.ckpt.RLock()
+	defer e.ckpt.RUnlock()
+
+	var err error
+	if len(entries) == 1 {
+		err = e.wal.append(entries[0].hash, entries[0].data)
+	} else {
+		err = e.wal.appendTx(entries)
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, en := range entries {
+		e.markDirty(en.hash)
+		if en.data == nil {
+			e.keys.del(en.hash)
+			os.Remove(e.path(en.hash))
+			continue
+		}
+		if err := e.writeFile(en.hash, en.data, false); err != nil {
+			return err
+		}
+		e.keys.put(en.hash, int64(len(en.data)))
+	}
+	return nil
+}
+
+func (e *fileBackend) Set(h uint64, data []byte) error {
+	return e.Batch([]walEntry{{hash: h, data: data}})
+}
+
+func (e *fileBackend) Delete(h uint64) error {
+	return e.Batch([]walEntry{{hash: h}})
+}
+
+func (e *fileBackend) Get(h uint64) ([]byte, error) {
+	if _, ok := e.keys.get(h); !ok {
+		return nil, os.ErrNotExist
+	}
+	return os.ReadFile(e.path(h))
+}
+
+func (e *fileBackend) Open(h uint64) (io.ReadCloser, error) {
+	if _, ok := e.keys.get(h); !ok {
+		return nil, os.ErrNotExist
+	}
+	return os.Open(e.path(h))
+}
+
+func (e *fileBackend) Create(h uint64) (*os.File, error) {
+	dir := filepath.Dir(e.path(h))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return os.CreateTemp(dir, fmtHex(h)+"-*.tmp")
+}
+
+// Commit syncs the file itself unless writes are async: the wal only logs
+// its head, so nothing else can bring the value back.
+func (e *fileBackend) Commit(h uint64, tmp string, head record) error {
+	e.ckpt.RLock()
+	defer e.ckpt.RUnlock()
+
+	if e.wal.mode != durAsync {
+		if err := syncFile(tmp); err != nil {
+			os.Remove(tmp)
+			return err
+		}
+	}
+	info, err := os.Stat(tmp)
+	if err == nil {
+		err = os.Rename(tmp, e.path(h))
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	e.keys.put(h, info.Size())
+	e.markDirty(h)
+	head.value = nil
+	head.external = true
+	return e.wal.append(h, head.encode())
+}
+
+func (e *fileBackend) Scan(fn func(h uint64)) error {
+	for _, h := range e.keys.hashes() {
+		fn(h)
+	}
+	return nil
+}
+
+func (e *fileBackend) walk(fn func(h uint64, size int64)) error {
+	return filepath.Walk(e.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info.IsDir() {
+			if path != e.dir && len(info.Name()) != 2 {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if filepath.Ext(path) == ".tmp" {
+			os.Remove(path)
+			return nil
+		}
+		if filepath.Dir(path) == e.dir {
+			// the wal and snapshots, not records.
+			return nil
+		}
+		fn(parseHex(filepath.Base(path)), info.Size())
+		return nil
+	})
+}
+
+func (e *fileBackend) Stats() map[string]interface{} {
+	keys, bytes := e.keys.stats()
+	return map[string]interface{}{
+		"engine":      "files",
+		"durability":  e.wal.mode.String(),
+		"replay":      e.report.stats(),
+		"keys":        keys,
+		"bytes":       bytes,
+		"index":       e.keysFrom,
+		"checkpoints": e.checkpoints.Load(),
+	}
+}
+
+func (e *fileBackend) Close() error {
+	close(e.done)
+	e.wg.Wait()
+	e.wal.close()
+	return e.keys.save(filepath.Join(e.dir, hashIndexFile))
+}
+
+func readRecordHead(path string) (record, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return record{}, err
+	}
+	defer f.Close()
+
+	head, _ := readHead(f)
+	if head == nil {
+		return record{}, nil
+	}
+	return decodeRecord(head), nil
+}
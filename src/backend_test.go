@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"slices"
+	"testing"
+)
+
+func TestBackends(t *testing.T) {
+	for _, engine := range []string{"files", "segments", "memory"} {
+		t.Run(engine, func(t *testing.T) {
+			b, err := OpenBackend(engine, t.TempDir(), durGroup)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer b.Close()
+			enc := func(key, value string) []byte {
+				return (&record{key: key, value: []byte(value)}).encode()
+			}
+
+			a, c := hash64str("a"), hash64str("c")
+			if err := b.Set(a, enc("a", "1")); err != nil {
+				t.Fatal(err)
+			}
+			if data, err := b.Get(a); err != nil || !bytes.Equal(data, enc("a", "1")) {
+				t.Fatalf("get: %q %v", data, err)
+			}
+			if err := b.Delete(a); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := b.Get(a); err == nil {
+				t.Fatal("deleted record read")
+			}
+
+			writes := []walEntry{
+				{hash: a, data: enc("a", "2")},
+				{hash: hash64str("b"), data: enc("b", "2")},
+				{hash: hash64str("b")},
+			}
+			if err := b.Batch(writes); err != nil {
+				t.Fatal(err)
+			}
+			if data, err := b.Get(a); err != nil || !bytes.Equal(data, enc("a", "2")) {
+				t.Fatalf("batched write: %q %v", data, err)
+			}
+			if _, err := b.Get(hash64str("b")); err == nil {
+				t.Fatal("batched delete missed")
+			}
+
+			f, err := b.Create(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			head := record{key: "c", value: bytes.Repeat([]byte("s"), 1<<16)}
+			f.Write(head.encode())
+			f.Close()
+			if err := b.Commit(c, f.Name(), head); err != nil {
+				t.Fatal(err)
+			}
+			r, err := b.Open(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := io.ReadAll(r)
+			r.Close()
+			if err != nil || !bytes.Equal(data, head.encode()) {
+				t.Fatalf("streamed record: %d bytes, %v", len(data), err)
+			}
+
+			var hashes []uint64
+			b.Scan(func(h uint64) { hashes = append(hashes, h) })
+			slices.Sort(hashes)
+			want := []uint64{a, c}
+			slices.Sort(want)
+			if !slices.Equal(hashes, want) {
+				t.Fatalf("scan: %v, want %v", hashes, want)
+			}
+			if b.Stats()["engine"] == nil {
+				t.Fatalf("stats: %v", b.Stats())
+			}
+		})
+	}
+	if _, err := OpenBackend("nope", t.TempDir(), durGroup); err == nil {
+		t.Fatal("unknown engine opened")
+	}
+}
+
+func TestMemoryStorage(t *testing.T) {
+	s, err := NewStorageEngine(t.TempDir(), "memory", durGroup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err := s.Set("k", []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	s.cache.del(hash64str("k"))
+	if v, err := s.Get("k"); err != nil || string(v) != "v" {
+		t.Fatalf("get: %q %v", v, err)
+	}
+	if err := s.SetFrom("big", bytes.NewReader(bytes.Repeat([]byte("b"), 1<<20)), 0); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if _, err := s.GetTo("big", &buf); err != nil || buf.Len() != 1<<20 {
+		t.Fatalf("streamed: %d bytes, %v", buf.Len(), err)
+	}
+	if keys, _ := s.Scan("", "", 10); !slices.Equal(keys, []string{"big", "k"}) {
+		t.Fatalf("scan: %v", keys)
+	}
+}
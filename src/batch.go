@@ -0,0 +1,410 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const maxBatchKeys = 10000
+
+// encodeKeys frames keys as [count:u32]([keylen:u16][key])*.
+func encodeKeys(keys []string) []byte {
+	size := 4
+	for _, k := range keys {
+		size += 2 + len(k)
+	}
+	buf := make([]byte, size)
+	binary.LittleEndian.PutUint32(buf, uint32(len(keys)))
+	n := 4
+	for _, k := range keys {
+		binary.LittleEndian.PutUint16(buf[n:], uint16(len(k)))
+		n += 2
+		n += copy(buf[n:], k)
+	}
+	return buf
+}
+
+func decodeKeys(b []byte) ([]string, error) {
+	if len(b) < 4 {
+		return nil, fmt.Errorf("truncated keys")
+	}
+	count := binary.LittleEndian.Uint32(b)
+	if count > maxBatchKeys {
+		return nil, fmt.Errorf("too many keys")
+	}
+	b = b[4:]
+	keys := make([]string, 0, count)
+	for range count {
+		if len(b) < 2 {
+			return nil, fmt.Errorf("truncated keys")
+		}
+		kl := int(binary.LittleEndian.Uint16(b))
+		if 2+kl > len(b) {
+			return nil, fmt.Errorf("truncated keys")
+		}
+		keys = append(keys, string(b[2:2+kl]))
+		b = b[2+kl:]
+	}
+	return keys, nil
+}
+
+// encodeItems frames key/value pairs as
+// [count:u32]([keylen:u16][key][vallen:u32][value])*.
+func encodeItems(keys []string, values [][]byte) []byte {
+	size := 4
+	for i, k := range keys {
+		size += 2 + len(k) + 4 + len(values[i])
+	}
+	buf := make([]byte, size)
+	binary.LittleEndian.PutUint32(buf, uint32(len(keys)))
+	n := 4
+	for i, k := range keys {
+		binary.LittleEndian.PutUint16(buf[n:], uint16(len(k)))
+		n += 2
+		n += copy(buf[n:], k)
+		binary.LittleEndian.PutUint32(buf[n:], uint32(len(values[i])))
+		n += 4
+		n += copy(buf[n:], values[i])
+	}
+	return buf
+}
+
+func decodeItems(b []byte) ([]string, [][]byte, error) {
+	if len(b) < 4 {
+		return nil, nil, fmt.Errorf("truncated items")
+	}
+	count := binary.LittleEndian.Uint32(b)
+	if count > maxBatchKeys {
+		return nil, nil, fmt.Errorf("too many keys")
+	}
+	b = b[4:]
+	keys := make([]string, 0, count)
+	values := make([][]byte, 0, count)
+	for range count {
+		if len(b) < 2 {
+			return nil, nil, fmt.Errorf("truncated items")
+		}
+		kl := int(binary.LittleEndian.Uint16(b))
+		if 2+kl+4 > len(b) {
+			return nil, nil, fmt.Errorf("truncated items")
+		}
+		vl := int(binary.LittleEndian.Uint32(b[2+kl:]))
+		if 2+kl+4+vl > len(b) {
+			return nil, nil, fmt.Errorf("truncated items")
+		}
+		keys = append(keys, string(b[2:2+kl]))
+		values = append(values, b[2+kl+4:2+kl+4+vl])
+		b = b[2+kl+4+vl:]
+	}
+	return keys, values, nil
+}
+
+// encodeResults frames per-key answers as [count:u32]([status:u8][len:u32][data])*.
+func encodeResults(status []byte, data [][]byte) []byte {
+	size := 4
+	for i := range status {
+		size += 5 + len(data[i])
+	}
+	buf := make([]byte, size)
+	binary.LittleEndian.PutUint32(buf, uint32(len(status)))
+	n := 4
+	for i, st := range status {
+		buf[n] = st
+		binary.LittleEndian.PutUint32(buf[n+1:], uint32(len(data[i])))
+		n += 5
+		n += copy(buf[n:], data[i])
+	}
+	return buf
+}
+
+func decodeResults(b []byte) ([]byte, [][]byte, error) {
+	if len(b) < 4 {
+		return nil, nil, fmt.Errorf("truncated results")
+	}
+	count := binary.LittleEndian.Uint32(b)
+	if count > maxBatchKeys {
+		return nil, nil, fmt.Errorf("too many results")
+	}
+	b = b[4:]
+	status := make([]byte, 0, count)
+	data := make([][]byte, 0, count)
+	for range count {
+		if len(b) < 5 {
+			return nil, nil, fmt.Errorf("truncated results")
+		}
+		l := int(binary.LittleEndian.Uint32(b[1:]))
+		if 5+l > len(b) {
+			return nil, nil, fmt.Errorf("truncated results")
+		}
+		status = append(status, b[0])
+		data = append(data, b[5:5+l])
+		b = b[5+l:]
+	}
+	return status, data, nil
+}
+
+func groupByOwner(owners [][]string) map[string][]int {
+	groups := make(map[string][]int)
+	for i, nodes := range owners {
+		for _, n := range nodes {
+			groups[n] = append(groups[n], i)
+		}
+	}
+	return groups
+}
+
+// writeBatch returns 0x00 for each key a quorum of owners stored, 0xFF
+// otherwise.
+func (c *Cluster) writeBatch(keys []string, values [][]byte, ctype string, ttl time.Duration) []byte {
+	recs := make([]record, len(keys))
+	for i, key := range keys {
+		recs[i] = c.storage.newRecord(key, values[i])
+		recs[i].ctype = ctype
+		if ttl > 0 {
+			recs[i].expires = time.Now().Add(ttl).UnixMilli()
+		}
+	}
+	return c.replicate(recs)
+}
+
+func (c *Cluster) deleteBatch(keys []string) []byte {
+	recs := make([]record, len(keys))
+	for i, key := range keys {
+		recs[i] = c.storage.tombstone(c.storage.newRecord(key, nil))
+	}
+	return c.replicate(recs)
+}
+
+// replicate sends each owner all of its records in one SYNC_BATCH.
+func (c *Cluster) replicate(recs []record) []byte {
+	encoded := make([][]byte, len(recs))
+	owners := make([][]string, len(recs))
+	for i, rec := range recs {
+		encoded[i] = rec.encode()
+		owners[i] = c.hash(rec.key, ReplicaCount)
+	}
+
+	acks := make([]atomic.Int32, len(recs))
+	var wg sync.WaitGroup
+	for node, idx := range groupByOwner(owners) {
+		wg.Add(1)
+		go func(node string, idx []int) {
+			defer wg.Done()
+			if node == c.self {
+				for _, i := range idx {
+					if err := c.storage.put(recs[i]); err == nil || err == errStale {
+						acks[i].Add(1)
+					}
+				}
+				return
+			}
+
+			batch := make([][]byte, len(idx))
+			for j, i := range idx {
+				batch[j] = encoded[i]
+			}
+			if err := c.client.SyncBatch(node, c.authKey, batch); err != nil {
+				for _, i := range idx {
+					c.hint(node, encoded[i])
+				}
+				return
+			}
+			for _, i := range idx {
+				acks[i].Add(1)
+			}
+		}(node, idx)
+	}
+	wg.Wait()
+
+	status := make([]byte, len(recs))
+	for i := range recs {
+		if len(owners[i]) == 0 || int(acks[i].Load()) < len(owners[i])/2+1 {
+			status[i] = 0xFF
+		}
+	}
+	return status
+}
+
+// readBatch asks each owner once, with MFETCH. a key missing its read quorum
+// gets status 0xFF.
+func (c *Cluster) readBatch(keys []string) ([]record, []byte) {
+	recs := make([]record, len(keys))
+	status := make([]byte, len(keys))
+	owners := make([][]string, len(keys))
+
+	for i, key := range keys {
+		nodes := c.hash(key, ReplicaCount)
+		if len(nodes) == 0 {
+			status[i] = 0xFF
+			continue
+		}
+		if c.readQuorum <= 1 && slices.Contains(nodes, c.self) {
+			if data, ok := c.storage.fetch(key); ok {
+				recs[i] = decodeRecord(data)
+			} else {
+				status[i] = statusNotFound
+			}
+			continue
+		}
+		owners[i] = nodes
+	}
+
+	type reply struct {
+		idx    []int
+		status []byte
+		data   [][]byte
+	}
+	groups := groupByOwner(owners)
+	replies := make(chan reply, len(groups))
+	for node, idx := range groups {
+		go func(node string, idx []int) {
+			r := reply{idx: idx}
+			if node == c.self {
+				r.status = make([]byte, len(idx))
+				r.data = make([][]byte, len(idx))
+				for j, i := range idx {
+					data, ok := c.storage.lookup(keys[i])
+					if !ok {
+						r.status[j] = statusNotFound
+					}
+					r.data[j] = data
+				}
+				replies <- r
+				return
+			}
+
+			batch := make([]string, len(idx))
+			for j, i := range idx {
+				batch[j] = keys[i]
+			}
+			st, data, err := c.client.FetchBatch(node, c.authKey, batch)
+			if err == nil && len(st) == len(idx) {
+				r.status, r.data = st, data
+			}
+			replies <- r
+		}(node, idx)
+	}
+
+	answers := make([]int, len(keys))
+	found := make([]bool, len(keys))
+	timeout := time.After(ReadTimeout)
+collect:
+	for range groups {
+		select {
+		case r := <-replies:
+			for j, i := range r.idx {
+				if r.status == nil {
+					continue
+				}
+				switch r.status[j] {
+				case 0x00:
+					answers[i]++
+					rec := decodeRecord(r.data[j])
+					if !found[i] || recs[i].ver.less(rec.ver) {
+						recs[i], found[i] = rec, true
+					}
+				case statusNotFound:
+					answers[i]++
+				}
+			}
+		case <-timeout:
+			break collect
+		}
+	}
+
+	for i, nodes := range owners {
+		if nodes == nil {
+			continue
+		}
+		switch {
+		case answers[i] < min(c.readQuorum, len(nodes)):
+			status[i] = 0xFF
+		case !found[i] || recs[i].deleted:
+			status[i] = statusNotFound
+		}
+	}
+	return recs, status
+}
+
+func batchStatus(status []byte) []byte {
+	return encodeResults(status, make([][]byte, len(status)))
+}
+
+// MGet returns nil for missing keys.
+func (c *BinaryClient) MGet(addr, authKey string, keys []string) ([][]byte, error) {
+	st, data, err := c.batchCall(addr, authKey, OpMGet, encodeKeys(keys))
+	if err != nil {
+		return nil, err
+	}
+	values := make([][]byte, len(keys))
+	for i := range st {
+		switch st[i] {
+		case 0x00:
+			values[i] = data[i]
+		case statusNotFound:
+		default:
+			return nil, fmt.Errorf("get %q failed", keys[i])
+		}
+	}
+	return values, nil
+}
+
+func (c *BinaryClient) MSet(addr, authKey string, keys []string, values [][]byte, ttl time.Duration) ([]bool, error) {
+	body := encodeItems(keys, values)
+	req := keyRequest(OpMSet, "", 5)
+	binary.LittleEndian.PutUint32(req[3:], uint32(len(body)))
+	if ttl > 0 {
+		req[7] = valTTL
+		req = binary.LittleEndian.AppendUint32(req, uint32(ttl/time.Second))
+	}
+	req = append(req, body...)
+	st, _, err := c.batchRequest(addr, authKey, req, len(keys))
+	return okStatus(st), err
+}
+
+func (c *BinaryClient) MDelete(addr, authKey string, keys []string) ([]bool, error) {
+	st, _, err := c.batchCall(addr, authKey, OpMDelete, encodeKeys(keys))
+	return okStatus(st), err
+}
+
+func (c *BinaryClient) FetchBatch(addr, authKey string, keys []string) ([]byte, [][]byte, error) {
+	return c.batchCall(addr, authKey, OpMFetch, encodeKeys(keys))
+}
+
+func (c *BinaryClient) batchCall(addr, authKey string, op byte, body []byte) ([]byte, [][]byte, error) {
+	count := int(binary.LittleEndian.Uint32(body))
+	return c.batchRequest(addr, authKey, syncRequest(op, "", nil, body), count)
+}
+
+func (c *BinaryClient) batchRequest(addr, authKey string, req []byte, count int) ([]byte, [][]byte, error) {
+	status, payload, err := c.call(addr, authKey, req)
+	if err != nil {
+		return nil, nil, err
+	}
+	if status != 0x00 {
+		return nil, nil, fmt.Errorf("batch failed")
+	}
+	st, data, err := decodeResults(payload)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(st) != count {
+		return nil, nil, fmt.Errorf("batch size mismatch")
+	}
+	return st, data, nil
+}
+
+func okStatus(status []byte) []bool {
+	if status == nil {
+		return nil
+	}
+	ok := make([]bool, len(status))
+	for i, st := range status {
+		ok[i] = st == 0x00
+	}
+	return ok
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBatch(t *testing.T) {
+	for _, rq := range []int{1, 2} {
+		t.Run("ReadQuorum"+strconv.Itoa(rq), func(t *testing.T) {
+			nodes := startCluster(t, 4, rq)
+			c := NewBinaryClient()
+			var keys []string
+			var vals [][]byte
+			for i := range 200 {
+				keys = append(keys, fmt.Sprintf("b%d", i))
+				vals = append(vals, []byte(fmt.Sprintf("v%d", i)))
+			}
+			ok, err := c.MSet(nodes[0].addr, "", keys, vals, time.Hour)
+			if err != nil || len(ok) != len(keys) {
+				t.Fatalf("mset: %d results, %v", len(ok), err)
+			}
+			for i := range ok {
+				if !ok[i] {
+					t.Fatalf("%s not set", keys[i])
+				}
+			}
+
+			got, err := c.MGet(nodes[1].addr, "", append(keys, "missing"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := range keys {
+				if string(got[i]) != string(vals[i]) {
+					t.Fatalf("%s: %q", keys[i], got[i])
+				}
+			}
+			if got[len(keys)] != nil {
+				t.Fatalf("missing key: %q", got[len(keys)])
+			}
+
+			ok, err = c.MDelete(nodes[2].addr, "", keys[:100])
+			if err != nil || !ok[0] || !ok[99] {
+				t.Fatalf("mdelete: %v %v", ok, err)
+			}
+			if got, _ = c.MGet(nodes[3].addr, "", keys[:101]); got[0] != nil || got[99] != nil || got[100] == nil {
+				t.Fatal("deleted keys still read")
+			}
+		})
+	}
+}
+
+func TestHTTPBatch(t *testing.T) {
+	h := newTestHTTP(t)
+	if w := do(h, "POST", "/_/batch/set", `{"values":{"a":1,"b":{"x":"y"}}}`, nil); !strings.Contains(w.Body.String(), `"success":true`) {
+		t.Fatal(w.Body)
+	}
+	if w := do(h, "POST", "/_/batch/get", `{"keys":["a","b","c"]}`, nil); !strings.Contains(w.Body.String(), `"data":{"a":1,"b":{"x":"y"}}`) {
+		t.Fatal(w.Body)
+	}
+	if w := do(h, "GET", "/b", "", nil); w.Body.String() != `{"x":"y"}` || w.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("%q as %q", w.Body.String(), w.Header().Get("Content-Type"))
+	}
+	if w := do(h, "POST", "/_/batch/delete", `{"keys":["a"]}`, nil); !strings.Contains(w.Body.String(), `"results":{"a":true}`) {
+		t.Fatal(w.Body)
+	}
+	if w := do(h, "GET", "/a", "", nil); w.Code != 404 {
+		t.Fatal(w.Code, w.Body)
+	}
+
+	t.Run("Reserved", func(t *testing.T) {
+		for _, body := range []string{`{"values":{"_/x":1}}`, `{"keys":["_/x"]}`} {
+			if w := do(h, "POST", "/_/batch/set", body, nil); w.Code != 400 {
+				t.Fatal(body, w.Code, w.Body)
+			}
+		}
+		if w := do(h, "POST", "/_/foo", "1", nil); w.Code != 404 {
+			t.Fatal(w.Code, w.Body)
+		}
+		for _, key := range []string{"_batch/get", "_tx"} {
+			if w := do(h, "POST", "/"+key, "v", nil); w.Code != 200 {
+				t.Fatal(key, w.Code, w.Body)
+			}
+			if w := do(h, "GET", "/"+key, "", nil); w.Body.String() != "v" {
+				t.Fatal(key, w.Code, w.Body)
+			}
+		}
+	})
+}
@@ -6,8 +6,8 @@ import (
 	"fmt"
 	"io"
 	"net"
-	"runtime"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/time/rate"
@@ -16,28 +16,156 @@ import (
 var hdrPool = sync.Pool{New: func() interface{} { return make([]byte, 5) }}
 
 const (
-	OpGet    = 0x01
-	OpSet    = 0x02
-	OpDelete = 0x03
-	OpSync   = 0x04
-	OpHealth = 0x05
-	OpAuth   = 0x06
+	OpGet       = 0x01
+	OpSet       = 0x02
+	OpDelete    = 0x03
+	OpSync      = 0x04
+	OpHealth    = 0x05
+	OpAuth      = 0x06
+	OpScan      = 0x07
+	OpFetch     = 0x08
+	OpCas       = 0x09
+	OpDelIf     = 0x0A
+	OpGetV      = 0x0B
+	OpSyncIf    = 0x0C
+	OpTree      = 0x0E
+	OpLeafItems = 0x0F
+	OpSyncBatch = 0x10
+	OpPing      = 0x11
+	OpPingReq   = 0x12
+	OpSetBegin  = 0x13
+	OpSetChunk  = 0x14
+	OpSetEnd    = 0x15
+	OpGetStream = 0x16
+	OpSyncBegin = 0x17
+
+	OpMGet    = 0x18
+	OpMSet    = 0x19
+	OpMDelete = 0x1A
+	OpMFetch  = 0x1B
+	OpHello   = 0x1D
+
+	OpTx        = 0x1E
+	OpTxPrepare = 0x1F
+	OpTxCommit  = 0x20
+	OpTxAbort   = 0x21
+
+	OpFetchHead   = 0x22
+	OpFetchStream = 0x23
+	OpScanLocal   = 0x24
 )
 
-func writeErr(conn net.Conn) error {
-	_, err := conn.Write([]byte{0xFF, 0, 0, 0, 0})
+const batchMaxSize = recMaxSize + antiEntropyBatch
+
+const (
+	statusNotFound = 0x01
+	statusConflict = 0x02
+)
+
+const (
+	valCompressed = 0x01
+	valTTL        = 0x02
+)
+
+func writeErr(w io.Writer) error {
+	_, err := w.Write([]byte{0xFF, 0, 0, 0, 0})
 	return err
 }
 
+func writeResp(w io.Writer, status byte, payload []byte) error {
+	return writeRespParts(w, status, payload)
+}
+
+// writeRespParts never copies parts into one buffer, so a value can be sent
+// straight from the cache.
+func writeRespParts(w io.Writer, status byte, parts ...[]byte) error {
+	respHdr := hdrPool.Get().([]byte)
+	defer hdrPool.Put(respHdr)
+	n := 0
+	for _, p := range parts {
+		n += len(p)
+	}
+	respHdr[0] = status
+	binary.LittleEndian.PutUint32(respHdr[1:], uint32(n))
+
+	bufs := make(net.Buffers, 0, 1+len(parts))
+	bufs = append(bufs, respHdr)
+	for _, p := range parts {
+		if len(p) > 0 {
+			bufs = append(bufs, p)
+		}
+	}
+	if fw, ok := w.(*frameWriter); ok {
+		return fw.writeFrame(bufs)
+	}
+	_, err := bufs.WriteTo(w)
+	return err
+}
+
+func writeStatus(w io.Writer, err error) error {
+	switch err {
+	case nil:
+		return writeResp(w, 0x00, nil)
+	case errConflict:
+		return writeResp(w, statusConflict, nil)
+	}
+	return writeErr(w)
+}
+
+func isWriteOp(op byte) bool {
+	switch op {
+	case OpSet, OpDelete, OpSync, OpCas, OpDelIf, OpSyncIf, OpSyncBatch, OpPing, OpPingReq,
+		OpSetBegin, OpSetChunk, OpSetEnd, OpSyncBegin, OpMSet, OpMDelete,
+		OpTx, OpTxPrepare, OpTxCommit, OpTxAbort:
+		return true
+	}
+	return false
+}
+
+// readValue reads [vallen:u32][flags:u8]([ttl:u32])[val]. ok is false when
+// the value was rejected but the connection is still usable.
+func readValue(r io.Reader, hdr []byte, buf *[]byte, limit int) (data []byte, ttl time.Duration, ok bool, err error) {
+	if _, err := io.ReadFull(r, hdr[:5]); err != nil {
+		return nil, 0, false, err
+	}
+	valLen := binary.LittleEndian.Uint32(hdr[:4])
+	flags := hdr[4]
+
+	if flags&valTTL != 0 {
+		if _, err := io.ReadFull(r, hdr[:4]); err != nil {
+			return nil, 0, false, err
+		}
+		ttl = time.Duration(binary.LittleEndian.Uint32(hdr[:4])) * time.Second
+	}
+
+	if valLen > uint32(limit) {
+		return nil, 0, false, nil
+	}
+
+	if cap(*buf) < int(valLen) {
+		*buf = make([]byte, valLen)
+	}
+	*buf = (*buf)[:valLen]
+	if _, err := io.ReadFull(r, *buf); err != nil {
+		return nil, 0, false, err
+	}
+
+	data, err = decompress(*buf, flags&valCompressed != 0)
+	if err != nil || len(data) > limit {
+		return nil, 0, false, nil
+	}
+	return data, ttl, true, nil
+}
+
 type BinaryServer struct {
-	vault      *Vault
-	authKey    string
-	authMode   AuthMode
-	rateLimit  int
-	startTime  time.Time
-	connSem    chan struct{}
-	maxConn    int
-	limiter    *rate.Limiter
+	vault     *Vault
+	authKey   string
+	authMode  AuthMode
+	rateLimit int
+	startTime time.Time
+	connSem   chan struct{}
+	maxConn   int
+	limiter   *rate.Limiter
 }
 
 func NewBinaryServer(vault *Vault, authKey string, authMode AuthMode, rateLimit int, startTime time.Time) *BinaryServer {
@@ -90,6 +218,31 @@ func (s *BinaryServer) Serve(ln net.Listener) error {
 	}
 }
 
+type session struct {
+	authenticated atomic.Bool
+	stream        *clusterStream
+	pipelined     bool
+}
+
+type reqBufs struct {
+	hdr   []byte
+	key   []byte
+	val   []byte
+	cond  []byte
+	chunk []byte
+}
+
+func newReqBufs() *reqBufs {
+	return &reqBufs{
+		hdr:  make([]byte, 7),
+		key:  make([]byte, 0, 1024),
+		val:  make([]byte, 0, 16384),
+		cond: make([]byte, condLen),
+	}
+}
+
+var reqBufPool = sync.Pool{New: func() interface{} { return newReqBufs() }}
+
 func (s *BinaryServer) handle(conn net.Conn) {
 	defer func() {
 		if r := recover(); r != nil {
@@ -97,12 +250,16 @@ func (s *BinaryServer) handle(conn net.Conn) {
 	}()
 	defer conn.Close()
 
-	authenticated := s.authMode == AuthNone
-	hdr := make([]byte, 7)
-	keyBuf := make([]byte, 0, 1024)
-	valBuf := make([]byte, 0, 16384)
+	sess := &session{}
+	sess.authenticated.Store(s.authMode == AuthNone)
+	defer func() {
+		if sess.stream != nil {
+			sess.stream.abort()
+		}
+	}()
+	b := newReqBufs()
 
-	for {
+	for !sess.pipelined {
 		if s.limiter != nil && !s.limiter.Allow() {
 			if writeErr(conn) != nil {
 				return
@@ -110,212 +267,609 @@ func (s *BinaryServer) handle(conn net.Conn) {
 			continue
 		}
 
-		if _, err := io.ReadFull(conn, hdr[:3]); err != nil {
+		if !s.request(sess, conn, conn, b) {
 			return
 		}
+	}
+	s.servePipelined(conn, sess, b)
+}
+
+// request returns false when the connection has to be closed.
+func (s *BinaryServer) request(sess *session, r io.Reader, w io.Writer, b *reqBufs) bool {
+	hdr, keyBuf, condBuf := b.hdr, b.key, b.cond
+
+	if _, err := io.ReadFull(r, hdr[:3]); err != nil {
+		return false
+	}
 
-		op := hdr[0]
-		keyLen := binary.LittleEndian.Uint16(hdr[1:3])
+	op := hdr[0]
+	keyLen := binary.LittleEndian.Uint16(hdr[1:3])
 
-		if cap(keyBuf) < int(keyLen) {
-			keyBuf = make([]byte, keyLen)
+	if cap(keyBuf) < int(keyLen) {
+		keyBuf = make([]byte, keyLen)
+		b.key = keyBuf
+	}
+	keyBuf = keyBuf[:keyLen]
+	if _, err := io.ReadFull(r, keyBuf); err != nil {
+		return false
+	}
+
+	needsAuth := false
+	if s.authMode == AuthAll && op != OpHealth && op != OpAuth {
+		needsAuth = true
+	} else if s.authMode == AuthWrites && isWriteOp(op) {
+		needsAuth = true
+	}
+
+	if needsAuth && !sess.authenticated.Load() {
+		if op == OpSet || op == OpSync {
+			if _, err := io.ReadFull(r, hdr[:5]); err != nil {
+				return false
+			}
+			valLen := binary.LittleEndian.Uint32(hdr[:4])
+			if valLen > uint32(MaxValueSize) {
+				writeErr(w)
+				return false
+			}
+			io.CopyN(io.Discard, r, int64(valLen))
 		}
-		keyBuf = keyBuf[:keyLen]
-		if _, err := io.ReadFull(conn, keyBuf); err != nil {
-			return
+		writeErr(w)
+		return false
+	}
+
+	switch op {
+	case OpAuth:
+		if string(keyBuf) == s.authKey && s.authKey != "" {
+			sess.authenticated.Store(true)
+			if _, err := w.Write([]byte{0x00, 0, 0, 0, 0}); err != nil {
+				return false
+			}
+		} else {
+			if writeErr(w) != nil {
+				return false
+			}
 		}
 
-		needsAuth := false
-		if s.authMode == AuthAll && op != OpHealth && op != OpAuth {
-			needsAuth = true
-		} else if s.authMode == AuthWrites && (op == OpSet || op == OpDelete || op == OpSync) {
-			needsAuth = true
+	case OpGet:
+		rec, err := s.vault.cluster.read(string(keyBuf))
+		if err != nil {
+			if writeErr(w) != nil {
+				return false
+			}
+			return true
 		}
 
-		if needsAuth && !authenticated {
-			if op == OpSet || op == OpSync {
-				if _, err := io.ReadFull(conn, hdr[:5]); err != nil {
-					return
-				}
-				valLen := binary.LittleEndian.Uint32(hdr[:4])
-				if valLen > uint32(MaxValueSize) {
-					writeErr(conn)
-					return
-				}
-				io.CopyN(io.Discard, conn, int64(valLen))
+		if writeResp(w, 0x00, rec.value) != nil {
+			return false
+		}
+
+	case OpGetV:
+		rec, err := s.vault.cluster.read(string(keyBuf))
+		if err != nil {
+			if writeErr(w) != nil {
+				return false
 			}
-			writeErr(conn)
-			return
+			return true
 		}
 
-		switch op {
-		case OpAuth:
-			if string(keyBuf) == s.authKey && s.authKey != "" {
-				authenticated = true
-				if _, err := conn.Write([]byte{0x00, 0, 0, 0, 0}); err != nil {
-					return
-				}
-			} else {
-				if writeErr(conn) != nil {
-					return
-				}
+		ver := make([]byte, versionLen)
+		rec.ver.put(ver)
+		if writeRespParts(w, 0x00, ver, rec.value) != nil {
+			return false
+		}
+
+	case OpFetch:
+		data, ok := s.vault.storage.lookup(string(keyBuf))
+		if !ok {
+			if _, err := w.Write([]byte{statusNotFound, 0, 0, 0, 0}); err != nil {
+				return false
 			}
+			return true
+		}
 
-		case OpGet:
-			data, err := s.vault.storage.Get(string(keyBuf))
-			if err != nil {
-				if writeErr(conn) != nil {
-					return
-				}
-				continue
+		if writeResp(w, 0x00, data) != nil {
+			return false
+		}
+
+	case OpFetchHead:
+		head, ok := s.vault.storage.lookupHead(string(keyBuf))
+		if !ok {
+			if _, err := w.Write([]byte{statusNotFound, 0, 0, 0, 0}); err != nil {
+				return false
 			}
+			return true
+		}
 
-			respHdr := hdrPool.Get().([]byte)
-			respHdr[0] = 0x00
-			binary.LittleEndian.PutUint32(respHdr[1:], uint32(len(data)))
-			if _, err := conn.Write(respHdr); err != nil {
-				hdrPool.Put(respHdr)
-				return
+		if writeResp(w, 0x00, head) != nil {
+			return false
+		}
+
+	case OpSet:
+		data, ttl, ok, err := readValue(r, hdr, &b.val, MaxValueSize)
+		if err != nil {
+			return false
+		}
+		if !ok {
+			if writeErr(w) != nil {
+				return false
 			}
-			hdrPool.Put(respHdr)
-			if _, err := conn.Write(data); err != nil {
-				return
+			return true
+		}
+
+		if _, err := s.vault.cluster.writeIf(string(keyBuf), data, "", ttl, condition{}); err != nil {
+			if writeErr(w) != nil {
+				return false
 			}
+		} else {
+			if _, err := w.Write([]byte{0x00, 0, 0, 0, 0}); err != nil {
+				return false
+			}
+		}
 
-		case OpSet:
-			if _, err := io.ReadFull(conn, hdr[:5]); err != nil {
-				return
+	case OpCas:
+		if _, err := io.ReadFull(r, condBuf); err != nil {
+			return false
+		}
+		cond, condErr := readCondition(condBuf)
+		data, ttl, ok, err := readValue(r, hdr, &b.val, MaxValueSize)
+		if err != nil {
+			return false
+		}
+		if !ok || condErr != nil {
+			if writeErr(w) != nil {
+				return false
 			}
-			valLen := binary.LittleEndian.Uint32(hdr[:4])
-			compressed := hdr[4] == 1
+			return true
+		}
 
-			if valLen > uint32(MaxValueSize) {
-				if writeErr(conn) != nil {
-					return
-				}
-				continue
+		ver, err := s.vault.cluster.writeIf(string(keyBuf), data, "", ttl, cond)
+		if err != nil {
+			if writeStatus(w, err) != nil {
+				return false
 			}
+			return true
+		}
+		resp := make([]byte, versionLen)
+		ver.put(resp)
+		if writeResp(w, 0x00, resp) != nil {
+			return false
+		}
+
+	case OpDelIf:
+		if _, err := io.ReadFull(r, condBuf); err != nil {
+			return false
+		}
+		cond, err := readCondition(condBuf)
+		if err == nil {
+			err = s.vault.cluster.deleteIf(string(keyBuf), cond)
+		}
+		if writeStatus(w, err) != nil {
+			return false
+		}
 
-			if cap(valBuf) < int(valLen) {
-				valBuf = make([]byte, valLen)
+	case OpSyncIf:
+		if _, err := io.ReadFull(r, condBuf); err != nil {
+			return false
+		}
+		cond, condErr := readCondition(condBuf)
+		data, _, ok, err := readValue(r, hdr, &b.val, recMaxSize)
+		if err != nil {
+			return false
+		}
+		if !ok || condErr != nil {
+			if writeErr(w) != nil {
+				return false
 			}
-			valBuf = valBuf[:valLen]
-			if _, err := io.ReadFull(conn, valBuf); err != nil {
-				return
+			return true
+		}
+
+		if writeStatus(w, s.syncRecordIf(string(keyBuf), decodeRecord(data), cond)) != nil {
+			return false
+		}
+
+	case OpTree:
+		t := s.vault.cluster.treeFor(string(keyBuf))
+		resp := make([]byte, 8*merkleLeaves)
+		for i, l := range t.levels[0] {
+			binary.LittleEndian.PutUint64(resp[8*i:], l)
+		}
+		if writeResp(w, 0x00, resp) != nil {
+			return false
+		}
+
+	case OpLeafItems:
+		if _, err := io.ReadFull(r, hdr[:4]); err != nil {
+			return false
+		}
+		count := binary.LittleEndian.Uint32(hdr[:4])
+		if count > merkleLeaves {
+			writeErr(w)
+			return false
+		}
+		body := make([]byte, 4*count)
+		if _, err := io.ReadFull(r, body); err != nil {
+			return false
+		}
+		leaves := make([]int, count)
+		for i := range leaves {
+			leaves[i] = int(binary.LittleEndian.Uint32(body[4*i:]))
+		}
+
+		items := s.vault.cluster.leafItems(string(keyBuf), leaves)
+		size := 4
+		for _, it := range items {
+			size += 2 + len(it.key) + versionLen
+		}
+		resp := make([]byte, size)
+		binary.LittleEndian.PutUint32(resp, uint32(len(items)))
+		n := 4
+		for _, it := range items {
+			binary.LittleEndian.PutUint16(resp[n:], uint16(len(it.key)))
+			n += 2
+			n += copy(resp[n:], it.key)
+			it.ver.put(resp[n:])
+			n += versionLen
+		}
+		if writeResp(w, 0x00, resp) != nil {
+			return false
+		}
+
+	case OpSyncBatch:
+		data, _, ok, err := readValue(r, hdr, &b.val, batchMaxSize)
+		if err != nil {
+			return false
+		}
+		if !ok {
+			if writeErr(w) != nil {
+				return false
 			}
+			return true
+		}
 
-			data, err := decompress(valBuf, compressed)
-			if err != nil {
-				if writeErr(conn) != nil {
-					return
+		records, err := decodeBatch(data)
+		if err == nil {
+			for _, r := range records {
+				rec := decodeRecord(r)
+				if err = s.syncRecord(rec.key, rec); err != nil {
+					break
 				}
-				continue
 			}
+		}
+		if writeStatus(w, err) != nil {
+			return false
+		}
 
-			if len(data) > MaxValueSize {
-				if writeErr(conn) != nil {
-					return
-				}
-				continue
+	case OpPing:
+		data, _, ok, err := readValue(r, hdr, &b.val, batchMaxSize)
+		if err != nil {
+			return false
+		}
+		ms, decErr := decodeMembers(data)
+		if !ok || decErr != nil {
+			if writeErr(w) != nil {
+				return false
 			}
+			return true
+		}
 
-			if err := s.vault.cluster.write(string(keyBuf), data); err != nil {
-				if writeErr(conn) != nil {
-					return
-				}
-			} else {
-				if _, err := conn.Write([]byte{0x00, 0, 0, 0, 0}); err != nil {
-					return
-				}
+		s.vault.cluster.merge(ms)
+		s.vault.cluster.markAlive(string(keyBuf))
+		if writeResp(w, 0x00, encodeMembers(s.vault.cluster.members())) != nil {
+			return false
+		}
+
+	case OpPingReq:
+		if writeStatus(w, s.vault.cluster.ping(string(keyBuf))) != nil {
+			return false
+		}
+
+	case OpSetBegin, OpSyncBegin:
+		data, ttl, ok, err := readValue(r, hdr, &b.val, streamChunkMax)
+		if err != nil {
+			return false
+		}
+		if sess.stream != nil {
+			sess.stream.abort()
+			sess.stream = nil
+		}
+		if !ok {
+			if writeErr(w) != nil {
+				return false
 			}
+			return true
+		}
 
-		case OpDelete:
-			if err := s.vault.cluster.delete(string(keyBuf)); err != nil {
-				if writeErr(conn) != nil {
-					return
-				}
-			} else {
-				if _, err := conn.Write([]byte{0x00, 0, 0, 0, 0}); err != nil {
-					return
+		if op == OpSetBegin {
+			// a value sent with SET_BEGIN is the first chunk.
+			sess.stream, err = s.vault.cluster.openStream(string(keyBuf), ttl)
+			if err == nil && len(data) > 0 {
+				if _, err = sess.stream.Write(data); err != nil {
+					sess.stream.abort()
+					sess.stream = nil
 				}
 			}
+		} else if rec := decodeRecord(data); rec.key == "" || rec.key != string(keyBuf) {
+			err = fmt.Errorf("key mismatch")
+		} else {
+			sess.stream, err = s.vault.cluster.streamTo(rec, []string{s.vault.cluster.self})
+		}
+		if writeStatus(w, err) != nil {
+			return false
+		}
 
-		case OpSync:
-			if _, err := io.ReadFull(conn, hdr[:5]); err != nil {
-				return
+	case OpSetChunk:
+		data, _, ok, err := readValue(r, hdr, &b.val, streamChunkMax)
+		if err != nil {
+			return false
+		}
+		switch {
+		case sess.stream == nil:
+			err = fmt.Errorf("no stream")
+		case !ok:
+			err = fmt.Errorf("bad chunk")
+		default:
+			_, err = sess.stream.Write(data)
+		}
+		if err != nil && sess.stream != nil {
+			sess.stream.abort()
+			sess.stream = nil
+		}
+		if writeStatus(w, err) != nil {
+			return false
+		}
+
+	case OpSetEnd:
+		err := fmt.Errorf("no stream")
+		if sess.stream != nil {
+			err = sess.stream.commit()
+			sess.stream = nil
+		}
+		if writeStatus(w, err) != nil {
+			return false
+		}
+
+	case OpGetStream, OpFetchStream:
+		var r io.ReadCloser
+		var err error
+		if op == OpGetStream {
+			r, err = s.vault.cluster.openValue(string(keyBuf))
+		} else {
+			r, err = s.vault.storage.open(string(keyBuf))
+		}
+		if err != nil {
+			if writeErr(w) != nil {
+				return false
 			}
-			valLen := binary.LittleEndian.Uint32(hdr[:4])
-			compressed := hdr[4] == 1
+			return true
+		}
+		if b.chunk == nil {
+			b.chunk = make([]byte, streamChunk)
+		}
+		err = writeChunks(w, r, b.chunk)
+		r.Close()
+		if err != nil {
+			return false
+		}
 
-			if valLen > uint32(MaxValueSize) {
-				if writeErr(conn) != nil {
-					return
-				}
-				continue
+	case OpMGet, OpMFetch, OpMDelete:
+		data, _, ok, err := readValue(r, hdr, &b.val, batchMaxSize)
+		if err != nil {
+			return false
+		}
+		keys, decErr := decodeKeys(data)
+		if !ok || decErr != nil {
+			if writeErr(w) != nil {
+				return false
 			}
+			return true
+		}
 
-			if cap(valBuf) < int(valLen) {
-				valBuf = make([]byte, valLen)
+		var resp []byte
+		switch op {
+		case OpMGet:
+			recs, status := s.vault.cluster.readBatch(keys)
+			values := make([][]byte, len(keys))
+			for i := range recs {
+				values[i] = recs[i].value
 			}
-			valBuf = valBuf[:valLen]
-			if _, err := io.ReadFull(conn, valBuf); err != nil {
-				return
+			resp = encodeResults(status, values)
+		case OpMFetch:
+			status := make([]byte, len(keys))
+			records := make([][]byte, len(keys))
+			for i, key := range keys {
+				var found bool
+				if records[i], found = s.vault.storage.lookup(key); !found {
+					status[i] = statusNotFound
+				}
 			}
+			resp = encodeResults(status, records)
+		case OpMDelete:
+			resp = batchStatus(s.vault.cluster.deleteBatch(keys))
+		}
+		if writeResp(w, 0x00, resp) != nil {
+			return false
+		}
 
-			data, err := decompress(valBuf, compressed)
-			if err != nil {
-				if writeErr(conn) != nil {
-					return
-				}
-				continue
+	case OpMSet:
+		data, ttl, ok, err := readValue(r, hdr, &b.val, batchMaxSize)
+		if err != nil {
+			return false
+		}
+		keys, values, decErr := decodeItems(data)
+		if !ok || decErr != nil {
+			if writeErr(w) != nil {
+				return false
 			}
+			return true
+		}
 
-			if len(data) > MaxValueSize {
-				if writeErr(conn) != nil {
-					return
-				}
-				continue
+		if writeResp(w, 0x00, batchStatus(s.vault.cluster.writeBatch(keys, values, "", ttl))) != nil {
+			return false
+		}
+
+	case OpDelete:
+		if err := s.vault.cluster.delete(string(keyBuf)); err != nil {
+			if writeErr(w) != nil {
+				return false
+			}
+		} else {
+			if _, err := w.Write([]byte{0x00, 0, 0, 0, 0}); err != nil {
+				return false
 			}
+		}
 
-			if err := s.vault.storage.Set(string(keyBuf), data); err != nil {
-				if writeErr(conn) != nil {
-					return
-				}
-			} else {
-				if _, err := conn.Write([]byte{0x00, 0, 0, 0, 0}); err != nil {
-					return
-				}
+	case OpSync:
+		data, _, ok, err := readValue(r, hdr, &b.val, recMaxSize)
+		if err != nil {
+			return false
+		}
+		if !ok {
+			if writeErr(w) != nil {
+				return false
 			}
+			return true
+		}
 
-		case OpHealth:
-			var m runtime.MemStats
-			runtime.ReadMemStats(&m)
+		rec := decodeRecord(data)
+		if rec.key == "" {
+			rec = record{key: string(keyBuf), value: data}
+		}
 
-			health := map[string]interface{}{
-				"status":          "healthy",
-				"uptime_seconds":  int64(time.Since(s.startTime).Seconds()),
-				"cache_items":     s.vault.storage.cache.items.Load(),
-				"cache_size_mb":   s.vault.storage.cache.size.Load() / (1024 * 1024),
-				"storage_size_mb": s.vault.storage.size.Load() / (1024 * 1024),
-				"goroutines":      runtime.NumGoroutine(),
-				"memory_mb":       m.Alloc / (1024 * 1024),
+		if err := s.syncRecord(string(keyBuf), rec); err != nil {
+			if writeErr(w) != nil {
+				return false
+			}
+		} else {
+			if _, err := w.Write([]byte{0x00, 0, 0, 0, 0}); err != nil {
+				return false
 			}
+		}
 
-			jsonData, _ := json.Marshal(health)
+	case OpScan, OpScanLocal:
+		if _, err := io.ReadFull(r, hdr[:2]); err != nil {
+			return false
+		}
+		cursor := make([]byte, binary.LittleEndian.Uint16(hdr[:2]))
+		if _, err := io.ReadFull(r, cursor); err != nil {
+			return false
+		}
+		if _, err := io.ReadFull(r, hdr[:4]); err != nil {
+			return false
+		}
+		limit := binary.LittleEndian.Uint32(hdr[:4])
+
+		var keys []string
+		var next string
+		var err error
+		if op == OpScan {
+			keys, next, err = s.vault.cluster.scan(string(keyBuf), string(cursor), int(limit))
+		} else {
+			keys, next = s.vault.storage.Scan(string(keyBuf), string(cursor), int(limit))
+		}
+		if err != nil {
+			if writeErr(w) != nil {
+				return false
+			}
+			return true
+		}
+		if writeResp(w, 0x00, encodeScan(keys, next)) != nil {
+			return false
+		}
 
-			respHdr := hdrPool.Get().([]byte)
-			respHdr[0] = 0x00
-			binary.LittleEndian.PutUint32(respHdr[1:], uint32(len(jsonData)))
-			if _, err := conn.Write(respHdr); err != nil {
-				hdrPool.Put(respHdr)
-				return
+	case OpHealth:
+		jsonData, _ := json.Marshal(s.vault.health(s.startTime))
+
+		if writeResp(w, 0x00, jsonData) != nil {
+			return false
+		}
+
+	case OpTx:
+		data, ttl, ok, err := readValue(r, hdr, &b.val, batchMaxSize)
+		if err != nil {
+			return false
+		}
+		ops, decErr := decodeTxRequest(data)
+		if !ok || decErr != nil {
+			if writeErr(w) != nil {
+				return false
 			}
-			hdrPool.Put(respHdr)
-			if _, err := conn.Write(jsonData); err != nil {
-				return
+			return true
+		}
+
+		for i := range ops {
+			if ttl > 0 && !ops[i].del {
+				ops[i].rec.expires = time.Now().Add(ttl).UnixMilli()
 			}
 		}
+		ver, err := s.vault.cluster.transact(ops)
+		if err != nil {
+			if writeStatus(w, err) != nil {
+				return false
+			}
+			return true
+		}
+		resp := make([]byte, versionLen)
+		ver.put(resp)
+		if writeResp(w, 0x00, resp) != nil {
+			return false
+		}
+
+	case OpTxPrepare:
+		data, _, ok, err := readValue(r, hdr, &b.val, batchMaxSize)
+		if err != nil {
+			return false
+		}
+		ops, decErr := decodeTxOps(data)
+		if !ok || decErr != nil {
+			if writeErr(w) != nil {
+				return false
+			}
+			return true
+		}
+		if writeStatus(w, s.vault.storage.prepareTx(string(keyBuf), ops)) != nil {
+			return false
+		}
+
+	case OpTxCommit:
+		if writeStatus(w, s.vault.storage.commitPrepared(string(keyBuf))) != nil {
+			return false
+		}
+
+	case OpTxAbort:
+		s.vault.storage.abortTx(string(keyBuf))
+		if writeStatus(w, nil) != nil {
+			return false
+		}
+
+	case OpHello:
+		// only the legacy framing can switch; later HELLOs just confirm.
+		sess.pipelined = true
+		if writeResp(w, 0x00, []byte{protocolVersion}) != nil {
+			return false
+		}
+
+	default:
+		if writeErr(w) != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// syncRecord acknowledges copies older than the local one without applying
+// them.
+func (s *BinaryServer) syncRecord(key string, rec record) error {
+	return s.syncRecordIf(key, rec, condition{})
+}
+
+func (s *BinaryServer) syncRecordIf(key string, rec record, cond condition) error {
+	if rec.key == "" || rec.key != key {
+		return fmt.Errorf("key mismatch")
+	}
+	if err := s.vault.storage.putIf(rec, cond); err != nil && err != errStale {
+		return err
 	}
+	return nil
 }
 
 type connPool struct {
@@ -365,8 +919,33 @@ func (p *connPool) dial() (net.Conn, error) {
 	return conn, nil
 }
 
+func authenticate(conn net.Conn, authKey string) error {
+	if authKey == "" {
+		return nil
+	}
+
+	authReq := make([]byte, 3+len(authKey))
+	authReq[0] = OpAuth
+	binary.LittleEndian.PutUint16(authReq[1:3], uint16(len(authKey)))
+	copy(authReq[3:], authKey)
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write(authReq); err != nil {
+		return err
+	}
+	authResp := make([]byte, 5)
+	if _, err := io.ReadFull(conn, authResp); err != nil {
+		return err
+	}
+	if authResp[0] != 0x00 {
+		return fmt.Errorf("auth failed")
+	}
+	return nil
+}
+
 type BinaryClient struct {
 	pools sync.Map
+	muxes sync.Map
 }
 
 func NewBinaryClient() *BinaryClient {
@@ -383,69 +962,106 @@ func (c *BinaryClient) getPool(addr string) *connPool {
 	return actual.(*connPool)
 }
 
-func (c *BinaryClient) Sync(addr, key, authKey string, data []byte) error {
+func (c *BinaryClient) call(addr, authKey string, req []byte) (byte, []byte, error) {
+	return c.callWithin(addr, authKey, req, 10*time.Second)
+}
+
+func (c *BinaryClient) callWithin(addr, authKey string, req []byte, timeout time.Duration) (byte, []byte, error) {
+	m, err := c.mux(addr, authKey)
+	if err != nil {
+		return 0, nil, err
+	}
+	if m != nil {
+		return m.call(req, timeout)
+	}
+
 	pool := c.getPool(addr)
 	conn, err := pool.Get()
 	if err != nil {
-		return err
+		return 0, nil, err
 	}
 
-	if authKey != "" {
-		authReq := make([]byte, 3+len(authKey))
-		authReq[0] = OpAuth
-		binary.LittleEndian.PutUint16(authReq[1:3], uint16(len(authKey)))
-		copy(authReq[3:], authKey)
+	if err := authenticate(conn, authKey); err != nil {
+		conn.Close()
+		return 0, nil, err
+	}
 
-		conn.SetDeadline(time.Now().Add(5 * time.Second))
-		if _, err := conn.Write(authReq); err != nil {
-			conn.Close()
-			return err
-		}
-		authResp := make([]byte, 5)
-		if _, err := io.ReadFull(conn, authResp); err != nil {
-			conn.Close()
-			return err
-		}
-		if authResp[0] != 0x00 {
-			conn.Close()
-			return fmt.Errorf("auth failed")
-		}
+	conn.SetDeadline(time.Now().Add(timeout))
+	if _, err := conn.Write(req); err != nil {
+		conn.Close()
+		return 0, nil, err
 	}
 
+	resp := make([]byte, 5)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		conn.Close()
+		return 0, nil, err
+	}
+	n := binary.LittleEndian.Uint32(resp[1:])
+	if n > batchMaxSize {
+		conn.Close()
+		return 0, nil, fmt.Errorf("too large")
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(conn, payload); err != nil {
+		conn.Close()
+		return 0, nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	pool.Put(conn)
+	return resp[0], payload, nil
+}
+
+func syncRequest(op byte, key string, cond *condition, data []byte) []byte {
 	compressed := compress(data)
 	isCompressed := len(compressed) < len(data)
 	if !isCompressed {
 		compressed = data
 	}
 
-	req := make([]byte, 3+len(key)+5+len(compressed))
-	req[0] = OpSync
+	n := 3 + len(key)
+	if cond != nil {
+		n += condLen
+	}
+	req := make([]byte, n+5+len(compressed))
+	req[0] = op
 	binary.LittleEndian.PutUint16(req[1:3], uint16(len(key)))
 	copy(req[3:], key)
-	binary.LittleEndian.PutUint32(req[3+len(key):], uint32(len(compressed)))
+	if cond != nil {
+		cond.put(req[3+len(key):])
+	}
+	binary.LittleEndian.PutUint32(req[n:], uint32(len(compressed)))
 	if isCompressed {
-		req[3+len(key)+4] = 1
+		req[n+4] = valCompressed
 	}
-	copy(req[3+len(key)+5:], compressed)
+	copy(req[n+5:], compressed)
+	return req
+}
 
-	conn.SetDeadline(time.Now().Add(10 * time.Second))
-	if _, err := conn.Write(req); err != nil {
-		conn.Close()
+func (c *BinaryClient) Sync(addr, key, authKey string, data []byte) error {
+	status, _, err := c.call(addr, authKey, syncRequest(OpSync, key, nil, data))
+	if err != nil {
 		return err
 	}
+	if status != 0x00 {
+		return fmt.Errorf("sync failed")
+	}
+	return nil
+}
 
-	resp := make([]byte, 5)
-	if _, err := io.ReadFull(conn, resp); err != nil {
-		conn.Close()
+func (c *BinaryClient) SyncIf(addr, key, authKey string, cond condition, data []byte) error {
+	status, _, err := c.call(addr, authKey, syncRequest(OpSyncIf, key, &cond, data))
+	if err != nil {
 		return err
 	}
-	conn.SetDeadline(time.Time{})
-
-	pool.Put(conn)
-	if resp[0] != 0x00 {
-		return fmt.Errorf("sync failed")
+	switch status {
+	case 0x00:
+		return nil
+	case statusConflict:
+		return errConflict
 	}
-	return nil
+	return fmt.Errorf("sync failed")
 }
 
 func (c *BinaryClient) Get(addr, key string) ([]byte, error) {
@@ -497,26 +1113,9 @@ func (c *BinaryClient) Delete(addr, key, authKey string) error {
 		return err
 	}
 
-	if authKey != "" {
-		authReq := make([]byte, 3+len(authKey))
-		authReq[0] = OpAuth
-		binary.LittleEndian.PutUint16(authReq[1:3], uint16(len(authKey)))
-		copy(authReq[3:], authKey)
-
-		conn.SetDeadline(time.Now().Add(5 * time.Second))
-		if _, err := conn.Write(authReq); err != nil {
-			conn.Close()
-			return err
-		}
-		authResp := make([]byte, 5)
-		if _, err := io.ReadFull(conn, authResp); err != nil {
-			conn.Close()
-			return err
-		}
-		if authResp[0] != 0x00 {
-			conn.Close()
-			return fmt.Errorf("auth failed")
-		}
+	if err := authenticate(conn, authKey); err != nil {
+		conn.Close()
+		return err
 	}
 
 	req := make([]byte, 3+len(key))
@@ -540,3 +1139,121 @@ func (c *BinaryClient) Delete(addr, key, authKey string) error {
 	pool.Put(conn)
 	return nil
 }
+
+// Fetch returns addr's local record for key.
+func (c *BinaryClient) Fetch(addr, key, authKey string) ([]byte, bool, error) {
+	status, data, err := c.call(addr, authKey, keyRequest(OpFetch, key, 0))
+	if err != nil {
+		return nil, false, err
+	}
+	switch status {
+	case 0x00:
+		return data, true, nil
+	case statusNotFound:
+		return nil, false, nil
+	}
+	return nil, false, fmt.Errorf("fetch failed")
+}
+
+func (c *BinaryClient) FetchHead(addr, key, authKey string) ([]byte, bool, error) {
+	status, data, err := c.call(addr, authKey, keyRequest(OpFetchHead, key, 0))
+	if err != nil {
+		return nil, false, err
+	}
+	switch status {
+	case 0x00:
+		return data, true, nil
+	case statusNotFound:
+		return nil, false, nil
+	}
+	return nil, false, fmt.Errorf("fetch failed")
+}
+
+func keyRequest(op byte, key string, extra int) []byte {
+	req := make([]byte, 3+len(key)+extra)
+	req[0] = op
+	binary.LittleEndian.PutUint16(req[1:3], uint16(len(key)))
+	copy(req[3:], key)
+	return req
+}
+
+func (c *BinaryClient) Tree(addr, self, authKey string) ([]uint64, error) {
+	status, payload, err := c.call(addr, authKey, keyRequest(OpTree, self, 0))
+	if err != nil {
+		return nil, err
+	}
+	if status != 0x00 {
+		return nil, fmt.Errorf("tree failed")
+	}
+	leaves := make([]uint64, len(payload)/8)
+	for i := range leaves {
+		leaves[i] = binary.LittleEndian.Uint64(payload[8*i:])
+	}
+	return leaves, nil
+}
+
+func (c *BinaryClient) LeafItems(addr, self, authKey string, leaves []int) ([]merkleItem, error) {
+	req := keyRequest(OpLeafItems, self, 4+4*len(leaves))
+	n := 3 + len(self)
+	binary.LittleEndian.PutUint32(req[n:], uint32(len(leaves)))
+	for i, l := range leaves {
+		binary.LittleEndian.PutUint32(req[n+4+4*i:], uint32(l))
+	}
+
+	status, payload, err := c.call(addr, authKey, req)
+	if err != nil {
+		return nil, err
+	}
+	if status != 0x00 || len(payload) < 4 {
+		return nil, fmt.Errorf("leaf items failed")
+	}
+
+	count := binary.LittleEndian.Uint32(payload)
+	items := make([]merkleItem, 0, count)
+	p := payload[4:]
+	for i := uint32(0); i < count; i++ {
+		if len(p) < 2 {
+			return nil, fmt.Errorf("truncated leaf items")
+		}
+		kl := int(binary.LittleEndian.Uint16(p))
+		if len(p) < 2+kl+versionLen {
+			return nil, fmt.Errorf("truncated leaf items")
+		}
+		items = append(items, merkleItem{key: string(p[2 : 2+kl]), ver: readVersion(p[2+kl:])})
+		p = p[2+kl+versionLen:]
+	}
+	return items, nil
+}
+
+func (c *BinaryClient) SyncBatch(addr, authKey string, records [][]byte) error {
+	status, _, err := c.call(addr, authKey, syncRequest(OpSyncBatch, "", nil, encodeBatch(records)))
+	if err != nil {
+		return err
+	}
+	if status != 0x00 {
+		return fmt.Errorf("sync failed")
+	}
+	return nil
+}
+
+func (c *BinaryClient) Ping(addr, self, authKey string, members []byte) ([]member, error) {
+	status, payload, err := c.callWithin(addr, authKey, syncRequest(OpPing, self, nil, members), pingTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if status != 0x00 {
+		return nil, fmt.Errorf("ping failed")
+	}
+	return decodeMembers(payload)
+}
+
+func (c *BinaryClient) PingReq(addr, target, authKey string) error {
+	status, _, err := c.callWithin(addr, authKey, keyRequest(OpPingReq, target, 0), 3*pingTimeout)
+	if err != nil {
+		return err
+	}
+	if status != 0x00 {
+		return fmt.Errorf("ping failed")
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestGetZeroCopy(t *testing.T) {
+	nodes := startCluster(t, 1, 1)
+	s := nodes[0].v.storage
+	big := bytes.Repeat([]byte("x"), 1<<20)
+	if err := s.Set("big", big); err != nil {
+		t.Fatal(err)
+	}
+	a, _ := s.Get("big")
+	b, _ := s.Get("big")
+	if &a[0] != &b[0] {
+		t.Fatal("cached value copied on get")
+	}
+	if n := testing.AllocsPerRun(100, func() { s.Get("big") }); n > 2 {
+		t.Fatalf("%v allocations per cached get", n)
+	}
+
+	conn, err := net.Dial("tcp", nodes[0].addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	for _, op := range []byte{OpGet, OpGetV, OpGet} {
+		conn.Write(keyRequest(op, "big", 0))
+		var hdr [5]byte
+		if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+			t.Fatal(err)
+		}
+		p := make([]byte, binary.LittleEndian.Uint32(hdr[1:]))
+		if _, err := io.ReadFull(conn, p); err != nil {
+			t.Fatal(err)
+		}
+		if op == OpGetV {
+			p = p[versionLen:]
+		}
+		if hdr[0] != 0 || !bytes.Equal(p, big) {
+			t.Fatalf("op %#x: status %d, %d bytes", op, hdr[0], len(p))
+		}
+	}
+	if got, err := NewBinaryClient().Get(nodes[0].addr, "big"); err != nil || !bytes.Equal(got, big) {
+		t.Fatalf("client get: %d bytes, %v", len(got), err)
+	}
+}
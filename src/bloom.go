@@ -1,33 +1,57 @@
 package main
 
-import "sync/atomic"
+import (
+	"sync"
+	"sync/atomic"
+)
 
-const cacheLineSize = 64
-
-type paddedUint64 struct {
-	val uint64
-	_   [cacheLineSize - 8]byte
-}
+const (
+	// false positive rate past which the filter is rebuilt.
+	bloomMaxFP     = 0.05
+	bloomMinChecks = 10000
+)
 
+// bloom is a counting bloom filter with 4-bit counters. a counter that
+// reaches 15 sticks there.
 type bloom struct {
-	bits []paddedUint64
-	k    uint32
+	counters []uint64
+	m        uint32
+	k        uint32
+	capacity int
+	gen      uint64
 }
 
 func newBloom(n int) *bloom {
-	size := max(n*10/64, 1024)
-	return &bloom{bits: make([]paddedUint64, size), k: 3}
+	m := max(n*10, 1024)
+	m = (m + 15) &^ 15
+	return &bloom{counters: make([]uint64, m/16), m: uint32(m), k: 3, capacity: n}
 }
 
-func (b *bloom) add(h uint64) {
+func (b *bloom) slot(h uint64, i uint32) (*uint64, uint64) {
 	h1, h2 := uint32(h), uint32(h>>32)
+	pos := (h1 + i*h2) % b.m
+	return &b.counters[pos/16], uint64(pos%16) * 4
+}
+
+func (b *bloom) add(h uint64) {
+	for i := uint32(0); i < b.k; i++ {
+		w, shift := b.slot(h, i)
+		for {
+			old := atomic.LoadUint64(w)
+			if (old>>shift)&0xF == 0xF || atomic.CompareAndSwapUint64(w, old, old+1<<shift) {
+				break
+			}
+		}
+	}
+}
+
+func (b *bloom) remove(h uint64) {
 	for i := uint32(0); i < b.k; i++ {
-		pos := (h1 + i*h2) % uint32(len(b.bits)*64)
-		idx, bit := pos/64, pos%64
+		w, shift := b.slot(h, i)
 		for {
-			old := atomic.LoadUint64(&b.bits[idx].val)
-			new := old | (1 << bit)
-			if old == new || atomic.CompareAndSwapUint64(&b.bits[idx].val, old, new) {
+			old := atomic.LoadUint64(w)
+			c := (old >> shift) & 0xF
+			if c == 0 || c == 0xF || atomic.CompareAndSwapUint64(w, old, old-1<<shift) {
 				break
 			}
 		}
@@ -35,13 +59,113 @@ func (b *bloom) add(h uint64) {
 }
 
 func (b *bloom) has(h uint64) bool {
-	h1, h2 := uint32(h), uint32(h>>32)
 	for i := uint32(0); i < b.k; i++ {
-		pos := (h1 + i*h2) % uint32(len(b.bits)*64)
-		idx, bit := pos/64, pos%64
-		if atomic.LoadUint64(&b.bits[idx].val)&(1<<bit) == 0 {
+		w, shift := b.slot(h, i)
+		if (atomic.LoadUint64(w)>>shift)&0xF == 0 {
 			return false
 		}
 	}
 	return true
 }
+
+// filter fills the next generation shard by shard during a rebuild; writes to
+// a copied shard go to both generations.
+type filter struct {
+	cur        atomic.Pointer[bloom]
+	mu         sync.RWMutex // shared while writing, exclusive to swap
+	next       *bloom
+	rebuilding atomic.Bool
+
+	checks   atomic.Int64
+	fp       atomic.Int64
+	rebuilds atomic.Int64
+}
+
+func newFilter(n int) *filter {
+	f := &filter{}
+	f.cur.Store(newBloom(n))
+	return f
+}
+
+func (f *filter) add(s *shard, h uint64) {
+	f.mu.RLock()
+	f.cur.Load().add(h)
+	if f.next != nil && s.gen == f.next.gen {
+		f.next.add(h)
+	}
+	f.mu.RUnlock()
+}
+
+func (f *filter) remove(s *shard, h uint64) {
+	f.mu.RLock()
+	f.cur.Load().remove(h)
+	if f.next != nil && s.gen == f.next.gen {
+		f.next.remove(h)
+	}
+	f.mu.RUnlock()
+}
+
+func (f *filter) has(h uint64) bool {
+	return f.cur.Load().has(h)
+}
+
+func (f *filter) miss(passed bool) {
+	f.checks.Add(1)
+	if passed {
+		f.fp.Add(1)
+	}
+}
+
+func (f *filter) fpRate() float64 {
+	checks := f.checks.Load()
+	if checks == 0 {
+		return 0
+	}
+	return float64(f.fp.Load()) / float64(checks)
+}
+
+func (f *filter) stale(items int64) bool {
+	if items > int64(f.cur.Load().capacity) {
+		return true
+	}
+	return f.checks.Load() >= bloomMinChecks && f.fpRate() > bloomMaxFP
+}
+
+func (f *filter) stats() map[string]interface{} {
+	return map[string]interface{}{
+		"false_positive_rate": f.fpRate(),
+		"capacity":            f.cur.Load().capacity,
+		"rebuilds":            f.rebuilds.Load(),
+	}
+}
+
+func (c *cache) rebuildFilter() {
+	f := c.filter
+	if !f.rebuilding.CompareAndSwap(false, true) {
+		return
+	}
+	defer f.rebuilding.Store(false)
+
+	next := newBloom(max(int(c.items.Load())*2, c.base))
+	next.gen = f.cur.Load().gen + 1
+	f.mu.Lock()
+	f.next = next
+	f.mu.Unlock()
+
+	for _, s := range c.shards {
+		s.mu.Lock()
+		for h := range s.m {
+			next.add(h)
+		}
+		s.gen = next.gen
+		s.mu.Unlock()
+	}
+
+	f.mu.Lock()
+	f.cur.Store(next)
+	f.next = nil
+	f.mu.Unlock()
+	f.checks.Store(0)
+	f.fp.Store(0)
+	f.rebuilds.Add(1)
+}
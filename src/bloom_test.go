@@ -0,0 +1,73 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBloomChurn(t *testing.T) {
+	c := newCache(1000)
+	val := make([]byte, 8)
+	for i := range 200000 {
+		h := uint64(i)*0x9E3779B97F4A7C15 + 1
+		c.set(h, val)
+		c.del(h)
+	}
+	fp := 0
+	for i := range 10000 {
+		if c.filter.has(uint64(i+1<<40) * 0xBF58476D1CE4E5B9) {
+			fp++
+		}
+	}
+	if fp > 100 {
+		t.Fatalf("churn saturated the filter: %d of 10000 absent keys pass", fp)
+	}
+}
+
+func TestBloomRebuild(t *testing.T) {
+	c := newCache(1000)
+	val := make([]byte, 8)
+	key := func(g, i int) uint64 { return uint64(g*1000000+i)*0x9E3779B97F4A7C15 + 1 }
+	var wg sync.WaitGroup
+	for g := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range 20000 {
+				c.set(key(g, i), val)
+				if i%3 == 0 {
+					c.del(key(g, i))
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	for c.filter.rebuilding.Load() {
+		time.Sleep(time.Millisecond)
+	}
+
+	for g := range 8 {
+		for i := range 20000 {
+			if i%3 != 0 && !c.filter.has(key(g, i)) {
+				t.Fatalf("cached key %d/%d missing from the filter", g, i)
+			}
+		}
+	}
+	for i := range 100000 {
+		if _, ok := c.get(uint64(i+1<<41) * 0xBF58476D1CE4E5B9); ok {
+			t.Fatal("absent key found")
+		}
+	}
+	if c.filter.rebuilds.Load() == 0 || c.filter.fpRate() > 0.05 {
+		t.Fatalf("stats: %v", c.filter.stats())
+	}
+}
+
+func TestBloomHealth(t *testing.T) {
+	h := newTestHTTP(t)
+	if w := do(h, "GET", "/health", "", nil); !strings.Contains(w.Body.String(), `"false_positive_rate"`) {
+		t.Fatal(w.Body)
+	}
+}
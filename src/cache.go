@@ -1,56 +1,123 @@
 package main
 
 import (
-	"container/heap"
+	"cmp"
+	"slices"
 	"sync"
 	"sync/atomic"
 )
 
-const shards = 256
+const (
+	shards = 256
+	// percent of a shard's bytes the small queue may hold.
+	smallShare = 10
+	maxFreq    = 3
+	evictBatch = 8
+)
 
+// every shard keeps two fifo queues, after S3-FIFO: new entries go into small
+// and only move on to main if they were read there or the frequency sketch
+// rates them above main's next victim. a scan thus only churns small.
 type entry struct {
-	data []byte
-	hits uint32
+	h          uint64
+	data       []byte
+	freq       atomic.Uint32
+	main       bool
+	prev, next *entry
+}
+
+type fifo struct {
+	head, tail *entry
+	bytes      int64
+}
+
+func (q *fifo) push(e *entry) {
+	e.prev, e.next = q.tail, nil
+	if q.tail != nil {
+		q.tail.next = e
+	} else {
+		q.head = e
+	}
+	q.tail = e
+	q.bytes += int64(len(e.data))
+}
+
+func (q *fifo) unlink(e *entry) {
+	if e.prev != nil {
+		e.prev.next = e.next
+	} else {
+		q.head = e.next
+	}
+	if e.next != nil {
+		e.next.prev = e.prev
+	} else {
+		q.tail = e.prev
+	}
+	e.prev, e.next = nil, nil
+	q.bytes -= int64(len(e.data))
 }
 
 type shard struct {
-	mu sync.RWMutex
-	m  map[uint64]*entry
+	mu    sync.RWMutex
+	m     map[uint64]*entry
+	small fifo
+	main  fifo
+	gen   uint64
+}
+
+func (s *shard) queue(e *entry) *fifo {
+	if e.main {
+		return &s.main
+	}
+	return &s.small
 }
 
 type cache struct {
 	shards [shards]*shard
-	bloom  *bloom
+	filter *filter
+	sketch *sketch
+	base   int
 	size   atomic.Int64
 	items  atomic.Int64
+	hits   atomic.Int64
+	misses atomic.Int64
+	hand   atomic.Uint32
 }
 
 func newCache(n int) *cache {
-	c := &cache{bloom: newBloom(n)}
+	c := &cache{filter: newFilter(n), sketch: newSketch(n), base: n}
 	for i := range c.shards {
 		c.shards[i] = &shard{m: make(map[uint64]*entry, n/shards)}
 	}
 	return c
 }
 
+// set takes data over and get hands out the cached slice itself, which must
+// not be modified.
 func (c *cache) set(h uint64, data []byte) {
 	s := c.shards[h%shards]
 	s.mu.Lock()
 	if old, ok := s.m[h]; ok {
 		c.size.Add(int64(len(data) - len(old.data)))
+		s.queue(old).bytes += int64(len(data) - len(old.data))
 		old.data = data
-		s.m[h] = old
 	} else {
-		s.m[h] = &entry{data: data}
+		e := &entry{h: h, data: data}
+		s.m[h] = e
+		s.small.push(e)
 		c.size.Add(int64(len(data)))
 		c.items.Add(1)
-		c.bloom.add(h)
+		c.filter.add(s, h)
 	}
 	s.mu.Unlock()
+	c.checkFilter()
 }
 
 func (c *cache) get(h uint64) ([]byte, bool) {
-	if !c.bloom.has(h) {
+	c.sketch.add(h)
+	if !c.filter.has(h) {
+		c.filter.miss(false)
+		c.misses.Add(1)
 		return nil, false
 	}
 	s := c.shards[h%shards]
@@ -58,13 +125,18 @@ func (c *cache) get(h uint64) ([]byte, bool) {
 	e, ok := s.m[h]
 	if !ok {
 		s.mu.RUnlock()
+		c.filter.miss(true)
+		c.misses.Add(1)
+		c.checkFilter()
 		return nil, false
 	}
-	data := make([]byte, len(e.data))
-	copy(data, e.data)
-	atomic.AddUint32(&e.hits, 1)
+	data := e.data
+	if f := e.freq.Load(); f < maxFreq {
+		e.freq.CompareAndSwap(f, f+1)
+	}
 	s.mu.RUnlock()
 
+	c.hits.Add(1)
 	return data, true
 }
 
@@ -73,79 +145,148 @@ func (c *cache) del(h uint64) int64 {
 	s.mu.Lock()
 	size := int64(0)
 	if e, ok := s.m[h]; ok {
-		size = int64(len(e.data))
-		c.size.Add(-size)
-		c.items.Add(-1)
-		delete(s.m, h)
+		size = c.dropLocked(s, e)
 	}
 	s.mu.Unlock()
 	return size
 }
 
+func (c *cache) dropLocked(s *shard, e *entry) int64 {
+	size := int64(len(e.data))
+	s.queue(e).unlink(e)
+	delete(s.m, e.h)
+	c.filter.remove(s, e.h)
+	c.size.Add(-size)
+	c.items.Add(-1)
+	return size
+}
+
 func (c *cache) has(h uint64) bool {
-	if !c.bloom.has(h) {
+	if !c.filter.has(h) {
+		c.filter.miss(false)
 		return false
 	}
 	s := c.shards[h%shards]
 	s.mu.RLock()
 	_, ok := s.m[h]
 	s.mu.RUnlock()
+	if !ok {
+		c.filter.miss(true)
+		c.checkFilter()
+	}
 	return ok
 }
 
-type evictItem struct {
-	h    uint64
-	hits uint32
-	size int
-}
-
-type minHeap []evictItem
-
-func (h minHeap) Len() int           { return len(h) }
-func (h minHeap) Less(i, j int) bool { return h[i].hits < h[j].hits }
-func (h minHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
-func (h *minHeap) Push(x any)        { *h = append(*h, x.(evictItem)) }
-func (h *minHeap) Pop() any {
-	old := *h
-	n := len(old)
-	x := old[n-1]
-	*h = old[0 : n-1]
-	return x
+func (c *cache) checkFilter() {
+	if !c.filter.rebuilding.Load() && c.filter.stale(c.items.Load()) {
+		go c.rebuildFilter()
+	}
 }
 
-func (c *cache) evict(max int64) int64 {
-	if c.size.Load() < max {
+func (c *cache) hitRate() float64 {
+	hits, misses := c.hits.Load(), c.misses.Load()
+	if hits+misses == 0 {
 		return 0
 	}
+	return float64(hits) / float64(hits+misses)
+}
 
-	n := int(c.items.Load() / 4)
-	if n == 0 {
-		n = 1
+// hottest lists the most asked for entries that fit in max bytes together.
+func (c *cache) hottest(max int64) []uint64 {
+	type hot struct {
+		h    uint64
+		size int64
+		est  uint64
+		main bool
 	}
-
-	h := make(minHeap, 0, n*2)
-	for i := range c.shards {
-		shard := c.shards[i]
-		shard.mu.RLock()
-		for hash, e := range shard.m {
-			if len(h) < n*2 {
-				heap.Push(&h, evictItem{
-					h:    hash,
-					hits: atomic.LoadUint32(&e.hits),
-					size: len(e.data),
-				})
-			} else if atomic.LoadUint32(&e.hits) < h[0].hits {
-				h[0] = evictItem{h: hash, hits: atomic.LoadUint32(&e.hits), size: len(e.data)}
-				heap.Fix(&h, 0)
+	var all []hot
+	for _, s := range c.shards {
+		s.mu.RLock()
+		for h, e := range s.m {
+			all = append(all, hot{h: h, size: int64(len(e.data)), est: c.sketch.estimate(h), main: e.main})
+		}
+		s.mu.RUnlock()
+	}
+	slices.SortFunc(all, func(a, b hot) int {
+		if a.est != b.est {
+			return cmp.Compare(b.est, a.est)
+		}
+		if a.main != b.main {
+			if a.main {
+				return -1
 			}
+			return 1
+		}
+		return 0
+	})
+
+	hashes := make([]uint64, 0, len(all))
+	total := int64(0)
+	for _, e := range all {
+		if total+e.size > max {
+			break
 		}
-		shard.mu.RUnlock()
+		total += e.size
+		hashes = append(hashes, e.h)
 	}
+	return hashes
+}
 
+// evict goes round the shards, at most evictBatch entries each, so a call
+// holds one shard lock at a time.
+func (c *cache) evict(max int64) int64 {
 	freed := int64(0)
-	for i := 0; i < n && h.Len() > 0; i++ {
-		item := heap.Pop(&h).(evictItem)
-		freed += c.del(item.h)
+	for tried := 0; c.size.Load() > max && tried < shards; {
+		s := c.shards[c.hand.Add(1)%shards]
+		n, got := int64(0), 0
+		s.mu.Lock()
+		for i := 0; i < evictBatch && c.size.Load() > max; i++ {
+			f, ok := c.evictLocked(s)
+			if !ok {
+				break
+			}
+			n += f
+			got++
+		}
+		s.mu.Unlock()
+
+		if got == 0 {
+			tried++
+			continue
+		}
+		freed += n
+		tried = 0
 	}
 	return freed
 }
+
+// evictLocked reports ok false if s is empty.
+func (c *cache) evictLocked(s *shard) (size int64, ok bool) {
+	for moves := len(s.m) * (maxFreq + 1); ; moves-- {
+		if s.small.head == nil && s.main.head == nil {
+			return 0, false
+		}
+		if s.small.head != nil && (s.main.head == nil || s.small.bytes*smallShare > s.small.bytes+s.main.bytes) {
+			e := s.small.head
+			admit := e.freq.Load() > 0 ||
+				(s.main.head != nil && c.sketch.estimate(e.h) > c.sketch.estimate(s.main.head.h))
+			if !admit || moves <= 0 {
+				return c.dropLocked(s, e), true
+			}
+			s.small.unlink(e)
+			e.main = true
+			e.freq.Store(0)
+			s.main.push(e)
+			continue
+		}
+
+		e := s.main.head
+		if f := e.freq.Load(); f > 0 && moves > 0 {
+			e.freq.Store(f - 1)
+			s.main.unlink(e)
+			s.main.push(e)
+			continue
+		}
+		return c.dropLocked(s, e), true
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestCacheScanResistance(t *testing.T) {
+	c := newCache(100000)
+	val := make([]byte, 100)
+	max := int64(1000 * len(val))
+	hot := make([]uint64, 200)
+	for i := range hot {
+		hot[i] = uint64(i)*0x9E3779B97F4A7C15 + 1
+		c.set(hot[i], val)
+	}
+	for range 5 {
+		for _, h := range hot {
+			c.get(h)
+		}
+	}
+
+	for i := range 50000 {
+		h := uint64(i+1000000) * 0xBF58476D1CE4E5B9
+		c.get(h)
+		c.set(h, val)
+		c.evict(max)
+		if i%1000 == 0 {
+			for _, h := range hot {
+				c.get(h)
+			}
+		}
+	}
+	if c.size.Load() > max {
+		t.Fatalf("%d bytes cached, limit %d", c.size.Load(), max)
+	}
+	kept := 0
+	for _, h := range hot {
+		if c.has(h) {
+			kept++
+		}
+	}
+	if kept < 180 {
+		t.Fatalf("scan evicted %d of %d hot keys", len(hot)-kept, len(hot))
+	}
+}
+
+func TestCacheConcurrent(t *testing.T) {
+	c := newCache(1000)
+	val := make([]byte, 64)
+	var wg sync.WaitGroup
+	for g := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range 20000 {
+				h := uint64((i*7+g)%3000) + 1
+				if _, ok := c.get(h); !ok {
+					c.set(h, val)
+				}
+				if i%10 == 0 {
+					c.del(h + 1)
+				}
+				c.evict(int64(len(val)) * 500)
+			}
+		}()
+	}
+	wg.Wait()
+
+	n := int64(0)
+	for _, s := range c.shards {
+		n += int64(len(s.m))
+		if s.small.bytes+s.main.bytes != int64(len(s.m)*len(val)) {
+			t.Fatalf("queues hold %d bytes for %d entries", s.small.bytes+s.main.bytes, len(s.m))
+		}
+	}
+	if n != c.items.Load() || n*int64(len(val)) != c.size.Load() {
+		t.Fatalf("%d entries, counted %d items in %d bytes", n, c.items.Load(), c.size.Load())
+	}
+}
+
+func TestSketchAging(t *testing.T) {
+	s := newSketch(64)
+	for range 12 {
+		s.add(1)
+	}
+	if e := s.estimate(1); e != 12 {
+		t.Fatalf("estimate %d, want 12", e)
+	}
+	if e := s.estimate(2); e != 0 {
+		t.Fatalf("unseen key estimated at %d", e)
+	}
+	for range 40 {
+		s.add(1)
+	}
+	if e := s.estimate(1); e != 0xF {
+		t.Fatalf("counter not saturated: %d", e)
+	}
+	s.age()
+	if e := s.estimate(1); e != 7 {
+		t.Fatalf("after aging %d, want 7", e)
+	}
+}
@@ -7,44 +7,79 @@ import (
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type Cluster struct {
-	self    string
-	nodes   sync.Map
-	client  *BinaryClient
-	workers chan struct{}
-	authKey string
-	storage *Storage
+	self       string
+	nodes      sync.Map
+	client     *BinaryClient
+	workers    chan struct{}
+	authKey    string
+	storage    *Storage
+	readQuorum int
+	hints      *hints
+
+	memberMu    sync.Mutex
+	incarnation uint32
+	seeds       []string
+
+	ae         aeCache
+	aeRounds   atomic.Int64
+	aeRepaired atomic.Int64
+	aeLast     atomic.Int64
+
+	rebalanceDrop bool
+	rbRunning     atomic.Bool
+	rbTotal       atomic.Int64
+	rbScanned     atomic.Int64
+	rbMoved       atomic.Int64
+	rbDropped     atomic.Int64
+	rbFailed      atomic.Int64
+	rbPasses      atomic.Int64
+	rbLast        atomic.Int64
+
+	txCommitted atomic.Int64
+	txAborted   atomic.Int64
 }
 
 type node struct {
-	url  string
-	seen time.Time
+	url         string
+	seen        time.Time
+	state       byte
+	incarnation uint32
+	changed     time.Time
 }
 
-func NewCluster(self, authKey string, storage *Storage, workerPoolSize int) *Cluster {
+func NewCluster(self, authKey string, storage *Storage, workerPoolSize, readQuorum int) *Cluster {
 	c := &Cluster{
-		self:    self,
-		authKey: authKey,
-		storage: storage,
-		workers: make(chan struct{}, workerPoolSize),
-		client:  NewBinaryClient(),
+		self:       self,
+		authKey:    authKey,
+		storage:    storage,
+		workers:    make(chan struct{}, workerPoolSize),
+		client:     NewBinaryClient(),
+		readQuorum: max(readQuorum, 1),
+		// a restarted node comes back with a higher incarnation.
+		incarnation: uint32(time.Now().Unix()),
 	}
 
+	storage.node = nodeID(self)
+
 	for range workerPoolSize {
 		c.workers <- struct{}{}
 	}
 
-	c.nodes.Store(self, &node{url: self, seen: time.Now()})
+	now := time.Now()
+	c.nodes.Store(self, &node{url: self, seen: now, incarnation: c.incarnation, changed: now})
 
 	nodes := os.Getenv("CLUSTER_NODES")
 	if nodes != "" {
 		for _, n := range strings.Split(nodes, ",") {
 			n = strings.TrimSpace(n)
 			if n != "" && n != self {
-				c.nodes.Store(n, &node{url: n, seen: time.Now()})
+				c.nodes.Store(n, &node{url: n, seen: now, changed: now})
+				c.seeds = append(c.seeds, n)
 			}
 		}
 	}
@@ -52,17 +87,27 @@ func NewCluster(self, authKey string, storage *Storage, workerPoolSize int) *Clu
 	return c
 }
 
+// getNodes returns every member not declared dead.
 func (c *Cluster) getNodes() []string {
+	c.memberMu.Lock()
+	defer c.memberMu.Unlock()
+
 	var nodes []string
-	c.nodes.Range(func(key, _ any) bool {
-		nodes = append(nodes, key.(string))
+	c.nodes.Range(func(key, v any) bool {
+		if v.(*node).state != stateDead {
+			nodes = append(nodes, key.(string))
+		}
 		return true
 	})
 	return nodes
 }
 
 func (c *Cluster) hash(key string, count int) []string {
-	nodes := c.getNodes()
+	return placement(key, c.getNodes(), count)
+}
+
+// placement ranks nodes for key by rendezvous hashing.
+func placement(key string, nodes []string, count int) []string {
 	if len(nodes) == 0 {
 		return nil
 	}
@@ -96,11 +141,81 @@ func (c *Cluster) hash(key string, count int) []string {
 }
 
 func (c *Cluster) write(key string, data []byte) error {
+	_, err := c.writeIf(key, data, "", 0, condition{})
+	return err
+}
+
+// writeIf runs a conditional write as a one-key transaction, so a write
+// reported as failed is never applied anywhere.
+func (c *Cluster) writeIf(key string, data []byte, ctype string, ttl time.Duration, cond condition) (version, error) {
+	nodes := c.hash(key, ReplicaCount)
+	if len(nodes) == 0 {
+		return version{}, fmt.Errorf("no nodes")
+	}
+
+	rec := c.storage.newRecord(key, data)
+	rec.ctype = ctype
+	if ttl > 0 {
+		rec.expires = time.Now().Add(ttl).UnixMilli()
+	}
+	if cond.kind != condNone {
+		return c.commitOps([]txOp{{rec: rec, cond: cond}})
+	}
+	encoded := rec.encode()
+	// the local write can outlive the caller's buffer.
+	local := decodeRecord(encoded)
+
+	err := c.quorum(nodes, func(node string) error {
+		if node == c.self {
+			if err := c.storage.put(local); err != errStale {
+				return err
+			}
+			return nil
+		}
+		err := c.client.SyncIf(node, key, c.authKey, condition{}, encoded)
+		if err != nil && err != errConflict {
+			c.hint(node, encoded)
+		}
+		return err
+	})
+	return rec.ver, err
+}
+
+func (c *Cluster) delete(key string) error {
+	return c.deleteIf(key, condition{})
+}
+
+func (c *Cluster) deleteIf(key string, cond condition) error {
 	nodes := c.hash(key, ReplicaCount)
 	if len(nodes) == 0 {
 		return fmt.Errorf("no nodes")
 	}
 
+	if cond.kind != condNone {
+		_, err := c.commitOps([]txOp{{rec: c.storage.newRecord(key, nil), del: true, cond: cond}})
+		return err
+	}
+	rec := c.storage.tombstone(c.storage.newRecord(key, nil))
+	encoded := rec.encode()
+
+	return c.quorum(nodes, func(node string) error {
+		if node == c.self {
+			if err := c.storage.put(rec); err != errStale {
+				return err
+			}
+			return nil
+		}
+		err := c.client.SyncIf(node, key, c.authKey, condition{}, encoded)
+		if err != nil && err != errConflict {
+			c.hint(node, encoded)
+		}
+		return err
+	})
+}
+
+// quorum returns errConflict when owners rejecting a condition cost the
+// majority.
+func (c *Cluster) quorum(nodes []string, fn func(node string) error) error {
 	quorum := (len(nodes) / 2) + 1
 	results := make(chan error, len(nodes))
 	timeout := time.After(WriteTimeout)
@@ -110,20 +225,14 @@ func (c *Cluster) write(key string, data []byte) error {
 		case <-c.workers:
 			go func(node string) {
 				defer func() { c.workers <- struct{}{} }()
-				var err error
-				if node == c.self {
-					err = c.storage.Set(key, data)
-				} else {
-					err = c.client.Sync(node, key, c.authKey, data)
-				}
-				results <- err
+				results <- fn(node)
 			}(n)
 		case <-time.After(50 * time.Millisecond):
 			return fmt.Errorf("worker pool exhausted")
 		}
 	}
 
-	ok := 0
+	ok, conflicts := 0, 0
 	for i := 0; i < len(nodes); i++ {
 		select {
 		case err := <-results:
@@ -132,57 +241,144 @@ func (c *Cluster) write(key string, data []byte) error {
 				if ok >= quorum {
 					return nil
 				}
+			} else if err == errConflict {
+				conflicts++
 			}
 		case <-timeout:
 			return fmt.Errorf("timeout")
 		}
 	}
 
+	if conflicts > 0 {
+		return errConflict
+	}
 	return fmt.Errorf("quorum failed: %d/%d", ok, quorum)
 }
 
-func (c *Cluster) delete(key string) error {
+type readResult struct {
+	node  string
+	data  []byte
+	ver   version
+	found bool
+	err   error
+}
+
+func (c *Cluster) fetch(node string, key string) readResult {
+	r := readResult{node: node}
+	if node == c.self {
+		r.data, r.found = c.storage.lookup(key)
+	} else {
+		r.data, r.found, r.err = c.client.Fetch(node, key, c.authKey)
+	}
+	if r.found {
+		r.ver = decodeRecord(r.data).ver
+	}
+	return r
+}
+
+// read answers once readQuorum owners replied and repairs the others in the
+// background. a newer tombstone wins like any other copy.
+func (c *Cluster) read(key string) (record, error) {
 	nodes := c.hash(key, ReplicaCount)
 	if len(nodes) == 0 {
-		return fmt.Errorf("no nodes")
+		return record{}, fmt.Errorf("no nodes")
+	}
+	if len(nodes) == 1 && nodes[0] == c.self {
+		data, ok := c.storage.fetch(key)
+		if !ok {
+			return record{}, fmt.Errorf("not found")
+		}
+		return decodeRecord(data), nil
 	}
 
-	quorum := (len(nodes) / 2) + 1
-	results := make(chan error, len(nodes))
-	timeout := time.After(WriteTimeout)
+	got, results, pending, err := c.query(key, nodes, c.fetch)
+	if err != nil {
+		return record{}, err
+	}
+
+	best := resolve(got)
+	go c.repair(key, got, results, pending)
+
+	if !best.found || isTombstone(best.data) {
+		return record{}, fmt.Errorf("not found")
+	}
+	return decodeRecord(best.data), nil
+}
+
+// query returns once readQuorum answers are in; at most pending more arrive
+// on results.
+func (c *Cluster) query(key string, nodes []string, fetch func(node, key string) readResult) (got []readResult, results chan readResult, pending int, err error) {
+	quorum := min(c.readQuorum, len(nodes))
+	results = make(chan readResult, len(nodes))
+	timeout := time.After(ReadTimeout)
 
 	for _, n := range nodes {
 		select {
 		case <-c.workers:
 			go func(node string) {
 				defer func() { c.workers <- struct{}{} }()
-				var err error
-				if node == c.self {
-					err = c.storage.Delete(key)
-				} else {
-					err = c.client.Delete(node, key, c.authKey)
-				}
-				results <- err
+				results <- fetch(node, key)
 			}(n)
 		case <-time.After(50 * time.Millisecond):
-			return fmt.Errorf("worker pool exhausted")
+			return nil, nil, 0, fmt.Errorf("worker pool exhausted")
 		}
 	}
 
-	ok := 0
-	for i := 0; i < len(nodes); i++ {
+	failed := 0
+	for len(got) < quorum {
 		select {
-		case err := <-results:
-			if err == nil {
-				ok++
-				if ok >= quorum {
-					return nil
+		case r := <-results:
+			if r.err != nil {
+				failed++
+				if failed > len(nodes)-quorum {
+					return nil, nil, 0, fmt.Errorf("quorum failed: %d/%d", len(got), quorum)
 				}
+				continue
 			}
+			got = append(got, r)
 		case <-timeout:
-			return fmt.Errorf("timeout")
+			return nil, nil, 0, fmt.Errorf("timeout")
 		}
 	}
+	return got, results, len(nodes) - len(got) - failed, nil
+}
 
-	return fmt.Errorf("quorum failed: %d/%d", ok, quorum)
+func resolve(results []readResult) readResult {
+	var best readResult
+	for _, r := range results {
+		if r.found && (!best.found || best.ver.less(r.ver)) {
+			best = r
+		}
+	}
+	return best
+}
+
+func (c *Cluster) repair(key string, got []readResult, results chan readResult, pending int) {
+	timeout := time.After(ReadTimeout)
+	for ; pending > 0; pending-- {
+		select {
+		case r := <-results:
+			if r.err == nil {
+				got = append(got, r)
+			}
+		case <-timeout:
+			pending = 0
+		}
+	}
+
+	best := resolve(got)
+	if !best.found {
+		return
+	}
+
+	for _, r := range got {
+		if r.found && !r.ver.less(best.ver) {
+			continue
+		}
+		if r.node == c.self {
+			c.storage.put(decodeRecord(best.data))
+		} else {
+			c.client.Sync(r.node, key, c.authKey, best.data)
+		}
+	}
 }
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testNode struct {
+	addr string
+	v    *Vault
+	ln   net.Listener
+}
+
+// startCluster runs n nodes on loopback, each with its own data directory.
+func startCluster(t *testing.T, n, readQuorum int) []*testNode {
+	t.Helper()
+	var nodes []*testNode
+	var addrs []string
+	for range n {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		nodes = append(nodes, &testNode{addr: ln.Addr().String(), ln: ln})
+		addrs = append(addrs, ln.Addr().String())
+	}
+	t.Setenv("CLUSTER_NODES", strings.Join(addrs, ","))
+
+	for _, n := range nodes {
+		s, err := NewStorage(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		n.v = &Vault{storage: s, cluster: NewCluster(n.addr, "", s, 50, readQuorum)}
+		go NewBinaryServer(n.v, "", AuthNone, 0, time.Now()).Serve(n.ln)
+	}
+	t.Cleanup(func() {
+		for _, n := range nodes {
+			n.ln.Close()
+			n.v.storage.Close()
+		}
+	})
+	return nodes
+}
+
+// waitFor fails t unless cond holds within a second.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestReadRepair(t *testing.T) {
+	nodes := startCluster(t, 3, 3)
+	stored := func(n *testNode, key, want string) func() bool {
+		return func() bool {
+			v, err := n.v.storage.Get(key)
+			return err == nil && string(v) == want
+		}
+	}
+
+	t.Run("Missing", func(t *testing.T) {
+		if err := nodes[0].v.cluster.write("k1", []byte("v1")); err != nil {
+			t.Fatal(err)
+		}
+		waitFor(t, "replication", stored(nodes[1], "k1", "v1"))
+		nodes[1].v.storage.remove("k1", hash64str("k1"))
+
+		rec, err := nodes[2].v.cluster.read("k1")
+		if err != nil || string(rec.value) != "v1" {
+			t.Fatalf("read: %q %v", rec.value, err)
+		}
+		waitFor(t, "repair", stored(nodes[1], "k1", "v1"))
+	})
+
+	t.Run("Stale", func(t *testing.T) {
+		old := nodes[1].v.storage.newRecord("k2", []byte("old"))
+		old.ver.ts = 1
+		if err := nodes[0].v.cluster.write("k2", []byte("new")); err != nil {
+			t.Fatal(err)
+		}
+		waitFor(t, "replication", stored(nodes[1], "k2", "new"))
+		if err := nodes[1].v.storage.put(old); err != errStale {
+			t.Fatalf("older write: %v", err)
+		}
+		nodes[1].v.storage.remove("k2", hash64str("k2"))
+		if err := nodes[1].v.storage.put(old); err != nil {
+			t.Fatal(err)
+		}
+
+		rec, err := nodes[2].v.cluster.read("k2")
+		if err != nil || string(rec.value) != "new" {
+			t.Fatalf("read: %q %v", rec.value, err)
+		}
+		waitFor(t, "repair", stored(nodes[1], "k2", "new"))
+	})
+}
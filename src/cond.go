@@ -0,0 +1,43 @@
+package main
+
+import "fmt"
+
+const (
+	condNone    = 0x00
+	condVersion = 0x01
+	condAbsent  = 0x02
+	condPresent = 0x03
+)
+
+const condLen = 1 + versionLen
+
+// condition is a precondition on the version a key currently holds.
+type condition struct {
+	kind byte
+	ver  version
+}
+
+func (c condition) holds(cur version, exists bool) bool {
+	switch c.kind {
+	case condVersion:
+		return exists && cur == c.ver
+	case condAbsent:
+		return !exists
+	case condPresent:
+		return exists
+	}
+	return true
+}
+
+func (c condition) put(b []byte) {
+	b[0] = c.kind
+	c.ver.put(b[1:])
+}
+
+func readCondition(b []byte) (condition, error) {
+	c := condition{kind: b[0], ver: readVersion(b[1:])}
+	if c.kind > condPresent {
+		return condition{}, fmt.Errorf("invalid condition")
+	}
+	return c, nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestConditionalWrite(t *testing.T) {
+	nodes := startCluster(t, 3, 2)
+	c := nodes[0].v.cluster
+
+	v1, err := c.writeIf("c", []byte("a"), "", 0, condition{kind: condAbsent})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.writeIf("c", []byte("b"), "", 0, condition{kind: condAbsent}); err != errConflict {
+		t.Fatalf("create over an existing key: %v", err)
+	}
+	if _, err := c.writeIf("c", []byte("b"), "", 0, condition{kind: condVersion, ver: version{ts: 1}}); err != errConflict {
+		t.Fatalf("write against a wrong version: %v", err)
+	}
+	v2, err := nodes[1].v.cluster.writeIf("c", []byte("b"), "", 0, condition{kind: condVersion, ver: v1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.deleteIf("c", condition{kind: condVersion, ver: v1}); err != errConflict {
+		t.Fatalf("delete against an old version: %v", err)
+	}
+	if err := c.deleteIf("c", condition{kind: condVersion, ver: v2}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.read("c"); err == nil {
+		t.Fatal("deleted key is back")
+	}
+}
+
+func TestConditionalWriteConflict(t *testing.T) {
+	nodes := startCluster(t, 3, 1)
+	c := nodes[0].v.cluster
+	h, err := newHints(t.TempDir(), 1<<20, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.hints = h
+
+	ver, err := c.writeIf("ck", []byte("v1"), "", 0, condition{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// two owners move on behind the coordinator's back.
+	newer := nodes[1].v.storage.newRecord("ck", []byte("v2"))
+	newer.ver.ts = ver.ts + 1000
+	for _, n := range nodes[1:] {
+		if err := n.v.storage.put(newer); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := c.writeIf("ck", []byte("bad"), "", 0, condition{kind: condVersion, ver: ver}); err != errConflict {
+		t.Fatalf("write against an old version: %v", err)
+	}
+	if err := c.deleteIf("ck", condition{kind: condVersion, ver: ver}); err != errConflict {
+		t.Fatalf("delete against an old version: %v", err)
+	}
+	for i, n := range nodes {
+		data, ok := n.v.storage.fetch("ck")
+		if !ok || string(decodeRecord(data).value) == "bad" {
+			t.Fatalf("node %d: rejected write applied", i)
+		}
+	}
+	if h.count.Load() != 0 {
+		t.Fatalf("%d hints for an aborted write", h.count.Load())
+	}
+
+	// the coordinator's own copy fails the condition, the quorum doesn't.
+	if _, err := c.writeIf("ck", []byte("v3"), "", 0, condition{kind: condVersion, ver: newer.ver}); err != nil {
+		t.Fatal(err)
+	}
+	if h.count.Load() != 1 {
+		t.Fatalf("%d hints for the owner that voted against the write", h.count.Load())
+	}
+	h.replay(func(target string, rec []byte) error {
+		return c.client.Sync(target, decodeRecord(rec).key, c.authKey, rec)
+	})
+	for i, n := range nodes {
+		if v, err := n.v.storage.Get("ck"); err != nil || string(v) != "v3" {
+			t.Fatalf("node %d: %q %v", i, v, err)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"sync"
+)
+
+// hash index snapshot: [count:u64]([hash:u64][size:u64])*
+const (
+	hashIndexFile    = "keys.idx"
+	hashIndexMagic   = 0x4D564858
+	hashIndexVersion = 1
+)
+
+// hashIndex holds the hash and file size of every record the file backend
+// holds.
+type hashIndex struct {
+	mu    sync.RWMutex
+	m     map[uint64]int64
+	bytes int64
+}
+
+func newHashIndex() *hashIndex {
+	return &hashIndex{m: make(map[uint64]int64)}
+}
+
+func (x *hashIndex) get(h uint64) (int64, bool) {
+	x.mu.RLock()
+	size, ok := x.m[h]
+	x.mu.RUnlock()
+	return size, ok
+}
+
+func (x *hashIndex) put(h uint64, size int64) {
+	x.mu.Lock()
+	x.bytes += size - x.m[h]
+	x.m[h] = size
+	x.mu.Unlock()
+}
+
+func (x *hashIndex) del(h uint64) {
+	x.mu.Lock()
+	x.bytes -= x.m[h]
+	delete(x.m, h)
+	x.mu.Unlock()
+}
+
+func (x *hashIndex) stats() (keys int, bytes int64) {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	return len(x.m), x.bytes
+}
+
+func (x *hashIndex) hashes() []uint64 {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	hs := make([]uint64, 0, len(x.m))
+	for h := range x.m {
+		hs = append(hs, h)
+	}
+	return hs
+}
+
+func (x *hashIndex) save(path string) error {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+
+	return writeSnapshot(path, hashIndexMagic, hashIndexVersion, func(w *bufio.Writer) error {
+		var buf [16]byte
+		binary.LittleEndian.PutUint64(buf[:], uint64(len(x.m)))
+		w.Write(buf[:8])
+		for h, size := range x.m {
+			binary.LittleEndian.PutUint64(buf[:], h)
+			binary.LittleEndian.PutUint64(buf[8:], uint64(size))
+			if _, err := w.Write(buf[:]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func loadHashIndex(path string) (*hashIndex, error) {
+	x := newHashIndex()
+	err := readSnapshot(path, hashIndexMagic, hashIndexVersion, func(r *bufio.Reader) error {
+		var buf [16]byte
+		if _, err := io.ReadFull(r, buf[:8]); err != nil {
+			return err
+		}
+		n := binary.LittleEndian.Uint64(buf[:])
+		for range n {
+			if _, err := io.ReadFull(r, buf[:]); err != nil {
+				return err
+			}
+			size := int64(binary.LittleEndian.Uint64(buf[8:]))
+			x.m[binary.LittleEndian.Uint64(buf[:])] = size
+			x.bytes += size
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return x, nil
+}
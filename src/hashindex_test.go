@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHashIndex(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range 500 {
+		if err := s.Set(fmt.Sprintf("k%d", i), []byte(fmt.Sprintf("v%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	big := bytes.Repeat([]byte("z"), 3<<20)
+	if err := s.SetFrom("big", bytes.NewReader(big), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete("k1"); err != nil {
+		t.Fatal(err)
+	}
+	s.remove("k2", hash64str("k2"))
+	e := s.backend.(*fileBackend)
+	if e.keysFrom != "scan" {
+		t.Fatalf("keys from %s in a new store", e.keysFrom)
+	}
+	if _, err := e.Get(12345); !os.IsNotExist(err) {
+		t.Fatalf("absent hash: %v", err)
+	}
+	s.Close()
+	index := filepath.Join(dir, hashIndexFile)
+	if _, err := os.Stat(index); err != nil {
+		t.Fatal(err)
+	}
+
+	if s, err = NewStorage(dir); err != nil {
+		t.Fatal(err)
+	}
+	e = s.backend.(*fileBackend)
+	if e.keysFrom != "snapshot" {
+		t.Fatalf("keys from %s after a clean close", e.keysFrom)
+	}
+	if _, err := os.Stat(index); !os.IsNotExist(err) {
+		t.Fatal("index kept while open")
+	}
+	if keys, _ := e.keys.stats(); keys != 500 {
+		t.Fatalf("%d keys indexed", keys)
+	}
+	if v, err := s.Get("k7"); err != nil || string(v) != "v7" {
+		t.Fatalf("k7: %q %v", v, err)
+	}
+	for _, k := range []string{"k1", "k2"} {
+		if _, err := s.Get(k); err == nil {
+			t.Fatalf("%s is back", k)
+		}
+	}
+	var buf bytes.Buffer
+	if _, err := s.GetTo("big", &buf); err != nil || !bytes.Equal(buf.Bytes(), big) {
+		t.Fatalf("big: %d bytes, %v", buf.Len(), err)
+	}
+	if err := s.Set("after", []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("Crash", func(t *testing.T) {
+		crashed := t.TempDir()
+		copyDir(t, dir, crashed)
+		s, err := NewStorage(crashed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		e := s.backend.(*fileBackend)
+		if e.keysFrom != "scan" {
+			t.Fatalf("keys from %s after a crash", e.keysFrom)
+		}
+		if keys, _ := e.keys.stats(); keys != 501 {
+			t.Fatalf("%d keys indexed", keys)
+		}
+		if v, err := s.Get("after"); err != nil || string(v) != "x" {
+			t.Fatalf("after: %q %v", v, err)
+		}
+	})
+	s.Close()
+
+	t.Run("Damaged", func(t *testing.T) {
+		b, err := os.ReadFile(index)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b[20] ^= 1
+		if err := os.WriteFile(index, b, 0644); err != nil {
+			t.Fatal(err)
+		}
+		s, err := NewStorage(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		if e := s.backend.(*fileBackend); e.keysFrom != "scan" {
+			t.Fatalf("keys from %s with a damaged index", e.keysFrom)
+		}
+		if v, err := s.Get("k7"); err != nil || string(v) != "v7" {
+			t.Fatalf("k7: %q %v", v, err)
+		}
+	})
+}
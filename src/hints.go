@@ -0,0 +1,286 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	hintInterval = 5 * time.Second
+	hintTxDir    = "tx"
+)
+
+// each hint is a file dir/<target hash>/<unix nanos>-<key hash> holding
+// [targetlen:u16][target][record].
+type hints struct {
+	dir      string
+	maxBytes int64
+	maxAge   time.Duration
+	mu       sync.Mutex
+	size     atomic.Int64
+	count    atomic.Int64
+}
+
+func newHints(dir string, maxBytes int64, maxAge time.Duration) (*hints, error) {
+	if err := os.MkdirAll(filepath.Join(dir, hintTxDir), 0755); err != nil {
+		return nil, err
+	}
+
+	h := &hints{dir: dir, maxBytes: maxBytes, maxAge: maxAge}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info.IsDir() {
+			if path == filepath.Join(dir, hintTxDir) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if filepath.Ext(path) == ".tmp" {
+			os.Remove(path)
+			return nil
+		}
+		h.size.Add(info.Size())
+		h.count.Add(1)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	h.recoverTx()
+	return h, nil
+}
+
+func (h *hints) add(target string, rec []byte) error {
+	size := int64(2 + len(target) + len(rec))
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.size.Load()+size > h.maxBytes {
+		return fmt.Errorf("hint store full")
+	}
+
+	dir := filepath.Join(h.dir, fmtHex(hash64str(target)))
+	_, err := os.Stat(dir)
+	created := os.IsNotExist(err)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	buf := make([]byte, size)
+	binary.LittleEndian.PutUint16(buf, uint16(len(target)))
+	copy(buf[2:], target)
+	copy(buf[2+len(target):], rec)
+
+	name := fmt.Sprintf("%d-%s", time.Now().UnixNano(), fmtHex(hash64(rec)))
+	path := filepath.Join(dir, name)
+	if err := writeSynced(path+".tmp", buf); err != nil {
+		os.Remove(path + ".tmp")
+		return err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		os.Remove(path + ".tmp")
+		return err
+	}
+	if err := syncDir(dir); err != nil {
+		return err
+	}
+	if created {
+		if err := syncDir(h.dir); err != nil {
+			return err
+		}
+	}
+
+	h.size.Add(size)
+	h.count.Add(1)
+	return nil
+}
+
+func writeSynced(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// logTx writes a transaction's writes for every target as one file under
+// hintTxDir, which recoverTx turns into hints after a crash.
+func (h *hints) logTx(id string, targets []string, recs [][]byte) (string, error) {
+	size := 4
+	for i := range targets {
+		size += 2 + len(targets[i]) + 4 + len(recs[i])
+	}
+	buf := make([]byte, 4, size)
+	binary.LittleEndian.PutUint32(buf, uint32(len(targets)))
+	for i := range targets {
+		buf = binary.LittleEndian.AppendUint16(buf, uint16(len(targets[i])))
+		buf = append(buf, targets[i]...)
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(len(recs[i])))
+		buf = append(buf, recs[i]...)
+	}
+
+	dir := filepath.Join(h.dir, hintTxDir)
+	path := filepath.Join(dir, fmtHex(hash64str(id)))
+	if err := writeSynced(path+".tmp", buf); err != nil {
+		os.Remove(path + ".tmp")
+		return "", err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		os.Remove(path + ".tmp")
+		return "", err
+	}
+	return path, syncDir(dir)
+}
+
+func (h *hints) recoverTx() {
+	dir := filepath.Join(h.dir, hintTxDir)
+	files, _ := os.ReadDir(dir)
+	for _, f := range files {
+		path := filepath.Join(dir, f.Name())
+		if strings.HasSuffix(f.Name(), ".tmp") {
+			os.Remove(path)
+			continue
+		}
+		if err := h.expandTx(path); err != nil {
+			log.Printf("hints: transaction %s: %v", f.Name(), err)
+			continue
+		}
+		os.Remove(path)
+	}
+}
+
+func (h *hints) expandTx(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if len(data) < 4 {
+		return fmt.Errorf("short transaction log")
+	}
+	count := int(binary.LittleEndian.Uint32(data))
+	n := 4
+	for range count {
+		if n+2 > len(data) {
+			return fmt.Errorf("short transaction log")
+		}
+		tl := int(binary.LittleEndian.Uint16(data[n:]))
+		if n+2+tl+4 > len(data) {
+			return fmt.Errorf("short transaction log")
+		}
+		target := string(data[n+2 : n+2+tl])
+		n += 2 + tl
+		rl := int(binary.LittleEndian.Uint32(data[n:]))
+		if n+4+rl > len(data) {
+			return fmt.Errorf("short transaction log")
+		}
+		if err := h.add(target, data[n+4:n+4+rl]); err != nil {
+			return err
+		}
+		n += 4 + rl
+	}
+	return nil
+}
+
+func (h *hints) remove(path string, size int64) {
+	if os.Remove(path) == nil {
+		h.size.Add(-size)
+		h.count.Add(-1)
+	}
+}
+
+// replay skips a target for the round at its first failed send.
+func (h *hints) replay(send func(target string, rec []byte) error) int {
+	targets, err := os.ReadDir(h.dir)
+	if err != nil {
+		return 0
+	}
+
+	delivered := 0
+	for _, t := range targets {
+		if !t.IsDir() || t.Name() == hintTxDir {
+			continue
+		}
+		dir := filepath.Join(h.dir, t.Name())
+		files, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		sort.Slice(files, func(i, j int) bool {
+			return hintTime(files[i].Name()) < hintTime(files[j].Name())
+		})
+
+		for _, f := range files {
+			if strings.HasSuffix(f.Name(), ".tmp") {
+				continue
+			}
+			path := filepath.Join(dir, f.Name())
+			data, err := os.ReadFile(path)
+			if err != nil {
+				continue
+			}
+			size := int64(len(data))
+
+			if time.Since(time.Unix(0, hintTime(f.Name()))) > h.maxAge || len(data) < 2 {
+				h.remove(path, size)
+				continue
+			}
+			tl := int(binary.LittleEndian.Uint16(data))
+			if 2+tl > len(data) {
+				h.remove(path, size)
+				continue
+			}
+
+			if err := send(string(data[2:2+tl]), data[2+tl:]); err != nil {
+				break
+			}
+			h.remove(path, size)
+			delivered++
+		}
+	}
+	return delivered
+}
+
+func hintTime(name string) int64 {
+	ts, _, _ := strings.Cut(name, "-")
+	n, _ := strconv.ParseInt(ts, 10, 64)
+	return n
+}
+
+func (c *Cluster) hint(target string, rec []byte) {
+	if c.hints == nil {
+		return
+	}
+	if err := c.hints.add(target, rec); err != nil {
+		log.Printf("hint for %s: %v", target, err)
+	}
+}
+
+func (c *Cluster) replayHints() {
+	ticker := time.NewTicker(hintInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		c.hints.replay(func(target string, rec []byte) error {
+			return c.client.Sync(target, decodeRecord(rec).key, c.authKey, rec)
+		})
+	}
+}
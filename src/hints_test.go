@@ -0,0 +1,83 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHintedHandoff(t *testing.T) {
+	nodes := startCluster(t, 3, 1)
+	c := nodes[0].v.cluster
+	h, err := newHints(filepath.Join(t.TempDir(), "hints"), 1<<20, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.hints = h
+	nodes[2].ln.Close()
+	// a new client, so no pooled connection reaches the closed node.
+	c.client = NewBinaryClient()
+
+	if err := c.write("hk", []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "a hint", func() bool { return h.count.Load() == 1 })
+	send := func(target string, rec []byte) error {
+		return c.client.Sync(target, decodeRecord(rec).key, "", rec)
+	}
+	if n := h.replay(send); n != 0 || h.count.Load() != 1 {
+		t.Fatalf("delivered %d hints to a closed node", n)
+	}
+
+	n := h.replay(func(target string, rec []byte) error {
+		if target != nodes[2].addr {
+			t.Fatalf("hint for %s", target)
+		}
+		return nodes[2].v.storage.put(decodeRecord(rec))
+	})
+	if n != 1 || h.count.Load() != 0 || h.size.Load() != 0 {
+		t.Fatalf("delivered %d, %d left in %d bytes", n, h.count.Load(), h.size.Load())
+	}
+	if v, _ := nodes[2].v.storage.Get("hk"); string(v) != "v" {
+		t.Fatalf("hk: %q", v)
+	}
+}
+
+func TestHintsReopen(t *testing.T) {
+	dir := t.TempDir()
+	h, err := newHints(dir, 1<<20, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := record{key: "k", value: []byte("v"), ver: version{ts: 1, node: 1}}
+	for _, target := range []string{"a:1", "a:1", "b:1"} {
+		if err := h.add(target, rec.encode()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	size := h.size.Load()
+	leftover := filepath.Join(dir, fmtHex(hash64str("a:1")), "1-0.tmp")
+	if err := os.WriteFile(leftover, []byte("torn"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	h, err = newHints(dir, size+1, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.count.Load() != 3 || h.size.Load() != size {
+		t.Fatalf("%d hints in %d bytes, want 3 in %d", h.count.Load(), h.size.Load(), size)
+	}
+	if _, err := os.Stat(leftover); !os.IsNotExist(err) {
+		t.Fatal("temp file left behind")
+	}
+	if err := h.add("c:1", rec.encode()); err == nil {
+		t.Fatal("hint added to a full store")
+	}
+
+	h.maxAge = 0
+	if n := h.replay(func(string, []byte) error { return nil }); n != 0 || h.count.Load() != 0 {
+		t.Fatalf("delivered %d hints past their age", n)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const versionLen = 12
+
+// version is a hybrid logical clock timestamp, with the writing node's id
+// breaking ties.
+type version struct {
+	ts   uint64
+	node uint32
+}
+
+func (v version) less(o version) bool {
+	if v.ts != o.ts {
+		return v.ts < o.ts
+	}
+	return v.node < o.node
+}
+
+func (v version) isZero() bool {
+	return v.ts == 0 && v.node == 0
+}
+
+func (v version) put(b []byte) {
+	binary.LittleEndian.PutUint64(b[0:8], v.ts)
+	binary.LittleEndian.PutUint32(b[8:12], v.node)
+}
+
+func readVersion(b []byte) version {
+	return version{
+		ts:   binary.LittleEndian.Uint64(b[0:8]),
+		node: binary.LittleEndian.Uint32(b[8:12]),
+	}
+}
+
+func (v version) String() string {
+	return fmt.Sprintf("%016x%08x", v.ts, v.node)
+}
+
+func nodeID(url string) uint32 {
+	return crc32.ChecksumIEEE([]byte(url))
+}
+
+// hlc timestamps are wall clock milliseconds in the high 48 bits and a
+// logical counter in the low 16.
+type hlc struct {
+	mu   sync.Mutex
+	last uint64
+}
+
+func (c *hlc) now() uint64 {
+	pt := uint64(time.Now().UnixMilli()) << 16
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if pt > c.last {
+		c.last = pt
+	} else {
+		c.last++
+	}
+	return c.last
+}
+
+func (c *hlc) observe(ts uint64) {
+	c.mu.Lock()
+	if ts > c.last {
+		c.last = ts
+	}
+	c.mu.Unlock()
+}
+
+func parseVersion(s string) (version, error) {
+	if len(s) != 2*versionLen {
+		return version{}, fmt.Errorf("invalid version")
+	}
+	ts, err := strconv.ParseUint(s[:16], 16, 64)
+	if err != nil {
+		return version{}, fmt.Errorf("invalid version")
+	}
+	node, err := strconv.ParseUint(s[16:], 16, 32)
+	if err != nil {
+		return version{}, fmt.Errorf("invalid version")
+	}
+	return version{ts: ts, node: uint32(node)}, nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHLC(t *testing.T) {
+	var c hlc
+	last := c.now()
+	for range 10000 {
+		ts := c.now()
+		if ts <= last {
+			t.Fatalf("%d after %d", ts, last)
+		}
+		last = ts
+	}
+
+	ahead := uint64(time.Now().Add(time.Hour).UnixMilli()) << 16
+	c.observe(ahead)
+	if ts := c.now(); ts <= ahead {
+		t.Fatalf("%d after observing %d", ts, ahead)
+	}
+}
+
+func TestVersion(t *testing.T) {
+	a := version{ts: 5, node: 2}
+	b := version{ts: 5, node: 3}
+	c := version{ts: 6, node: 1}
+	if !a.less(b) || !b.less(c) || c.less(a) || a.less(a) {
+		t.Fatal("order")
+	}
+
+	v, err := parseVersion(c.String())
+	if err != nil || v != c {
+		t.Fatalf("parsed %v, %v", v, err)
+	}
+	for _, s := range []string{"", "xyz", c.String()[1:], "zz" + c.String()[2:]} {
+		if _, err := parseVersion(s); err == nil {
+			t.Fatalf("parsed %q", s)
+		}
+	}
+}
+
+func TestStorageVersions(t *testing.T) {
+	s, err := NewStorage(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.node = 1
+
+	if err := s.Set("k", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	first, _ := s.index.get("k")
+	if err := s.Set("k", []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+	second, _ := s.index.get("k")
+	if !first.ver.less(second.ver) {
+		t.Fatalf("%v then %v", first.ver, second.ver)
+	}
+
+	old := record{key: "k", value: []byte("old"), ver: first.ver}
+	if err := s.put(old); err != errStale {
+		t.Fatalf("older write: %v", err)
+	}
+	tie := record{key: "k", value: []byte("tie"), ver: version{ts: second.ver.ts, node: 2}}
+	if err := s.put(tie); err != nil {
+		t.Fatalf("same time, higher node: %v", err)
+	}
+	if v, _ := s.Get("k"); string(v) != "tie" {
+		t.Fatalf("got %q", v)
+	}
+
+	ahead := record{key: "r", value: []byte("v"), ver: version{ts: second.ver.ts + 1<<32, node: 9}}
+	if err := s.put(ahead); err != nil {
+		t.Fatal(err)
+	}
+	if ts := s.clock.now(); ts <= ahead.ver.ts {
+		t.Fatal("clock did not observe a replicated version")
+	}
+}
@@ -1,9 +1,12 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"fmt"
+	"io"
 	"net/http"
-	"runtime"
+	"strconv"
 	"strings"
 	"time"
 
@@ -42,6 +45,18 @@ func (s *HTTPServer) checkAuth(r *http.Request, needsAuth bool) bool {
 	return r.Header.Get("Authorization") == "Bearer "+s.authKey
 }
 
+// endpoints that aren't keys live under apiPrefix.
+const apiPrefix = "_/"
+func keyError(key string) string {
+	switch {
+	case len(key) > MaxKeySize:
+		return "key too long"
+	case strings.HasPrefix(key, apiPrefix):
+		return "reserved key"
+	}
+	return ""
+}
+
 func (s *HTTPServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if s.limiter != nil && !s.limiter.Allow() {
 		w.Header().Set("Content-Type", "application/json")
@@ -56,17 +71,27 @@ func (s *HTTPServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	key := strings.TrimPrefix(r.URL.Path, "/")
-	if key == "" {
+	if key == "" && r.Method != http.MethodGet {
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(map[string]interface{}{"success": false, "error": "key required"})
 		return
 	}
+	if len(key) > MaxKeySize {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(400)
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": false, "error": "key too long"})
+		return
+	}
+
+	api, isAPI := strings.CutPrefix(key, apiPrefix)
+	batch, isBatch := strings.CutPrefix(api, "batch/")
+	isBatch = isAPI && isBatch && r.Method == http.MethodPost
 
 	needsAuth := false
 	if s.authMode == AuthAll {
 		needsAuth = true
 	} else if s.authMode == AuthWrites && (r.Method == http.MethodPut || r.Method == http.MethodPost || r.Method == http.MethodDelete) {
-		needsAuth = true
+		needsAuth = !(isBatch && batch == "get")
 	}
 
 	if !s.checkAuth(r, needsAuth) {
@@ -78,54 +103,107 @@ func (s *HTTPServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Set("Content-Type", "application/json")
 
+	if key == "" {
+		s.handleScan(w, r)
+		return
+	}
+
+	if isAPI {
+		switch {
+		case isBatch:
+			s.handleBatch(w, r, batch)
+		case api == "tx" && r.Method == http.MethodPost:
+			s.handleTx(w, r)
+		default:
+			w.WriteHeader(404)
+			json.NewEncoder(w).Encode(map[string]interface{}{"success": false, "error": "unknown endpoint"})
+		}
+		return
+	}
+
 	switch r.Method {
 	case http.MethodGet:
-		data, err := s.vault.storage.Get(key)
+		rec, err := s.vault.cluster.read(key)
 		if err != nil {
 			w.WriteHeader(404)
 			json.NewEncoder(w).Encode(map[string]interface{}{"success": false, "error": "not found"})
 			return
 		}
 
+		if !rec.ver.isZero() {
+			w.Header().Set("ETag", etag(rec.ver))
+		}
+
+		if !envelope(r) {
+			ctype := rec.ctype
+			if ctype == "" {
+				ctype = "application/octet-stream"
+			}
+			w.Header().Set("Content-Type", ctype)
+			w.Header().Set("Content-Length", strconv.Itoa(len(rec.value)))
+			w.Write(rec.value)
+			return
+		}
+
 		var value interface{}
-		if err := json.Unmarshal(data, &value); err != nil {
-			value = string(data)
+		if err := json.Unmarshal(rec.value, &value); err != nil {
+			value = string(rec.value)
 		}
 
 		json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "data": value})
 
 	case http.MethodPut, http.MethodPost:
-		var req map[string]interface{}
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		cond, err := parseCondition(r)
+		if err != nil {
 			w.WriteHeader(400)
-			json.NewEncoder(w).Encode(map[string]interface{}{"success": false, "error": "invalid json"})
+			json.NewEncoder(w).Encode(map[string]interface{}{"success": false, "error": err.Error()})
 			return
 		}
 
-		value, ok := req["value"]
-		if !ok {
+		ttl, err := parseTTL(r)
+		if err != nil {
 			w.WriteHeader(400)
-			json.NewEncoder(w).Encode(map[string]interface{}{"success": false, "error": "missing value field"})
+			json.NewEncoder(w).Encode(map[string]interface{}{"success": false, "error": err.Error()})
 			return
 		}
 
-		data, err := json.Marshal(value)
+		data, ctype, status, err := readBody(r)
 		if err != nil {
-			w.WriteHeader(400)
-			json.NewEncoder(w).Encode(map[string]interface{}{"success": false, "error": "failed to marshal value"})
+			w.WriteHeader(status)
+			json.NewEncoder(w).Encode(map[string]interface{}{"success": false, "error": err.Error()})
 			return
 		}
 
-		if err := s.vault.cluster.write(key, data); err != nil {
+		ver, err := s.vault.cluster.writeIf(key, data, ctype, ttl, cond)
+		if err == errConflict {
+			w.WriteHeader(412)
+			json.NewEncoder(w).Encode(map[string]interface{}{"success": false, "error": "precondition failed"})
+			return
+		}
+		if err != nil {
 			w.WriteHeader(500)
 			json.NewEncoder(w).Encode(map[string]interface{}{"success": false, "error": "write error"})
 			return
 		}
 
+		w.Header().Set("ETag", etag(ver))
 		json.NewEncoder(w).Encode(map[string]interface{}{"success": true})
 
 	case http.MethodDelete:
-		if err := s.vault.cluster.delete(key); err != nil {
+		cond, err := parseCondition(r)
+		if err != nil {
+			w.WriteHeader(400)
+			json.NewEncoder(w).Encode(map[string]interface{}{"success": false, "error": err.Error()})
+			return
+		}
+
+		err = s.vault.cluster.deleteIf(key, cond)
+		if err == errConflict {
+			w.WriteHeader(412)
+			json.NewEncoder(w).Encode(map[string]interface{}{"success": false, "error": "precondition failed"})
+			return
+		}
+		if err != nil {
 			w.WriteHeader(500)
 			json.NewEncoder(w).Encode(map[string]interface{}{"success": false, "error": "delete error"})
 			return
@@ -138,20 +216,287 @@ func (s *HTTPServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (s *HTTPServer) handleHealth(w http.ResponseWriter, r *http.Request) {
-	var m runtime.MemStats
-	runtime.ReadMemStats(&m)
+func envelope(r *http.Request) bool {
+	return r.URL.Query().Get("format") == "json"
+}
+
+func readBody(r *http.Request) ([]byte, string, int, error) {
+	body := http.MaxBytesReader(nil, r.Body, MaxValueSize)
 
-	health := map[string]interface{}{
-		"status":          "healthy",
-		"uptime_seconds":  int64(time.Since(s.startTime).Seconds()),
-		"cache_items":     s.vault.storage.cache.items.Load(),
-		"cache_size_mb":   s.vault.storage.cache.size.Load() / (1024 * 1024),
-		"storage_size_mb": s.vault.storage.size.Load() / (1024 * 1024),
-		"goroutines":      runtime.NumGoroutine(),
-		"memory_mb":       m.Alloc / (1024 * 1024),
+	if envelope(r) {
+		var req map[string]interface{}
+		if err := json.NewDecoder(body).Decode(&req); err != nil {
+			return nil, "", 400, fmt.Errorf("invalid json")
+		}
+		value, ok := req["value"]
+		if !ok {
+			return nil, "", 400, fmt.Errorf("missing value field")
+		}
+		data, err := json.Marshal(value)
+		if err != nil {
+			return nil, "", 400, fmt.Errorf("failed to marshal value")
+		}
+		return data, "application/json", 0, nil
+	}
+
+	ctype := r.Header.Get("Content-Type")
+	if ctype == "" {
+		ctype = "application/octet-stream"
+	}
+	if len(ctype) > maxTypeLen {
+		return nil, "", 400, fmt.Errorf("content type too long")
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, "", 413, fmt.Errorf("too large")
 	}
+	return data, ctype, 0, nil
+}
+
+func etag(v version) string {
+	return `"` + v.String() + `"`
+}
+
+func parseCondition(r *http.Request) (condition, error) {
+	return condFrom(r.Header.Get("If-Match"), r.Header.Get("If-None-Match"))
+}
+
+func condFrom(ifMatch, ifNoneMatch string) (condition, error) {
+	if m := ifNoneMatch; m != "" {
+		if m != "*" {
+			return condition{}, fmt.Errorf("unsupported If-None-Match")
+		}
+		return condition{kind: condAbsent}, nil
+	}
+
+	m := ifMatch
+	if m == "" {
+		return condition{}, nil
+	}
+	if m == "*" {
+		return condition{kind: condPresent}, nil
+	}
+	ver, err := parseVersion(strings.Trim(strings.TrimPrefix(m, "W/"), `"`))
+	if err != nil {
+		return condition{}, fmt.Errorf("invalid If-Match")
+	}
+	return condition{kind: condVersion, ver: ver}, nil
+}
+
+func parseTTL(r *http.Request) (time.Duration, error) {
+	v := r.URL.Query().Get("ttl")
+	if v == "" {
+		v = r.Header.Get("X-TTL")
+	}
+	if v == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseUint(v, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid ttl")
+	}
+	return time.Duration(n) * time.Second, nil
+}
 
+func (s *HTTPServer) handleScan(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	limit := 0
+	if l := q.Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 0 {
+			w.WriteHeader(400)
+			json.NewEncoder(w).Encode(map[string]interface{}{"success": false, "error": "invalid limit"})
+			return
+		}
+		limit = n
+	}
+
+	keys, next, err := s.vault.cluster.scan(q.Get("prefix"), q.Get("cursor"), limit)
+	if err == errKeyTooLong {
+		w.WriteHeader(400)
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": false, "error": err.Error()})
+		return
+	}
+	if err != nil {
+		w.WriteHeader(500)
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": false, "error": "scan failed"})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "keys": keys, "cursor": next})
+}
+
+func (s *HTTPServer) handleBatch(w http.ResponseWriter, r *http.Request, op string) {
+	var req struct {
+		Keys   []string                   `json:"keys"`
+		Values map[string]json.RawMessage `json:"values"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, MaxValueSize)).Decode(&req); err != nil {
+		w.WriteHeader(400)
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": false, "error": "invalid json"})
+		return
+	}
+	if len(req.Keys) > maxBatchKeys || len(req.Values) > maxBatchKeys {
+		w.WriteHeader(400)
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": false, "error": "too many keys"})
+		return
+	}
+	for _, key := range req.Keys {
+		if msg := keyError(key); msg != "" {
+			w.WriteHeader(400)
+			json.NewEncoder(w).Encode(map[string]interface{}{"success": false, "error": msg})
+			return
+		}
+	}
+	for key := range req.Values {
+		if msg := keyError(key); msg != "" {
+			w.WriteHeader(400)
+			json.NewEncoder(w).Encode(map[string]interface{}{"success": false, "error": msg})
+			return
+		}
+	}
+
+	results := make(map[string]bool)
+	switch op {
+	case "get":
+		recs, status := s.vault.cluster.readBatch(req.Keys)
+		data := make(map[string]interface{})
+		for i, key := range req.Keys {
+			if status[i] == 0xFF {
+				w.WriteHeader(500)
+				json.NewEncoder(w).Encode(map[string]interface{}{"success": false, "error": "read error"})
+				return
+			}
+			if status[i] != 0x00 {
+				continue
+			}
+			var value interface{}
+			if err := json.Unmarshal(recs[i].value, &value); err != nil {
+				value = string(recs[i].value)
+			}
+			data[key] = value
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "data": data})
+		return
+
+	case "set":
+		ttl, err := parseTTL(r)
+		if err != nil {
+			w.WriteHeader(400)
+			json.NewEncoder(w).Encode(map[string]interface{}{"success": false, "error": err.Error()})
+			return
+		}
+		keys := make([]string, 0, len(req.Values))
+		values := make([][]byte, 0, len(req.Values))
+		for key, value := range req.Values {
+			var buf bytes.Buffer
+			json.Compact(&buf, value)
+			keys = append(keys, key)
+			values = append(values, buf.Bytes())
+		}
+		for i, st := range s.vault.cluster.writeBatch(keys, values, "application/json", ttl) {
+			results[keys[i]] = st == 0x00
+		}
+
+	case "delete":
+		for i, st := range s.vault.cluster.deleteBatch(req.Keys) {
+			results[req.Keys[i]] = st == 0x00
+		}
+
+	default:
+		w.WriteHeader(404)
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": false, "error": "unknown batch operation"})
+		return
+	}
+
+	success := true
+	for _, ok := range results {
+		success = success && ok
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"success": success, "results": results})
+}
+
+func (s *HTTPServer) handleTx(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Ops []struct {
+			Op          string          `json:"op"`
+			Key         string          `json:"key"`
+			Value       json.RawMessage `json:"value"`
+			IfMatch     string          `json:"if_match"`
+			IfNoneMatch string          `json:"if_none_match"`
+		} `json:"ops"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, MaxValueSize)).Decode(&req); err != nil {
+		w.WriteHeader(400)
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": false, "error": "invalid json"})
+		return
+	}
+	ttl, err := parseTTL(r)
+	if err != nil {
+		w.WriteHeader(400)
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": false, "error": err.Error()})
+		return
+	}
+
+	ops := make([]txOp, len(req.Ops))
+	for i, o := range req.Ops {
+		cond, err := condFrom(o.IfMatch, o.IfNoneMatch)
+		if err != nil {
+			w.WriteHeader(400)
+			json.NewEncoder(w).Encode(map[string]interface{}{"success": false, "error": err.Error()})
+			return
+		}
+		if msg := keyError(o.Key); msg != "" {
+			w.WriteHeader(400)
+			json.NewEncoder(w).Encode(map[string]interface{}{"success": false, "error": msg})
+			return
+		}
+		ops[i] = txOp{rec: record{key: o.Key}, cond: cond}
+
+		switch o.Op {
+		case "set":
+			if o.Value == nil {
+				w.WriteHeader(400)
+				json.NewEncoder(w).Encode(map[string]interface{}{"success": false, "error": "missing value field"})
+				return
+			}
+			var buf bytes.Buffer
+			json.Compact(&buf, o.Value)
+			ops[i].rec.value = buf.Bytes()
+			ops[i].rec.ctype = "application/json"
+			if ttl > 0 {
+				ops[i].rec.expires = time.Now().Add(ttl).UnixMilli()
+			}
+		case "delete":
+			ops[i].del = true
+		default:
+			w.WriteHeader(400)
+			json.NewEncoder(w).Encode(map[string]interface{}{"success": false, "error": "unknown operation"})
+			return
+		}
+	}
+	if err := validTx(ops); err != nil {
+		w.WriteHeader(400)
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": false, "error": err.Error()})
+		return
+	}
+
+	ver, err := s.vault.cluster.transact(ops)
+	if err == errConflict {
+		w.WriteHeader(412)
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": false, "error": "precondition failed"})
+		return
+	}
+	if err != nil {
+		w.WriteHeader(500)
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": false, "error": "transaction failed"})
+		return
+	}
+
+	w.Header().Set("ETag", etag(ver))
+	json.NewEncoder(w).Encode(map[string]interface{}{"success": true})
+}
+
+func (s *HTTPServer) handleHealth(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(health)
+	json.NewEncoder(w).Encode(s.vault.health(s.startTime))
 }
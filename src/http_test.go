@@ -0,0 +1,86 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestHTTP(t *testing.T) *HTTPServer {
+	nodes := startCluster(t, 1, 1)
+	return NewHTTPServer(nodes[0].v, "", AuthNone, 0, time.Now())
+}
+
+func do(h http.Handler, method, path, body string, hdr map[string]string) *httptest.ResponseRecorder {
+	var r io.Reader
+	if body != "" {
+		r = strings.NewReader(body)
+	}
+	req := httptest.NewRequest(method, path, r)
+	for k, v := range hdr {
+		req.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+func TestHTTPConditional(t *testing.T) {
+	h := newTestHTTP(t)
+	w := do(h, "PUT", "/k", "1", map[string]string{"If-None-Match": "*"})
+	if w.Code != 200 {
+		t.Fatal(w.Code, w.Body)
+	}
+	tag := w.Header().Get("ETag")
+	if w := do(h, "PUT", "/k", "2", map[string]string{"If-None-Match": "*"}); w.Code != 412 {
+		t.Fatal(w.Code, w.Body)
+	}
+	if w := do(h, "GET", "/k", "", nil); w.Header().Get("ETag") != tag {
+		t.Fatalf("etag %q, want %q", w.Header().Get("ETag"), tag)
+	}
+	if w := do(h, "PUT", "/k", "2", map[string]string{"If-Match": tag}); w.Code != 200 {
+		t.Fatal(w.Code, w.Body)
+	}
+	if w := do(h, "DELETE", "/k", "", map[string]string{"If-Match": tag}); w.Code != 412 {
+		t.Fatal(w.Code, w.Body)
+	}
+	if w := do(h, "PUT", "/k", "3", map[string]string{"If-Match": "bogus"}); w.Code != 400 {
+		t.Fatal(w.Code, w.Body)
+	}
+}
+
+func TestHTTPRawBody(t *testing.T) {
+	h := newTestHTTP(t)
+	bin := "\x00\xff\x10binary"
+	if w := do(h, "PUT", "/img", bin, map[string]string{"Content-Type": "image/png"}); w.Code != 200 {
+		t.Fatal(w.Code, w.Body)
+	}
+	if w := do(h, "GET", "/img", "", nil); w.Body.String() != bin || w.Header().Get("Content-Type") != "image/png" {
+		t.Fatalf("%q as %q", w.Body.Bytes(), w.Header().Get("Content-Type"))
+	}
+
+	if w := do(h, "PUT", "/plain", "plain", nil); w.Code != 200 {
+		t.Fatal(w.Code, w.Body)
+	}
+	if w := do(h, "GET", "/plain", "", nil); w.Body.String() != "plain" || w.Header().Get("Content-Type") != "application/octet-stream" {
+		t.Fatalf("%q as %q", w.Body.String(), w.Header().Get("Content-Type"))
+	}
+
+	t.Run("Envelope", func(t *testing.T) {
+		if w := do(h, "PUT", "/j?format=json", `{"value":{"a":1}}`, nil); w.Code != 200 {
+			t.Fatal(w.Code, w.Body)
+		}
+		if w := do(h, "GET", "/j?format=json", "", nil); !strings.Contains(w.Body.String(), `"data":{"a":1}`) {
+			t.Fatal(w.Body)
+		}
+		if w := do(h, "GET", "/j", "", nil); w.Body.String() != `{"a":1}` || w.Header().Get("Content-Type") != "application/json" {
+			t.Fatalf("%q as %q", w.Body.String(), w.Header().Get("Content-Type"))
+		}
+		if w := do(h, "GET", "/img?format=json", "", nil); w.Code != 200 || !strings.Contains(w.Body.String(), `"data"`) {
+			t.Fatal(w.Code, w.Body)
+		}
+	})
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	indexMaxLevel = 24
+	scanDefLimit  = 100
+	scanMaxLimit  = 1000
+)
+
+// keyIndex keeps every stored key in lexical order so prefixes can be listed.
+type keyIndex struct {
+	mu    sync.RWMutex
+	head  *indexNode
+	level int
+	count int
+	rng   uint64
+}
+
+type indexNode struct {
+	key  string
+	meta keyMeta
+	next []*indexNode
+}
+
+// keyMeta of a deleted key stays in the index until the tombstone expires.
+type keyMeta struct {
+	h       uint64
+	ver     version
+	expires int64
+	deleted bool
+}
+
+func (m keyMeta) live(now time.Time) bool {
+	return !m.deleted && !expired(m.expires, now)
+}
+
+func newKeyIndex() *keyIndex {
+	return &keyIndex{
+		head:  &indexNode{next: make([]*indexNode, indexMaxLevel)},
+		level: 1,
+		rng:   0x9E3779B97F4A7C15,
+	}
+}
+
+func (x *keyIndex) randLevel() int {
+	x.rng ^= x.rng << 13
+	x.rng ^= x.rng >> 7
+	x.rng ^= x.rng << 17
+	lvl := 1
+	for r := x.rng; lvl < indexMaxLevel && r&3 == 0; r >>= 2 {
+		lvl++
+	}
+	return lvl
+}
+
+func (x *keyIndex) put(key string, m keyMeta) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	var update [indexMaxLevel]*indexNode
+	n := x.head
+	for i := x.level - 1; i >= 0; i-- {
+		for n.next[i] != nil && n.next[i].key < key {
+			n = n.next[i]
+		}
+		update[i] = n
+	}
+
+	if next := n.next[0]; next != nil && next.key == key {
+		next.meta = m
+		return
+	}
+
+	lvl := x.randLevel()
+	if lvl > x.level {
+		for i := x.level; i < lvl; i++ {
+			update[i] = x.head
+		}
+		x.level = lvl
+	}
+
+	node := &indexNode{key: key, meta: m, next: make([]*indexNode, lvl)}
+	for i := 0; i < lvl; i++ {
+		node.next[i] = update[i].next[i]
+		update[i].next[i] = node
+	}
+	x.count++
+}
+
+func (x *keyIndex) get(key string) (keyMeta, bool) {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+
+	n := x.head
+	for i := x.level - 1; i >= 0; i-- {
+		for n.next[i] != nil && n.next[i].key < key {
+			n = n.next[i]
+		}
+	}
+	if n = n.next[0]; n != nil && n.key == key {
+		return n.meta, true
+	}
+	return keyMeta{}, false
+}
+
+func (x *keyIndex) del(key string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	var update [indexMaxLevel]*indexNode
+	n := x.head
+	for i := x.level - 1; i >= 0; i-- {
+		for n.next[i] != nil && n.next[i].key < key {
+			n = n.next[i]
+		}
+		update[i] = n
+	}
+
+	target := n.next[0]
+	if target == nil || target.key != key {
+		return
+	}
+	for i := 0; i < len(target.next); i++ {
+		if update[i].next[i] == target {
+			update[i].next[i] = target.next[i]
+		}
+	}
+	for x.level > 1 && x.head.next[x.level-1] == nil {
+		x.level--
+	}
+	x.count--
+}
+
+func (x *keyIndex) len() int {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	return x.count
+}
+
+func (x *keyIndex) snapshot() ([]string, []keyMeta) {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+
+	keys := make([]string, 0, x.count)
+	metas := make([]keyMeta, 0, x.count)
+	for n := x.head.next[0]; n != nil; n = n.next[0] {
+		keys = append(keys, n.key)
+		metas = append(metas, n.meta)
+	}
+	return keys, metas
+}
+
+func (x *keyIndex) scan(prefix, cursor string, limit int) ([]string, string) {
+	if limit <= 0 {
+		limit = scanDefLimit
+	}
+	if limit > scanMaxLimit {
+		limit = scanMaxLimit
+	}
+
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+
+	n := x.head
+	for i := x.level - 1; i >= 0; i-- {
+		for n.next[i] != nil && (n.next[i].key < prefix || (cursor != "" && n.next[i].key <= cursor)) {
+			n = n.next[i]
+		}
+	}
+
+	now := time.Now()
+	keys := make([]string, 0, min(limit, x.count))
+	for n = n.next[0]; n != nil && strings.HasPrefix(n.key, prefix); n = n.next[0] {
+		if !n.meta.live(now) {
+			continue
+		}
+		if len(keys) == limit {
+			return keys, keys[len(keys)-1]
+		}
+		keys = append(keys, n.key)
+	}
+	return keys, ""
+}
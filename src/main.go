@@ -4,21 +4,27 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"math"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"runtime"
 	"syscall"
 	"time"
 )
 
 const (
+	// key lengths are stored as u16 everywhere.
+	MaxKeySize   = math.MaxUint16
 	MaxValueSize = 100 * 1024 * 1024
 	MaxCacheSize = 512 * 1024 * 1024
 	WriteTimeout = 30 * time.Second
+	ReadTimeout  = 5 * time.Second
 	WorkerPool   = 50
 	ReplicaCount = 3
+	TombstoneTTL = 24 * time.Hour
 )
 
 type AuthMode int
@@ -34,6 +40,53 @@ type Vault struct {
 	cluster *Cluster
 }
 
+func (v *Vault) health(startTime time.Time) map[string]interface{} {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+
+	health := map[string]interface{}{
+		"status":          "healthy",
+		"uptime_seconds":  int64(time.Since(startTime).Seconds()),
+		"cache_items":     v.storage.cache.items.Load(),
+		"cache_size_mb":   v.storage.cache.size.Load() / (1024 * 1024),
+		"cache_hit_rate":  v.storage.cache.hitRate(),
+		"cache_bloom":     v.storage.cache.filter.stats(),
+		"storage_size_mb": v.storage.size.Load() / (1024 * 1024),
+		"goroutines":      runtime.NumGoroutine(),
+		"memory_mb":       m.Alloc / (1024 * 1024),
+		"anti_entropy": map[string]interface{}{
+			"rounds":   v.cluster.aeRounds.Load(),
+			"repaired": v.cluster.aeRepaired.Load(),
+			"last_run": v.cluster.aeLast.Load(),
+		},
+		"members": v.cluster.memberStates(),
+		"engine":  v.storage.backend.Stats(),
+		"startup": v.storage.startupStats(),
+		"rebalance": map[string]interface{}{
+			"running":  v.cluster.rbRunning.Load(),
+			"keys":     v.cluster.rbTotal.Load(),
+			"scanned":  v.cluster.rbScanned.Load(),
+			"moved":    v.cluster.rbMoved.Load(),
+			"dropped":  v.cluster.rbDropped.Load(),
+			"failed":   v.cluster.rbFailed.Load(),
+			"passes":   v.cluster.rbPasses.Load(),
+			"last_run": v.cluster.rbLast.Load(),
+		},
+		"transactions": map[string]interface{}{
+			"committed": v.cluster.txCommitted.Load(),
+			"aborted":   v.cluster.txAborted.Load(),
+			"prepared":  v.storage.txs.pending.Load(),
+		},
+	}
+	if h := v.cluster.hints; h != nil {
+		health["hints"] = map[string]interface{}{
+			"pending": h.count.Load(),
+			"bytes":   h.size.Load(),
+		}
+	}
+	return health
+}
+
 func main() {
 	port := flag.Int("port", 3000, "port")
 	pubURL := flag.String("public-url", "", "public url")
@@ -44,6 +97,17 @@ func main() {
 	cacheSize := flag.Int64("cache", 512, "cache size (MB)")
 	workers := flag.Int("workers", 50, "worker pool size")
 	httpPort := flag.Int("http", 0, "http port (0=disabled)")
+	readQuorum := flag.Int("read-quorum", 1, "replicas that must answer a read")
+	antiEntropy := flag.Duration("anti-entropy", time.Minute, "replica comparison interval (0=disabled)")
+	hintMax := flag.Int64("hint-max", 1024, "hinted handoff storage limit (MB)")
+	hintAge := flag.Duration("hint-age", 3*time.Hour, "drop hints older than this")
+	gossip := flag.Duration("gossip", time.Second, "failure detector probe interval (0=static membership)")
+	rebalance := flag.Duration("rebalance", 10*time.Second, "membership check interval for rebalancing (0=disabled)")
+	rebalanceDrop := flag.Bool("rebalance-drop", false, "drop local copies of keys handed off to their new owners")
+	engineName := flag.String("engine", "files", "storage engine: files, segments, memory")
+	tombstoneTTL := flag.Duration("tombstone-ttl", TombstoneTTL, "how long deletes are remembered for replicas that missed them (keep above -hint-age)")
+	durabilityName := flag.String("durability", "group", "when writes are acknowledged: async, group (fsync before ack, shared), sync (fsync per write)")
+	cacheWarmup := flag.Bool("cache-warmup", true, "record the hottest keys at shutdown and load them back into the cache on start")
 	flag.Parse()
 
 	runtime.GOMAXPROCS(runtime.NumCPU())
@@ -70,20 +134,49 @@ func main() {
 
 	MaxCacheSizeRuntime := *cacheSize * 1024 * 1024
 
-	storage, err := NewStorage(*dataDir)
+	durability, err := parseDurability(*durabilityName)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	storage, err := NewStorageEngine(*dataDir, *engineName, durability)
 	if err != nil {
 		log.Fatal(err)
 	}
 
 	storage.maxSize = MaxCacheSizeRuntime
+	storage.tombstoneTTL = *tombstoneTTL
+	storage.warmup = *cacheWarmup
+	if *cacheWarmup {
+		go storage.warmUp()
+	}
 
-	cluster := NewCluster(*pubURL, *authKey, storage, *workers)
+	cluster := NewCluster(*pubURL, *authKey, storage, *workers, *readQuorum)
+	cluster.rebalanceDrop = *rebalanceDrop
+
+	cluster.hints, err = newHints(filepath.Join(*dataDir, "hints"), *hintMax*1024*1024, *hintAge)
+	if err != nil {
+		log.Fatal(err)
+	}
+	go cluster.replayHints()
 
 	vault := &Vault{
 		storage: storage,
 		cluster: cluster,
 	}
 
+	if *gossip > 0 {
+		go cluster.gossip(*gossip)
+	}
+
+	if *rebalance > 0 {
+		go cluster.rebalance(*rebalance)
+	}
+
+	if *antiEntropy > 0 {
+		go cluster.antiEntropy(*antiEntropy)
+	}
+
 	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", *port))
 	if err != nil {
 		log.Fatal(err)
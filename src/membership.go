@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"time"
+)
+
+const (
+	stateAlive   = 0
+	stateSuspect = 1
+	stateDead    = 2
+)
+
+const (
+	pingTimeout    = 500 * time.Millisecond
+	suspectTimeout = 5 * time.Second
+	indirectProbes = 3
+)
+
+var stateNames = [...]string{"alive", "suspect", "dead"}
+
+type member struct {
+	url         string
+	state       byte
+	incarnation uint32
+}
+
+func encodeMembers(ms []member) []byte {
+	size := 0
+	for _, m := range ms {
+		size += 2 + len(m.url) + 1 + 4
+	}
+	buf := make([]byte, size)
+	n := 0
+	for _, m := range ms {
+		binary.LittleEndian.PutUint16(buf[n:], uint16(len(m.url)))
+		n += 2
+		n += copy(buf[n:], m.url)
+		buf[n] = m.state
+		binary.LittleEndian.PutUint32(buf[n+1:], m.incarnation)
+		n += 5
+	}
+	return buf
+}
+
+func decodeMembers(b []byte) ([]member, error) {
+	var ms []member
+	for len(b) > 0 {
+		if len(b) < 2 {
+			return nil, fmt.Errorf("truncated members")
+		}
+		ul := int(binary.LittleEndian.Uint16(b))
+		if len(b) < 2+ul+5 || b[2+ul] > stateDead {
+			return nil, fmt.Errorf("truncated members")
+		}
+		ms = append(ms, member{
+			url:         string(b[2 : 2+ul]),
+			state:       b[2+ul],
+			incarnation: binary.LittleEndian.Uint32(b[3+ul:]),
+		})
+		b = b[2+ul+5:]
+	}
+	return ms, nil
+}
+
+func (c *Cluster) members() []member {
+	c.memberMu.Lock()
+	defer c.memberMu.Unlock()
+
+	var ms []member
+	c.nodes.Range(func(_, v any) bool {
+		n := v.(*node)
+		ms = append(ms, member{url: n.url, state: n.state, incarnation: n.incarnation})
+		return true
+	})
+	return ms
+}
+
+// merge lets a higher incarnation win, and dead over suspect over alive
+// within one. rumours about this node are refuted with a new incarnation.
+func (c *Cluster) merge(ms []member) {
+	c.memberMu.Lock()
+	defer c.memberMu.Unlock()
+
+	now := time.Now()
+	for _, m := range ms {
+		if m.url == c.self {
+			if m.state != stateAlive && m.incarnation >= c.incarnation {
+				c.incarnation = m.incarnation + 1
+				if v, ok := c.nodes.Load(c.self); ok {
+					v.(*node).incarnation = c.incarnation
+				}
+			}
+			continue
+		}
+
+		v, ok := c.nodes.Load(m.url)
+		if !ok {
+			c.nodes.Store(m.url, &node{url: m.url, state: m.state, incarnation: m.incarnation, changed: now})
+			log.Printf("member %s joined (%s)", m.url, stateNames[m.state])
+			continue
+		}
+
+		n := v.(*node)
+		if m.incarnation > n.incarnation || (m.incarnation == n.incarnation && m.state > n.state) {
+			if m.state != n.state {
+				n.changed = now
+				log.Printf("member %s is %s", m.url, stateNames[m.state])
+			}
+			n.state, n.incarnation = m.state, m.incarnation
+		}
+	}
+}
+
+func (c *Cluster) markAlive(url string) {
+	c.memberMu.Lock()
+	defer c.memberMu.Unlock()
+
+	if v, ok := c.nodes.Load(url); ok {
+		n := v.(*node)
+		n.seen = time.Now()
+	}
+}
+
+func (c *Cluster) markSuspect(url string) {
+	c.memberMu.Lock()
+	defer c.memberMu.Unlock()
+
+	if v, ok := c.nodes.Load(url); ok {
+		n := v.(*node)
+		if n.state == stateAlive {
+			n.state, n.changed = stateSuspect, time.Now()
+			log.Printf("member %s is suspect", url)
+		}
+	}
+}
+
+func (c *Cluster) expireSuspects() {
+	c.memberMu.Lock()
+	defer c.memberMu.Unlock()
+
+	c.nodes.Range(func(_, v any) bool {
+		n := v.(*node)
+		if n.state == stateSuspect && time.Since(n.changed) > suspectTimeout {
+			n.state, n.changed = stateDead, time.Now()
+			log.Printf("member %s is dead", n.url)
+		}
+		return true
+	})
+}
+
+// gossip runs the SWIM failure detector.
+func (c *Cluster) gossip(interval time.Duration) {
+	for _, seed := range c.seeds {
+		c.ping(seed)
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		c.expireSuspects()
+
+		var peers []string
+		for _, m := range c.members() {
+			if m.url != c.self {
+				peers = append(peers, m.url)
+			}
+		}
+		if len(peers) == 0 {
+			continue
+		}
+		rand.Shuffle(len(peers), func(i, j int) { peers[i], peers[j] = peers[j], peers[i] })
+
+		target := peers[0]
+		if c.ping(target) == nil {
+			continue
+		}
+		if c.probeIndirect(target, peers[1:]) {
+			c.markAlive(target)
+			continue
+		}
+		c.markSuspect(target)
+	}
+}
+
+func (c *Cluster) ping(target string) error {
+	ms, err := c.client.Ping(target, c.self, c.authKey, encodeMembers(c.members()))
+	if err != nil {
+		return err
+	}
+	c.markAlive(target)
+	c.merge(ms)
+	return nil
+}
+
+func (c *Cluster) probeIndirect(target string, helpers []string) bool {
+	helpers = helpers[:min(len(helpers), indirectProbes)]
+	if len(helpers) == 0 {
+		return false
+	}
+
+	results := make(chan bool, len(helpers))
+	for _, h := range helpers {
+		go func(helper string) {
+			results <- c.client.PingReq(helper, target, c.authKey) == nil
+		}(h)
+	}
+	for range helpers {
+		if <-results {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Cluster) memberStates() map[string]string {
+	states := make(map[string]string)
+	for _, m := range c.members() {
+		states[m.url] = stateNames[m.state]
+	}
+	return states
+}
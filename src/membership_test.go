@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestGossipJoin(t *testing.T) {
+	nodes := startCluster(t, 3, 1)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	t.Setenv("CLUSTER_NODES", nodes[0].addr)
+	s, err := NewStorage(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	c := NewCluster(ln.Addr().String(), "", s, 50, 1)
+	go NewBinaryServer(&Vault{storage: s, cluster: c}, "", AuthNone, 0, time.Now()).Serve(ln)
+
+	if err := c.ping(nodes[0].addr); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.getNodes()) != 4 || len(nodes[0].v.cluster.getNodes()) != 4 {
+		t.Fatalf("after joining: %v and %v", c.memberStates(), nodes[0].v.cluster.memberStates())
+	}
+	if err := nodes[0].v.cluster.ping(nodes[1].addr); err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes[1].v.cluster.getNodes()) != 4 {
+		t.Fatalf("gossiped on: %v", nodes[1].v.cluster.memberStates())
+	}
+}
+
+func TestGossipFailureDetection(t *testing.T) {
+	nodes := startCluster(t, 3, 1)
+	c := nodes[0].v.cluster
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead := ln.Addr().String()
+	ln.Close()
+
+	c.merge([]member{{url: dead, state: stateAlive, incarnation: 1}})
+	if c.ping(dead) == nil || c.probeIndirect(dead, []string{nodes[1].addr}) {
+		t.Fatal("closed node answered")
+	}
+	c.markSuspect(dead)
+	if !slices.Contains(c.getNodes(), dead) {
+		t.Fatal("suspect dropped before its timeout")
+	}
+	n, _ := c.nodes.Load(dead)
+	n.(*node).changed = time.Now().Add(-time.Minute)
+	c.expireSuspects()
+	if c.memberStates()[dead] != "dead" || slices.Contains(c.getNodes(), dead) {
+		t.Fatalf("after the timeout: %v", c.memberStates())
+	}
+	if err := c.write("gk", []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGossipRefute(t *testing.T) {
+	nodes := startCluster(t, 3, 1)
+	c := nodes[0].v.cluster
+	peer := nodes[1].v.cluster
+
+	c.merge([]member{{url: nodes[1].addr, state: stateSuspect, incarnation: peer.incarnation}})
+	if c.memberStates()[nodes[1].addr] != "suspect" {
+		t.Fatalf("rumour ignored: %v", c.memberStates())
+	}
+	before := peer.incarnation
+	if err := c.ping(nodes[1].addr); err != nil {
+		t.Fatal(err)
+	}
+	if c.memberStates()[nodes[1].addr] != "alive" {
+		t.Fatalf("not refuted: %v", c.memberStates())
+	}
+	c.merge([]member{{url: nodes[1].addr, state: stateDead, incarnation: before}})
+	if c.memberStates()[nodes[1].addr] != "alive" {
+		t.Fatal("an older incarnation's rumour won")
+	}
+}
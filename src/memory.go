@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"sync"
+)
+
+// memBackend keeps records in a map and loses them on exit.
+type memBackend struct {
+	mu   sync.RWMutex
+	recs map[uint64][]byte
+	size int64
+}
+
+func newMemBackend() *memBackend {
+	return &memBackend{recs: make(map[uint64][]byte)}
+}
+
+func (m *memBackend) Get(h uint64) ([]byte, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	data, ok := m.recs[h]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return data, nil
+}
+
+func (m *memBackend) Set(h uint64, data []byte) error {
+	return m.Batch([]walEntry{{hash: h, data: data}})
+}
+
+func (m *memBackend) Delete(h uint64) error {
+	return m.Batch([]walEntry{{hash: h}})
+}
+
+func (m *memBackend) Batch(writes []walEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, w := range writes {
+		m.size -= int64(len(m.recs[w.hash]))
+		if w.data == nil {
+			delete(m.recs, w.hash)
+			continue
+		}
+		m.recs[w.hash] = w.data
+		m.size += int64(len(w.data))
+	}
+	return nil
+}
+
+func (m *memBackend) Scan(fn func(h uint64)) error {
+	m.mu.RLock()
+	hashes := make([]uint64, 0, len(m.recs))
+	for h := range m.recs {
+		hashes = append(hashes, h)
+	}
+	m.mu.RUnlock()
+
+	for _, h := range hashes {
+		fn(h)
+	}
+	return nil
+}
+
+func (m *memBackend) Open(h uint64) (io.ReadCloser, error) {
+	data, err := m.Get(h)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (m *memBackend) Create(h uint64) (*os.File, error) {
+	return os.CreateTemp("", "minivault-"+fmtHex(h)+"-*.tmp")
+}
+
+func (m *memBackend) Commit(h uint64, tmp string, head record) error {
+	defer os.Remove(tmp)
+	data, err := os.ReadFile(tmp)
+	if err != nil {
+		return err
+	}
+	return m.Set(h, data)
+}
+
+func (m *memBackend) Stats() map[string]interface{} {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return map[string]interface{}{
+		"engine":  "memory",
+		"keys":    len(m.recs),
+		"size_mb": m.size / (1024 * 1024),
+	}
+}
+
+func (m *memBackend) Close() error {
+	return nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import "encoding/binary"
+
+const (
+	merkleBits   = 10
+	merkleLeaves = 1 << merkleBits
+)
+
+type merkleItem struct {
+	key string
+	ver version
+}
+
+// merkleTree leaves xor their items' digests, so they don't depend on
+// iteration order.
+type merkleTree struct {
+	levels [][]uint64
+	items  [][]merkleItem
+}
+
+func itemDigest(h uint64, ver version) uint64 {
+	var b [8 + versionLen]byte
+	binary.LittleEndian.PutUint64(b[:8], h)
+	ver.put(b[8:])
+	return hash64(b[:])
+}
+
+func leafOf(h uint64) int {
+	return int(h >> (64 - merkleBits))
+}
+
+func buildMerkle(leaves []uint64) *merkleTree {
+	t := &merkleTree{levels: [][]uint64{leaves}}
+	var b [16]byte
+	for level := leaves; len(level) > 1; {
+		next := make([]uint64, len(level)/2)
+		for i := range next {
+			binary.LittleEndian.PutUint64(b[:8], level[2*i])
+			binary.LittleEndian.PutUint64(b[8:], level[2*i+1])
+			next[i] = hash64(b[:])
+		}
+		t.levels = append(t.levels, next)
+		level = next
+	}
+	return t
+}
+
+func (t *merkleTree) root() uint64 {
+	return t.levels[len(t.levels)-1][0]
+}
+
+func (t *merkleTree) diff(o *merkleTree) []int {
+	var out []int
+	var walk func(level, i int)
+	walk = func(level, i int) {
+		if t.levels[level][i] == o.levels[level][i] {
+			return
+		}
+		if level == 0 {
+			out = append(out, i)
+			return
+		}
+		walk(level-1, 2*i)
+		walk(level-1, 2*i+1)
+	}
+	walk(len(t.levels)-1, 0)
+	return out
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// after HELLO a connection speaks protocol version 2: requests are framed as
+// [id:u32][len:u32][request] and every response frame is sent back as
+// [id:u32][response], in whatever order the requests finish.
+const (
+	protocolVersion = 2
+	maxInflight     = 64
+	maxFrameSize    = batchMaxSize + 128*1024
+	legacyRetry     = time.Minute
+)
+
+var errNoPipelining = errors.New("pipelining not supported")
+
+// sequential reports whether op touches connection state.
+func sequential(op byte) bool {
+	switch op {
+	case OpAuth, OpHello, OpSetBegin, OpSetChunk, OpSetEnd, OpSyncBegin:
+		return true
+	}
+	return false
+}
+
+type frameWriter struct {
+	conn net.Conn
+	mu   *sync.Mutex
+	id   uint32
+	buf  []byte
+}
+
+func (f *frameWriter) Write(p []byte) (int, error) {
+	f.buf = append(f.buf, p...)
+	for len(f.buf) >= 5 {
+		n := 5 + int(binary.LittleEndian.Uint32(f.buf[1:5]))
+		if len(f.buf) < n {
+			break
+		}
+
+		var id [4]byte
+		binary.LittleEndian.PutUint32(id[:], f.id)
+		f.mu.Lock()
+		_, err := (&net.Buffers{id[:], f.buf[:n]}).WriteTo(f.conn)
+		f.mu.Unlock()
+		if err != nil {
+			return 0, err
+		}
+		f.buf = append(f.buf[:0], f.buf[n:]...)
+	}
+	return len(p), nil
+}
+
+func (f *frameWriter) writeFrame(bufs net.Buffers) error {
+	if len(f.buf) > 0 {
+		for _, b := range bufs {
+			if _, err := f.Write(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var id [4]byte
+	binary.LittleEndian.PutUint32(id[:], f.id)
+	frame := append(net.Buffers{id[:]}, bufs...)
+	f.mu.Lock()
+	_, err := frame.WriteTo(f.conn)
+	f.mu.Unlock()
+	return err
+}
+
+func (s *BinaryServer) servePipelined(conn net.Conn, sess *session, b *reqBufs) {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	inflight := make(chan struct{}, maxInflight)
+	var hdr [8]byte
+	for {
+		if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+			return
+		}
+		id := binary.LittleEndian.Uint32(hdr[:4])
+		n := binary.LittleEndian.Uint32(hdr[4:])
+		if n == 0 || n > maxFrameSize {
+			return
+		}
+		frame := make([]byte, n)
+		if _, err := io.ReadFull(conn, frame); err != nil {
+			return
+		}
+		fw := &frameWriter{conn: conn, mu: &mu, id: id}
+
+		if s.limiter != nil && !s.limiter.Allow() {
+			if writeErr(fw) != nil {
+				return
+			}
+			continue
+		}
+
+		if sequential(frame[0]) {
+			if !s.request(sess, bytes.NewReader(frame), fw, b) {
+				return
+			}
+			continue
+		}
+
+		inflight <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				if r := recover(); r != nil {
+					log.Printf("pipelined request from %s: %v\n%s", conn.RemoteAddr(), r, debug.Stack())
+					conn.Close()
+				}
+				<-inflight
+				wg.Done()
+			}()
+			rb := reqBufPool.Get().(*reqBufs)
+			defer reqBufPool.Put(rb)
+			if !s.request(sess, bytes.NewReader(frame), fw, rb) {
+				conn.Close()
+			}
+		}()
+	}
+}
+
+type muxResp struct {
+	status  byte
+	payload []byte
+	err     error
+}
+
+type muxConn struct {
+	conn    net.Conn
+	authKey string
+	wmu     sync.Mutex
+	mu      sync.Mutex
+	pending map[uint32]chan muxResp
+	nextID  uint32
+	err     error
+}
+
+type muxSlot struct {
+	mu     sync.Mutex
+	m      *muxConn
+	legacy time.Time
+}
+
+// mux returns nil without an error when addr only speaks the legacy framing.
+func (c *BinaryClient) mux(addr, authKey string) (*muxConn, error) {
+	v, _ := c.muxes.LoadOrStore(addr, &muxSlot{})
+	slot := v.(*muxSlot)
+
+	slot.mu.Lock()
+	defer slot.mu.Unlock()
+
+	if slot.m != nil && slot.m.alive() {
+		if slot.m.authKey != authKey {
+			return nil, nil
+		}
+		return slot.m, nil
+	}
+	if time.Since(slot.legacy) < legacyRetry {
+		return nil, nil
+	}
+
+	m, err := c.dialMux(addr, authKey)
+	if err == errNoPipelining {
+		slot.legacy = time.Now()
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	slot.m = m
+	return m, nil
+}
+
+func (c *BinaryClient) dialMux(addr, authKey string) (*muxConn, error) {
+	conn, err := c.getPool(addr).dial()
+	if err != nil {
+		return nil, err
+	}
+	if err := authenticate(conn, authKey); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	// servers that predate HELLO don't answer it at all.
+	conn.SetDeadline(time.Now().Add(pingTimeout))
+	if _, err := conn.Write([]byte{OpHello, 0, 0}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	var resp [6]byte
+	if _, err := io.ReadFull(conn, resp[:5]); err != nil {
+		conn.Close()
+		return nil, errNoPipelining
+	}
+	if resp[0] != 0x00 || binary.LittleEndian.Uint32(resp[1:5]) != 1 {
+		conn.Close()
+		return nil, errNoPipelining
+	}
+	if _, err := io.ReadFull(conn, resp[5:]); err != nil || resp[5] < protocolVersion {
+		conn.Close()
+		return nil, errNoPipelining
+	}
+	conn.SetDeadline(time.Time{})
+
+	m := &muxConn{conn: conn, authKey: authKey, pending: make(map[uint32]chan muxResp)}
+	go m.readLoop()
+	return m, nil
+}
+
+func (m *muxConn) alive() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.err == nil
+}
+
+func (m *muxConn) readLoop() {
+	var hdr [9]byte
+	for {
+		if _, err := io.ReadFull(m.conn, hdr[:]); err != nil {
+			m.fail(err)
+			return
+		}
+		id := binary.LittleEndian.Uint32(hdr[:4])
+		n := binary.LittleEndian.Uint32(hdr[5:])
+		if n > batchMaxSize {
+			m.fail(fmt.Errorf("too large"))
+			return
+		}
+		payload := make([]byte, n)
+		if _, err := io.ReadFull(m.conn, payload); err != nil {
+			m.fail(err)
+			return
+		}
+
+		m.mu.Lock()
+		ch := m.pending[id]
+		delete(m.pending, id)
+		m.mu.Unlock()
+		if ch != nil {
+			ch <- muxResp{status: hdr[4], payload: payload}
+		}
+	}
+}
+
+func (m *muxConn) fail(err error) {
+	m.mu.Lock()
+	if m.err == nil {
+		m.err = err
+	}
+	pending := m.pending
+	m.pending = nil
+	m.mu.Unlock()
+
+	m.conn.Close()
+	for _, ch := range pending {
+		ch <- muxResp{err: err}
+	}
+}
+
+func (m *muxConn) call(req []byte, timeout time.Duration) (byte, []byte, error) {
+	ch := make(chan muxResp, 1)
+	m.mu.Lock()
+	if m.err != nil {
+		err := m.err
+		m.mu.Unlock()
+		return 0, nil, err
+	}
+	m.nextID++
+	id := m.nextID
+	m.pending[id] = ch
+	m.mu.Unlock()
+
+	var hdr [8]byte
+	binary.LittleEndian.PutUint32(hdr[:4], id)
+	binary.LittleEndian.PutUint32(hdr[4:], uint32(len(req)))
+	m.wmu.Lock()
+	m.conn.SetWriteDeadline(time.Now().Add(timeout))
+	_, err := (&net.Buffers{hdr[:], req}).WriteTo(m.conn)
+	m.wmu.Unlock()
+	if err != nil {
+		m.fail(err)
+		return 0, nil, err
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case r := <-ch:
+		return r.status, r.payload, r.err
+	case <-timer.C:
+		m.mu.Lock()
+		delete(m.pending, id)
+		m.mu.Unlock()
+		return 0, nil, fmt.Errorf("timeout")
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPipelining(t *testing.T) {
+	nodes := startCluster(t, 3, 2)
+	c := NewBinaryClient()
+	var wg sync.WaitGroup
+	errs := make(chan error, 15)
+	for i := range 15 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			k := fmt.Sprintf("pk%d", i)
+			if err := nodes[1].v.cluster.write(k, []byte(k)); err != nil {
+				errs <- err
+				return
+			}
+			data, ok, err := c.Fetch(nodes[1].addr, k, "")
+			if err != nil || !ok || string(decodeRecord(data).value) != k {
+				errs <- fmt.Errorf("%s: found %v, %v", k, ok, err)
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	n := 0
+	c.muxes.Range(func(_, v any) bool {
+		n++
+		return v.(*muxSlot).m != nil
+	})
+	if n != 1 {
+		t.Fatalf("%d connections to one node", n)
+	}
+}
+
+func TestPipelinedFrames(t *testing.T) {
+	nodes := startCluster(t, 1, 1)
+	if err := nodes[0].v.storage.Set("pk", []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp", nodes[0].addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	conn.Write([]byte{OpHello, 0, 0})
+	hello := make([]byte, 6)
+	if _, err := io.ReadFull(conn, hello); err != nil || hello[0] != 0 || hello[5] != protocolVersion {
+		t.Fatalf("hello: %v %v", hello, err)
+	}
+
+	frame := func(id uint32, req []byte) []byte {
+		b := make([]byte, 8, 8+len(req))
+		binary.LittleEndian.PutUint32(b, id)
+		binary.LittleEndian.PutUint32(b[4:], uint32(len(req)))
+		return append(b, req...)
+	}
+	conn.Write(append(frame(7, keyRequest(OpGet, "pk", 0)), frame(9, keyRequest(OpHealth, "", 0))...))
+	seen := map[uint32]bool{}
+	for range 2 {
+		var hdr [9]byte
+		if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+			t.Fatal(err)
+		}
+		id := binary.LittleEndian.Uint32(hdr[:])
+		p := make([]byte, binary.LittleEndian.Uint32(hdr[5:]))
+		if _, err := io.ReadFull(conn, p); err != nil {
+			t.Fatal(err)
+		}
+		if id == 7 && (hdr[4] != 0 || string(p) != "v") {
+			t.Fatalf("get: status %d, %q", hdr[4], p)
+		}
+		seen[id] = true
+	}
+	if !seen[7] || !seen[9] {
+		t.Fatalf("responses for %v", seen)
+	}
+}
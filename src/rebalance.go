@@ -0,0 +1,174 @@
+package main
+
+import (
+	"log"
+	"slices"
+	"time"
+)
+
+type rebalanceBatch struct {
+	keys []string
+	recs [][]byte
+	size int
+}
+
+// rebalance retries failed hand-offs on every tick: anti-entropy never moves
+// keys this node no longer owns.
+func (c *Cluster) rebalance(interval time.Duration) {
+	prev := c.getNodes()
+	slices.Sort(prev)
+	var pending map[string][]string
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		cur := c.getNodes()
+		slices.Sort(cur)
+		if slices.Equal(prev, cur) && len(pending) == 0 {
+			continue
+		}
+		pending = c.rebalancePass(prev, cur, pending)
+		prev = cur
+	}
+}
+
+// rebalancePass sends each key to the owners it gained between prev and cur,
+// plus the targets retry holds for it, and returns the ones it failed to reach.
+func (c *Cluster) rebalancePass(prev, cur []string, retry map[string][]string) map[string][]string {
+	var (
+		keys  []string
+		metas []keyMeta
+	)
+	changed := !slices.Equal(prev, cur)
+	if changed {
+		keys, metas = c.storage.index.snapshot()
+	} else {
+		for key := range retry {
+			if m, ok := c.storage.index.get(key); ok {
+				keys = append(keys, key)
+				metas = append(metas, m)
+			}
+		}
+	}
+	now := time.Now()
+
+	c.rbRunning.Store(true)
+	defer c.rbRunning.Store(false)
+	c.rbTotal.Store(int64(len(keys)))
+	c.rbScanned.Store(0)
+	c.rbMoved.Store(0)
+	c.rbDropped.Store(0)
+	c.rbFailed.Store(0)
+
+	failed := make(map[string][]string)
+	batches := make(map[string]*rebalanceBatch)
+	acks := make(map[string]int)
+	vers := make(map[string]version)
+
+	flush := func(target string) {
+		b := batches[target]
+		if b == nil || len(b.recs) == 0 {
+			return
+		}
+		delete(batches, target)
+
+		if err := c.client.SyncBatch(target, c.authKey, b.recs); err != nil {
+			log.Printf("rebalance %s: %v", target, err)
+			c.rbFailed.Add(int64(len(b.keys)))
+			for _, key := range b.keys {
+				delete(acks, key)
+				failed[key] = append(failed[key], target)
+			}
+			return
+		}
+		c.rbMoved.Add(int64(len(b.keys)))
+
+		for _, key := range b.keys {
+			n, ok := acks[key]
+			if !ok {
+				continue
+			}
+			if n > 1 {
+				acks[key] = n - 1
+				continue
+			}
+			delete(acks, key)
+			if c.storage.drop(key, vers[key]) {
+				c.rbDropped.Add(1)
+			}
+		}
+	}
+
+	for i, key := range keys {
+		c.rbScanned.Add(1)
+		if expired(metas[i].expires, now) {
+			continue
+		}
+
+		owners := placement(key, cur, ReplicaCount)
+		var targets []string
+		if slices.Contains(owners, c.self) {
+			before := placement(key, prev, ReplicaCount)
+			for _, o := range owners {
+				if !slices.Contains(before, o) || slices.Contains(retry[key], o) {
+					targets = append(targets, o)
+				}
+			}
+		} else {
+			targets = owners
+			if c.rebalanceDrop {
+				acks[key] = len(owners)
+				vers[key] = metas[i].ver
+			}
+		}
+		if len(targets) == 0 {
+			continue
+		}
+
+		data, ok := c.storage.lookup(key)
+		if !ok {
+			delete(acks, key)
+			continue
+		}
+		for _, t := range targets {
+			b := batches[t]
+			if b == nil {
+				b = &rebalanceBatch{}
+				batches[t] = b
+			}
+			b.keys = append(b.keys, key)
+			b.recs = append(b.recs, data)
+			b.size += len(data)
+			if b.size >= antiEntropyBatch {
+				flush(t)
+			}
+		}
+	}
+
+	for t := range batches {
+		flush(t)
+	}
+
+	c.rbPasses.Add(1)
+	c.rbLast.Store(time.Now().Unix())
+	log.Printf("rebalance: moved %d, dropped %d, failed %d", c.rbMoved.Load(), c.rbDropped.Load(), c.rbFailed.Load())
+	return failed
+}
+
+// drop keeps a write that landed during the hand-off.
+func (s *Storage) drop(key string, ver version) bool {
+	h := hash64str(key)
+	mu := s.lock(h)
+	mu.Lock()
+	defer mu.Unlock()
+
+	if s.txs.holder(key, time.Now()) != "" {
+		return false
+	}
+	if cur, ok := s.index.get(key); ok && cur.ver == ver {
+		s.remove(key, h)
+		return true
+	}
+	return false
+}
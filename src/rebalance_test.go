@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"testing"
+	"time"
+)
+
+func writeKeys(t *testing.T, nodes []*testNode, prefix string, n int) {
+	t.Helper()
+	var addrs []string
+	for _, nd := range nodes {
+		addrs = append(addrs, nd.addr)
+	}
+	for i := range n {
+		if err := nodes[0].v.cluster.write(fmt.Sprintf("%s%d", prefix, i), []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, "replication", func() bool {
+		for i := range n {
+			k := fmt.Sprintf("%s%d", prefix, i)
+			for _, nd := range nodes {
+				if _, ok := nd.v.storage.fetch(k); ok != slices.Contains(placement(k, addrs, ReplicaCount), nd.addr) {
+					return false
+				}
+			}
+		}
+		return true
+	})
+}
+
+func TestRebalance(t *testing.T) {
+	nodes := startCluster(t, 3, 1)
+	writeKeys(t, nodes, "rk", 300)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	s, err := NewStorage(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	c := NewCluster(ln.Addr().String(), "", s, 50, 1)
+	go NewBinaryServer(&Vault{storage: s, cluster: c}, "", AuthNone, 0, time.Now()).Serve(ln)
+
+	var prev []string
+	for _, n := range nodes {
+		prev = append(prev, n.addr)
+	}
+	cur := append(slices.Clone(prev), c.self)
+	for _, n := range nodes {
+		n.v.cluster.rebalanceDrop = true
+		if pending := n.v.cluster.rebalancePass(prev, cur, nil); len(pending) != 0 {
+			t.Fatalf("%s: %d keys pending", n.addr, len(pending))
+		}
+	}
+	all := append(slices.Clone(nodes), &testNode{addr: c.self, v: &Vault{storage: s, cluster: c}})
+	for i := range 300 {
+		k := fmt.Sprintf("rk%d", i)
+		owners := placement(k, cur, ReplicaCount)
+		for _, n := range all {
+			if _, ok := n.v.storage.fetch(k); ok != slices.Contains(owners, n.addr) {
+				t.Fatalf("%s on %s: held %v, owners %v", k, n.addr, ok, owners)
+			}
+		}
+	}
+}
+
+func TestRebalanceRetry(t *testing.T) {
+	nodes := startCluster(t, 3, 1)
+	writeKeys(t, nodes, "rr", 200)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	var prev []string
+	for _, n := range nodes {
+		prev = append(prev, n.addr)
+	}
+	cur := append(slices.Clone(prev), addr)
+	c := nodes[0].v.cluster
+	pending := c.rebalancePass(prev, cur, nil)
+	if len(pending) == 0 || c.rbFailed.Load() == 0 {
+		t.Fatalf("new owner down: %d pending, %d failed", len(pending), c.rbFailed.Load())
+	}
+
+	if ln, err = net.Listen("tcp", addr); err != nil {
+		t.Skip(err)
+	}
+	defer ln.Close()
+	s, err := NewStorage(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	go NewBinaryServer(&Vault{storage: s, cluster: NewCluster(addr, "", s, 50, 1)}, "", AuthNone, 0, time.Now()).Serve(ln)
+
+	pending = c.rebalancePass(cur, cur, pending)
+	if len(pending) != 0 || c.rbFailed.Load() != 0 || c.rbMoved.Load() == 0 {
+		t.Fatalf("retry: %d pending, %d failed, %d moved", len(pending), c.rbFailed.Load(), c.rbMoved.Load())
+	}
+	for i := range 200 {
+		k := fmt.Sprintf("rr%d", i)
+		if _, ok := s.fetch(k); !ok && slices.Contains(placement(k, cur, ReplicaCount), addr) {
+			t.Fatalf("%s not handed off", k)
+		}
+	}
+	if again := c.rebalancePass(cur, cur, nil); c.rbTotal.Load() != 0 || len(again) != 0 {
+		t.Fatal("an unchanged membership visited keys")
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+)
+
+// on-disk and wal layout of a stored value:
+//
+//	[magic:u16][flags:u8][keylen:u16][key][fields][value]
+//
+// fields holds the parts announced in flags, in flag bit order:
+//
+//	recFlagVersion  [ts:u64][node:u32]
+//	recFlagExpiry   [expires:u64]  unix milliseconds
+//	recFlagType     [typelen:u8][content type]
+//
+// recFlagExternal marks a wal entry holding only the head of a streamed
+// record, recFlagTombstone a delete.
+//
+// files written before records existed hold the raw value only; see storedAt.
+const (
+	recMagic   = 0x564D
+	recHdrLen  = 5
+	recMaxSize = MaxValueSize + 128*1024
+)
+
+const (
+	recFlagVersion = 1 << iota
+	recFlagExpiry
+	recFlagExternal
+	recFlagType
+	recFlagTombstone
+)
+
+const maxTypeLen = 255
+
+type record struct {
+	key      string
+	ver      version
+	expires  int64
+	value    []byte
+	ctype    string
+	external bool
+	deleted  bool
+}
+
+func (r *record) flags() byte {
+	var f byte
+	if !r.ver.isZero() {
+		f |= recFlagVersion
+	}
+	if r.expires != 0 {
+		f |= recFlagExpiry
+	}
+	if r.external {
+		f |= recFlagExternal
+	}
+	if r.ctype != "" {
+		f |= recFlagType
+	}
+	if r.deleted {
+		f |= recFlagTombstone
+	}
+	return f
+}
+
+func fieldsLen(flags byte) int {
+	n := 0
+	if flags&recFlagVersion != 0 {
+		n += versionLen
+	}
+	if flags&recFlagExpiry != 0 {
+		n += 8
+	}
+	return n
+}
+
+func expired(expires int64, now time.Time) bool {
+	return expires != 0 && expires <= now.UnixMilli()
+}
+
+func (r *record) encode() []byte {
+	flags := r.flags()
+	size := recHdrLen + len(r.key) + fieldsLen(flags) + len(r.value)
+	if flags&recFlagType != 0 {
+		size += 1 + len(r.ctype)
+	}
+	buf := make([]byte, size)
+	binary.LittleEndian.PutUint16(buf[0:2], recMagic)
+	buf[2] = flags
+	binary.LittleEndian.PutUint16(buf[3:5], uint16(len(r.key)))
+	n := recHdrLen
+	n += copy(buf[n:], r.key)
+	if flags&recFlagVersion != 0 {
+		r.ver.put(buf[n:])
+		n += versionLen
+	}
+	if flags&recFlagExpiry != 0 {
+		binary.LittleEndian.PutUint64(buf[n:], uint64(r.expires))
+		n += 8
+	}
+	if flags&recFlagType != 0 {
+		buf[n] = byte(len(r.ctype))
+		n++
+		n += copy(buf[n:], r.ctype)
+	}
+	copy(buf[n:], r.value)
+	return buf
+}
+
+// headLen returns the size of everything before the value, or -1 if b does
+// not start a record. while b is too short to hold the content type length,
+// it counts only up to that byte.
+func headLen(b []byte) int {
+	if len(b) < recHdrLen || binary.LittleEndian.Uint16(b[0:2]) != recMagic {
+		return -1
+	}
+	n := recHdrLen + int(binary.LittleEndian.Uint16(b[3:5])) + fieldsLen(b[2])
+	if b[2]&recFlagType != 0 {
+		if len(b) <= n {
+			return n + 1
+		}
+		n += 1 + int(b[n])
+	}
+	return n
+}
+
+// readHead returns nil if r does not start with a record.
+func readHead(r io.Reader) ([]byte, error) {
+	head := make([]byte, recHdrLen)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, err
+	}
+	for {
+		n := headLen(head)
+		if n < 0 {
+			return nil, nil
+		}
+		if n <= len(head) {
+			return head[:n], nil
+		}
+		have := len(head)
+		head = append(head, make([]byte, n-have)...)
+		if _, err := io.ReadFull(r, head[have:]); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func decodeRecord(b []byte) record {
+	n := headLen(b)
+	if n < 0 || n > len(b) {
+		return record{value: b}
+	}
+
+	flags := b[2]
+	n = recHdrLen + int(binary.LittleEndian.Uint16(b[3:5]))
+	r := record{
+		key:      string(b[recHdrLen:n]),
+		external: flags&recFlagExternal != 0,
+		deleted:  flags&recFlagTombstone != 0,
+	}
+	if flags&recFlagVersion != 0 {
+		r.ver = readVersion(b[n:])
+		n += versionLen
+	}
+	if flags&recFlagExpiry != 0 {
+		r.expires = int64(binary.LittleEndian.Uint64(b[n:]))
+		n += 8
+	}
+	if flags&recFlagType != 0 {
+		tl := int(b[n])
+		r.ctype = string(b[n+1 : n+1+tl])
+		n += 1 + tl
+	}
+	r.value = b[n:]
+	return r
+}
+
+func isTombstone(b []byte) bool {
+	return headLen(b) >= 0 && b[2]&recFlagTombstone != 0
+}
+
+func (r *record) matches(key string) bool {
+	return r.key == "" || r.key == key
+}
+
+// storedAt tells a record stored under h from a legacy value that happens to
+// start with the magic.
+func (r *record) storedAt(h uint64) bool {
+	return r.key != "" && hash64str(r.key) == h
+}
+
+func encodeBatch(records [][]byte) []byte {
+	size := 0
+	for _, r := range records {
+		size += 4 + len(r)
+	}
+	buf := make([]byte, size)
+	n := 0
+	for _, r := range records {
+		binary.LittleEndian.PutUint32(buf[n:], uint32(len(r)))
+		n += 4
+		n += copy(buf[n:], r)
+	}
+	return buf
+}
+
+func decodeBatch(b []byte) ([][]byte, error) {
+	var records [][]byte
+	for len(b) > 0 {
+		if len(b) < 4 {
+			return nil, fmt.Errorf("truncated batch")
+		}
+		n := int(binary.LittleEndian.Uint32(b))
+		if 4+n > len(b) {
+			return nil, fmt.Errorf("truncated batch")
+		}
+		records = append(records, b[4:4+n])
+		b = b[4+n:]
+	}
+	return records, nil
+}
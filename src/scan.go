@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"slices"
+	"sync"
+)
+
+// encodeScan frames [cursorlen:u16][cursor][count:u32]([keylen:u16][key])*.
+func encodeScan(keys []string, next string) []byte {
+	buf := make([]byte, 2, 2+len(next))
+	binary.LittleEndian.PutUint16(buf, uint16(len(next)))
+	buf = append(buf, next...)
+	return append(buf, encodeKeys(keys)...)
+}
+
+func decodeScan(b []byte) ([]string, string, error) {
+	if len(b) < 2 {
+		return nil, "", fmt.Errorf("short scan")
+	}
+	n := 2 + int(binary.LittleEndian.Uint16(b))
+	if len(b) < n {
+		return nil, "", fmt.Errorf("short scan")
+	}
+	keys, err := decodeKeys(b[n:])
+	return keys, string(b[2:n]), err
+}
+
+// scan merges a page from every live member: a key among the first limit of
+// the cluster is among the first limit of every node holding it.
+func (c *Cluster) scan(prefix, cursor string, limit int) ([]string, string, error) {
+	if len(prefix) > MaxKeySize || len(cursor) > MaxKeySize {
+		return nil, "", errKeyTooLong
+	}
+	limit = min(max(limit, 0), scanMaxLimit)
+	if limit == 0 {
+		limit = scanDefLimit
+	}
+	nodes := c.getNodes()
+	if len(nodes) <= 1 {
+		keys, next := c.storage.Scan(prefix, cursor, limit)
+		return keys, next, nil
+	}
+
+	type page struct {
+		keys []string
+		more bool
+		err  error
+	}
+	pages := make([]page, len(nodes))
+	var wg sync.WaitGroup
+	for i, n := range nodes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var keys []string
+			var next string
+			var err error
+			if n == c.self {
+				keys, next = c.storage.Scan(prefix, cursor, limit)
+			} else {
+				keys, next, err = c.client.ScanLocal(n, c.authKey, prefix, cursor, limit)
+			}
+			pages[i] = page{keys: keys, more: next != "", err: err}
+		}()
+	}
+	wg.Wait()
+
+	var keys []string
+	more, failed := false, 0
+	for _, p := range pages {
+		if p.err != nil {
+			failed++
+			continue
+		}
+		keys = append(keys, p.keys...)
+		more = more || p.more
+	}
+	if failed >= min(ReplicaCount, len(nodes)) {
+		return nil, "", fmt.Errorf("scan failed: %d of %d nodes unreachable", failed, len(nodes))
+	}
+
+	slices.Sort(keys)
+	keys = slices.Compact(keys)
+	if len(keys) > limit {
+		keys, more = keys[:limit], true
+	}
+	if !more || len(keys) == 0 {
+		return keys, "", nil
+	}
+	return keys, keys[len(keys)-1], nil
+}
+
+func (c *BinaryClient) ScanLocal(addr, authKey, prefix, cursor string, limit int) ([]string, string, error) {
+	req := keyRequest(OpScanLocal, prefix, 2+len(cursor)+4)
+	n := 3 + len(prefix)
+	binary.LittleEndian.PutUint16(req[n:], uint16(len(cursor)))
+	n += 2
+	n += copy(req[n:], cursor)
+	binary.LittleEndian.PutUint32(req[n:], uint32(limit))
+
+	status, payload, err := c.call(addr, authKey, req)
+	if err != nil {
+		return nil, "", err
+	}
+	if status != 0x00 {
+		return nil, "", fmt.Errorf("scan failed")
+	}
+	return decodeScan(payload)
+}
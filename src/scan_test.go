@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+)
+
+func TestClusterScan(t *testing.T) {
+	nodes := startCluster(t, 5, 1)
+	var want []string
+	for i := range 300 {
+		k := fmt.Sprintf("s%03d", i)
+		want = append(want, k)
+		if err := nodes[i%5].v.cluster.write(k, []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := nodes[0].v.cluster.write("other", []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	if keys, _ := nodes[0].v.storage.Scan("s", "", 1000); len(keys) == len(want) {
+		t.Fatal("one node holds every key")
+	}
+
+	for _, limit := range []int{17, 100, 300, 1000} {
+		t.Run(fmt.Sprint(limit), func(t *testing.T) {
+			var got []string
+			cursor := ""
+			for {
+				keys, next, err := nodes[2].v.cluster.scan("s", cursor, limit)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(keys) > limit {
+					t.Fatalf("page of %d keys", len(keys))
+				}
+				got = append(got, keys...)
+				if next == "" {
+					break
+				}
+				cursor = next
+			}
+			if !slices.Equal(got, want) {
+				t.Fatalf("scanned %d keys, want %d", len(got), len(want))
+			}
+		})
+	}
+
+	t.Run("Local", func(t *testing.T) {
+		keys, next, err := NewBinaryClient().ScanLocal(nodes[1].addr, "", "s", "", 1000)
+		local, _ := nodes[1].v.storage.Scan("s", "", 1000)
+		if err != nil || next != "" || !slices.Equal(keys, local) {
+			t.Fatalf("%d keys, %q, %v; node holds %d", len(keys), next, err, len(local))
+		}
+	})
+
+}
@@ -0,0 +1,733 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// the segment backend appends records to segment files in the wal's entry
+// format, with an in-memory keydir pointing at the newest copy of each key.
+const (
+	segMaxBytes        = 64 * 1024 * 1024
+	segCompactInterval = 30 * time.Second
+	segCompactRatio    = 0.5
+)
+
+// keydir snapshot: [seq:u64][segments:u32]([id:u32][size:u64][live:u64])*
+// [keys:u64]([hash:u64][seg:u32][off:u64][size:u32])*
+const (
+	segSnapFile    = "keydir.snap"
+	segSnapMagic   = 0x4D56534B
+	segSnapVersion = 1
+)
+
+type segLoc struct {
+	seg  uint32
+	off  int64
+	size uint32
+}
+
+type segment struct {
+	id   uint32
+	f    *os.File
+	size int64
+	live int64
+}
+
+type segmentBackend struct {
+	dir  string
+	mode durability
+
+	wmu    sync.Mutex
+	mu     sync.RWMutex
+	keydir map[uint64]segLoc
+	segs   map[uint32]*segment
+	active *segment
+	dirty  atomic.Bool
+
+	// synced is the last seq an fsync covered.
+	seq     uint64
+	smu     sync.Mutex
+	scond   *sync.Cond
+	syncing bool
+	synced  uint64
+
+	report   replayReport
+	keysFrom string
+
+	compactions atomic.Int64
+	reclaimed   atomic.Int64
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+type segOp struct {
+	hash uint64
+	off  int64
+	data []byte
+}
+
+func segName(id uint32) string {
+	return fmt.Sprintf("%08d.seg", id)
+}
+
+func newSegmentBackend(dir string, mode durability) (*segmentBackend, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	e := &segmentBackend{
+		dir:    dir,
+		mode:   mode,
+		keydir: make(map[uint64]segLoc),
+		segs:   make(map[uint32]*segment),
+		done:   make(chan struct{}),
+	}
+	e.scond = sync.NewCond(&e.smu)
+	if err := e.load(); err != nil {
+		e.Close()
+		return nil, err
+	}
+
+	e.wg.Add(2)
+	go e.syncer()
+	go e.compactor()
+	return e, nil
+}
+
+func (e *segmentBackend) load() error {
+	names, err := os.ReadDir(e.dir)
+	if err != nil {
+		return err
+	}
+	var ids []uint32
+	for _, n := range names {
+		if filepath.Ext(n.Name()) == ".tmp" {
+			os.Remove(filepath.Join(e.dir, n.Name()))
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(n.Name(), ".seg"), 10, 32)
+		if err != nil || !strings.HasSuffix(n.Name(), ".seg") {
+			continue
+		}
+		ids = append(ids, uint32(id))
+	}
+	slices.Sort(ids)
+
+	err = e.loadKeydir(ids)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("segment keydir: %v, scanning segments", err)
+		}
+		if err := e.scan(ids); err != nil {
+			return err
+		}
+	}
+	e.synced = e.seq
+
+	if len(ids) > 0 && e.segs[ids[len(ids)-1]].size < segMaxBytes {
+		e.active = e.segs[ids[len(ids)-1]]
+		return nil
+	}
+	next := uint32(1)
+	if len(ids) > 0 {
+		next = ids[len(ids)-1] + 1
+	}
+	return e.roll(next)
+}
+
+func (e *segmentBackend) scan(ids []uint32) error {
+	e.keysFrom = "scan"
+	for i, id := range ids {
+		f, err := os.OpenFile(filepath.Join(e.dir, segName(id)), os.O_RDWR, 0644)
+		if err != nil {
+			return err
+		}
+		seg := &segment{id: id, f: f}
+		e.segs[id] = seg
+
+		info, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		end, rep, err := scanLog(f, info.Size(), func(off int64, rec walRecord) error {
+			for _, op := range segOps(off, rec) {
+				e.place(op.hash, segLoc{seg: id, off: op.off, size: uint32(len(op.data))}, op.data == nil)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		seg.size = end
+		e.report.add(rep)
+
+		if rep.lostBytes > 0 {
+			log.Printf("segment %s: %s", segName(id), rep)
+			if i == len(ids)-1 {
+				if err := f.Truncate(end); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	e.seq = e.report.lastSeq
+	return nil
+}
+
+// loadKeydir only trusts the snapshot if ids are exactly the segments it
+// describes, at the same sizes.
+func (e *segmentBackend) loadKeydir(ids []uint32) error {
+	var (
+		seq    uint64
+		segs   []*segment
+		keydir map[uint64]segLoc
+	)
+	err := readSnapshot(filepath.Join(e.dir, segSnapFile), segSnapMagic, segSnapVersion, func(r *bufio.Reader) error {
+		var buf [24]byte
+		if _, err := io.ReadFull(r, buf[:12]); err != nil {
+			return err
+		}
+		seq = binary.LittleEndian.Uint64(buf[:])
+		n := binary.LittleEndian.Uint32(buf[8:])
+		for range n {
+			if _, err := io.ReadFull(r, buf[:20]); err != nil {
+				return err
+			}
+			segs = append(segs, &segment{
+				id:   binary.LittleEndian.Uint32(buf[:]),
+				size: int64(binary.LittleEndian.Uint64(buf[4:])),
+				live: int64(binary.LittleEndian.Uint64(buf[12:])),
+			})
+		}
+
+		if _, err := io.ReadFull(r, buf[:8]); err != nil {
+			return err
+		}
+		keys := binary.LittleEndian.Uint64(buf[:])
+		keydir = make(map[uint64]segLoc, min(keys, 1<<24))
+		for range keys {
+			if _, err := io.ReadFull(r, buf[:]); err != nil {
+				return err
+			}
+			keydir[binary.LittleEndian.Uint64(buf[:])] = segLoc{
+				seg:  binary.LittleEndian.Uint32(buf[8:]),
+				off:  int64(binary.LittleEndian.Uint64(buf[12:])),
+				size: binary.LittleEndian.Uint32(buf[20:]),
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(segs) != len(ids) {
+		return errBadSnapshot
+	}
+	for i, seg := range segs {
+		if seg.id != ids[i] {
+			return errBadSnapshot
+		}
+	}
+	for i, seg := range segs {
+		f, err := os.OpenFile(filepath.Join(e.dir, segName(seg.id)), os.O_RDWR, 0644)
+		if err == nil {
+			var info os.FileInfo
+			if info, err = f.Stat(); err == nil && info.Size() != seg.size {
+				err = errBadSnapshot
+			}
+			if err != nil {
+				f.Close()
+			}
+		}
+		if err != nil {
+			for _, s := range segs[:i] {
+				s.f.Close()
+			}
+			return err
+		}
+		seg.f = f
+	}
+
+	for _, seg := range segs {
+		e.segs[seg.id] = seg
+	}
+	e.keydir = keydir
+	e.seq = seq
+	e.keysFrom = "snapshot"
+	return nil
+}
+
+func (e *segmentBackend) saveKeydir() error {
+	ids := slices.Sorted(maps.Keys(e.segs))
+	return writeSnapshot(filepath.Join(e.dir, segSnapFile), segSnapMagic, segSnapVersion, func(w *bufio.Writer) error {
+		var buf [24]byte
+		binary.LittleEndian.PutUint64(buf[:], e.seq)
+		binary.LittleEndian.PutUint32(buf[8:], uint32(len(ids)))
+		w.Write(buf[:12])
+		for _, id := range ids {
+			seg := e.segs[id]
+			binary.LittleEndian.PutUint32(buf[:], id)
+			binary.LittleEndian.PutUint64(buf[4:], uint64(seg.size))
+			binary.LittleEndian.PutUint64(buf[12:], uint64(seg.live))
+			w.Write(buf[:20])
+		}
+
+		binary.LittleEndian.PutUint64(buf[:], uint64(len(e.keydir)))
+		w.Write(buf[:8])
+		for h, loc := range e.keydir {
+			binary.LittleEndian.PutUint64(buf[:], h)
+			binary.LittleEndian.PutUint32(buf[8:], loc.seg)
+			binary.LittleEndian.PutUint64(buf[12:], uint64(loc.off))
+			binary.LittleEndian.PutUint32(buf[20:], loc.size)
+			if _, err := w.Write(buf[:]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (e *segmentBackend) place(h uint64, loc segLoc, tombstone bool) {
+	if old, ok := e.keydir[h]; ok {
+		if seg := e.segs[old.seg]; seg != nil {
+			seg.live -= int64(old.size)
+		}
+	}
+	if tombstone {
+		delete(e.keydir, h)
+		return
+	}
+	e.keydir[h] = loc
+	e.segs[loc.seg].live += int64(loc.size)
+}
+
+func (e *segmentBackend) roll(id uint32) error {
+	f, err := os.OpenFile(filepath.Join(e.dir, segName(id)), os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if e.active != nil {
+		e.active.f.Sync()
+	}
+	seg := &segment{id: id, f: f}
+	e.mu.Lock()
+	e.segs[id] = seg
+	e.mu.Unlock()
+	e.active = seg
+	return nil
+}
+
+func (e *segmentBackend) appendEntry(typ recType, hash uint64, data []byte) ([]segOp, uint32, error) {
+	if e.active.size > 0 && e.active.size+walHdrLen+int64(len(data)) > segMaxBytes {
+		if err := e.roll(e.active.id + 1); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	seg := e.active
+	buf := encodeEntry(typ, e.seq+1, hash, data)
+	off := seg.size
+	if _, err := seg.f.WriteAt(buf, off); err != nil {
+		return nil, 0, err
+	}
+	seg.size += int64(len(buf))
+	e.seq++
+	e.dirty.Store(true)
+	rec := walRecord{typ: typ, seq: e.seq, hash: hash, data: buf[walHdrLen:], hdrLen: walHdrLen}
+	return segOps(off, rec), seg.id, nil
+}
+
+func (e *segmentBackend) Batch(entries []walEntry) error {
+	typ, hash, data := entries[0].typ(), entries[0].hash, entries[0].data
+	if len(entries) > 1 {
+		typ, hash, data = recBatch, uint64(len(entries)), encodeTxEntry(entries)
+	}
+
+	e.wmu.Lock()
+	ops, id, err := e.appendEntry(typ, hash, data)
+	if err != nil {
+		e.wmu.Unlock()
+		return err
+	}
+	e.mu.Lock()
+	for _, op := range ops {
+		e.place(op.hash, segLoc{seg: id, off: op.off, size: uint32(len(op.data))}, op.data == nil)
+	}
+	e.mu.Unlock()
+	return e.settle()
+}
+
+// settle releases wmu.
+func (e *segmentBackend) settle() error {
+	switch e.mode {
+	case durSync:
+		defer e.wmu.Unlock()
+		return e.active.f.Sync()
+	case durGroup:
+		seq := e.seq
+		e.wmu.Unlock()
+		return e.waitSynced(seq)
+	}
+	e.wmu.Unlock()
+	return nil
+}
+
+// waitSynced lets the first writer to arrive fsync for everyone appended by
+// then.
+func (e *segmentBackend) waitSynced(seq uint64) error {
+	e.smu.Lock()
+	defer e.smu.Unlock()
+
+	for e.synced < seq {
+		if e.syncing {
+			e.scond.Wait()
+			continue
+		}
+		e.syncing = true
+		e.smu.Unlock()
+
+		e.wmu.Lock()
+		upto, f := e.seq, e.active.f
+		e.wmu.Unlock()
+		err := f.Sync()
+
+		e.smu.Lock()
+		e.syncing = false
+		if err == nil && upto > e.synced {
+			e.synced = upto
+		}
+		e.scond.Broadcast()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *segmentBackend) Set(h uint64, data []byte) error {
+	return e.Batch([]walEntry{{hash: h, data: data}})
+}
+
+func (e *segmentBackend) Delete(h uint64) error {
+	return e.Batch([]walEntry{{hash: h}})
+}
+
+func (e *segmentBackend) Get(h uint64) ([]byte, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	loc, ok := e.keydir[h]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	buf := make([]byte, loc.size)
+	if _, err := e.segs[loc.seg].f.ReadAt(buf, loc.off); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+type sectionFile struct {
+	*io.SectionReader
+	io.Closer
+}
+
+func (e *segmentBackend) Open(h uint64) (io.ReadCloser, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	loc, ok := e.keydir[h]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	// compaction may remove the segment while it is read.
+	f, err := os.Open(filepath.Join(e.dir, segName(loc.seg)))
+	if err != nil {
+		return nil, err
+	}
+	return sectionFile{io.NewSectionReader(f, loc.off, int64(loc.size)), f}, nil
+}
+
+func (e *segmentBackend) Create(h uint64) (*os.File, error) {
+	return os.CreateTemp(e.dir, fmtHex(h)+"-*.tmp")
+}
+
+func (e *segmentBackend) Commit(h uint64, tmp string, head record) error {
+	defer os.Remove(tmp)
+
+	f, err := os.Open(tmp)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	size := info.Size()
+	sum := crc32.NewIEEE()
+	if _, err := io.Copy(sum, f); err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	e.wmu.Lock()
+	hdr := frameEntry(recPut, e.seq+1, h, int(size))
+	sum.Write(hdr[:24])
+	binary.LittleEndian.PutUint32(hdr[24:28], sum.Sum32())
+
+	if e.active.size > 0 && e.active.size+walHdrLen+size > segMaxBytes {
+		if err := e.roll(e.active.id + 1); err != nil {
+			e.wmu.Unlock()
+			return err
+		}
+	}
+	seg := e.active
+	off := seg.size
+	if _, err := io.Copy(io.NewOffsetWriter(seg.f, off+walHdrLen), f); err != nil {
+		e.wmu.Unlock()
+		return err
+	}
+	if _, err := seg.f.WriteAt(hdr[:], off); err != nil {
+		e.wmu.Unlock()
+		return err
+	}
+	seg.size += walHdrLen + size
+	e.seq++
+	e.dirty.Store(true)
+
+	e.mu.Lock()
+	e.place(h, segLoc{seg: seg.id, off: off + walHdrLen, size: uint32(size)}, false)
+	e.mu.Unlock()
+	return e.settle()
+}
+
+func (e *segmentBackend) Scan(fn func(h uint64)) error {
+	e.mu.RLock()
+	hashes := make([]uint64, 0, len(e.keydir))
+	for h := range e.keydir {
+		hashes = append(hashes, h)
+	}
+	e.mu.RUnlock()
+
+	for _, h := range hashes {
+		fn(h)
+	}
+	return nil
+}
+
+func (e *segmentBackend) Stats() map[string]interface{} {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	var size, live int64
+	for _, seg := range e.segs {
+		size += seg.size
+		live += seg.live
+	}
+	return map[string]interface{}{
+		"engine":       "segments",
+		"durability":   e.mode.String(),
+		"replay":       e.report.stats(),
+		"segments":     len(e.segs),
+		"keys":         len(e.keydir),
+		"index":        e.keysFrom,
+		"size_mb":      size / (1024 * 1024),
+		"live_mb":      live / (1024 * 1024),
+		"compactions":  e.compactions.Load(),
+		"reclaimed_mb": e.reclaimed.Load() / (1024 * 1024),
+	}
+}
+
+func (e *segmentBackend) syncer() {
+	defer e.wg.Done()
+	ticker := time.NewTicker(walFlushMs * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if e.dirty.Swap(false) {
+				e.wmu.Lock()
+				e.active.f.Sync()
+				e.wmu.Unlock()
+			}
+		case <-e.done:
+			return
+		}
+	}
+}
+
+func (e *segmentBackend) compactor() {
+	defer e.wg.Done()
+	ticker := time.NewTicker(segCompactInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			e.compact()
+		case <-e.done:
+			return
+		}
+	}
+}
+
+func (e *segmentBackend) compact() {
+	e.wmu.Lock()
+	active := e.active.id
+	e.wmu.Unlock()
+
+	e.mu.RLock()
+	var victims []*segment
+	for _, seg := range e.segs {
+		if seg.id < active && seg.size > 0 && float64(seg.live) < segCompactRatio*float64(seg.size) {
+			victims = append(victims, seg)
+		}
+	}
+	e.mu.RUnlock()
+	slices.SortFunc(victims, func(a, b *segment) int { return int(a.id) - int(b.id) })
+
+	for _, seg := range victims {
+		select {
+		case <-e.done:
+			return
+		default:
+		}
+		if err := e.compactSegment(seg); err != nil {
+			log.Printf("compact %s: %v", segName(seg.id), err)
+			return
+		}
+	}
+}
+
+// compactSegment carries tombstones along while older segments could still
+// hold the value they delete.
+func (e *segmentBackend) compactSegment(seg *segment) error {
+	f, err := os.Open(filepath.Join(e.dir, segName(seg.id)))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	e.mu.RLock()
+	live := seg.live
+	e.mu.RUnlock()
+
+	_, _, err = scanLog(io.NewSectionReader(f, 0, seg.size), seg.size, func(off int64, rec walRecord) error {
+		for _, op := range segOps(off, rec) {
+			if err := e.carry(seg, op); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	e.wmu.Lock()
+	err = e.active.f.Sync()
+	e.wmu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	delete(e.segs, seg.id)
+	e.mu.Unlock()
+	seg.f.Close()
+	e.compactions.Add(1)
+	e.reclaimed.Add(seg.size - live)
+	return os.Remove(filepath.Join(e.dir, segName(seg.id)))
+}
+
+func (e *segmentBackend) carry(seg *segment, op segOp) error {
+	e.wmu.Lock()
+	defer e.wmu.Unlock()
+
+	e.mu.RLock()
+	loc, ok := e.keydir[op.hash]
+	older := false
+	for id := range e.segs {
+		older = older || id < seg.id
+	}
+	e.mu.RUnlock()
+
+	if op.data == nil {
+		if ok || !older {
+			return nil
+		}
+	} else if !ok || loc.seg != seg.id || loc.off != op.off {
+		return nil
+	}
+
+	typ := recPut
+	if op.data == nil {
+		typ = recDelete
+	}
+	ops, id, err := e.appendEntry(typ, op.hash, op.data)
+	if err != nil {
+		return err
+	}
+	e.mu.Lock()
+	for _, o := range ops {
+		e.place(o.hash, segLoc{seg: id, off: o.off, size: uint32(len(o.data))}, o.data == nil)
+	}
+	e.mu.Unlock()
+	return nil
+}
+
+func (e *segmentBackend) Close() error {
+	select {
+	case <-e.done:
+		return nil
+	default:
+	}
+	close(e.done)
+	e.wg.Wait()
+
+	e.wmu.Lock()
+	defer e.wmu.Unlock()
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var err error
+	for _, seg := range e.segs {
+		if seg == e.active {
+			err = seg.f.Sync()
+		}
+		seg.f.Close()
+	}
+	if err != nil || e.active == nil {
+		return err
+	}
+	return e.saveKeydir()
+}
+
+func segOps(off int64, rec walRecord) []segOp {
+	wops, _ := rec.ops()
+	ops := make([]segOp, 0, len(wops))
+	base := off + int64(rec.hdrLen)
+	for _, op := range wops {
+		ops = append(ops, segOp{hash: op.hash, off: base + int64(op.off), data: op.data})
+	}
+	return ops
+}
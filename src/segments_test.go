@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// copyDir copies the files under src to dst, which is what a crash leaves
+// of a store that is still open.
+func copyDir(t *testing.T, src, dst string) {
+	t.Helper()
+	err := filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(src, path)
+		if info.IsDir() {
+			return os.MkdirAll(filepath.Join(dst, rel), 0755)
+		}
+		in, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		out, err := os.Create(filepath.Join(dst, rel))
+		if err != nil {
+			return err
+		}
+		defer out.Close()
+		_, err = io.Copy(out, in)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSegmentsCrashAndReopen(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewStorageEngine(dir, "segments", durGroup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range 200 {
+		if err := s.Set(fmt.Sprintf("k%03d", i), []byte(fmt.Sprintf("v%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := range 20 {
+		if err := s.Delete(fmt.Sprintf("k%03d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	check := func(t *testing.T, s *Storage) {
+		t.Helper()
+		for i := range 200 {
+			v, err := s.Get(fmt.Sprintf("k%03d", i))
+			if i < 20 {
+				if err == nil {
+					t.Fatalf("k%03d: deleted key is back", i)
+				}
+			} else if err != nil || string(v) != fmt.Sprintf("v%d", i) {
+				t.Fatalf("k%03d: %q %v", i, v, err)
+			}
+		}
+	}
+
+	crashed := t.TempDir()
+	copyDir(t, dir, crashed)
+	s.Close()
+
+	t.Run("Crash", func(t *testing.T) {
+		segs, _ := filepath.Glob(filepath.Join(crashed, "segments", "*.seg"))
+		if len(segs) == 0 {
+			t.Fatal("no segments")
+		}
+		last := segs[len(segs)-1]
+		info, _ := os.Stat(last)
+		f, err := os.OpenFile(last, os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write([]byte{0x57, 0x56, walVersion, 1, 2, 3})
+		f.Close()
+
+		s, err := NewStorageEngine(crashed, "segments", durGroup)
+		if err != nil {
+			t.Fatal(err)
+		}
+		e := s.backend.(*segmentBackend)
+		if e.keysFrom != "scan" || s.indexFrom != "scan" {
+			t.Fatalf("keydir from %s, index from %s", e.keysFrom, s.indexFrom)
+		}
+		if e.report.discarded != 1 || e.report.lostBytes != 6 {
+			t.Fatalf("replay report %+v", e.report)
+		}
+		if after, _ := os.Stat(last); after.Size() != info.Size() {
+			t.Fatalf("torn tail kept: %d bytes, want %d", after.Size(), info.Size())
+		}
+		check(t, s)
+		if err := s.Set("after", []byte("1")); err != nil {
+			t.Fatal(err)
+		}
+		s.Close()
+
+		s, err = NewStorageEngine(crashed, "segments", durGroup)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		check(t, s)
+		if v, err := s.Get("after"); err != nil || string(v) != "1" {
+			t.Fatalf("after: %q %v", v, err)
+		}
+	})
+
+	t.Run("Clean", func(t *testing.T) {
+		s, err := NewStorageEngine(dir, "segments", durGroup)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		e := s.backend.(*segmentBackend)
+		if e.keysFrom != "snapshot" || s.indexFrom != "snapshot" {
+			t.Fatalf("keydir from %s, index from %s", e.keysFrom, s.indexFrom)
+		}
+		if e.report.discarded != 0 {
+			t.Fatalf("replay report %+v", e.report)
+		}
+		check(t, s)
+	})
+}
@@ -0,0 +1,75 @@
+package main
+
+import "sync/atomic"
+
+// sketch is a count-min sketch with 4-bit counters, halved every ten times
+// as many lookups as it has counters per row.
+type sketch struct {
+	rows    [4][]uint64
+	mask    uint64
+	samples atomic.Int64
+	resetAt int64
+	aging   atomic.Bool
+}
+
+func newSketch(n int) *sketch {
+	width := 64
+	for width < n {
+		width <<= 1
+	}
+	s := &sketch{mask: uint64(width - 1), resetAt: int64(width) * 10}
+	for i := range s.rows {
+		s.rows[i] = make([]uint64, width/16)
+	}
+	return s
+}
+
+func (s *sketch) slot(h uint64, i int) (*uint64, uint64) {
+	h = (h ^ uint64(i)*0x9E3779B97F4A7C15) * 0xBF58476D1CE4E5B9
+	h ^= h >> 31
+	pos := h & s.mask
+	return &s.rows[i][pos/16], (pos % 16) * 4
+}
+
+func (s *sketch) add(h uint64) {
+	for i := range s.rows {
+		w, shift := s.slot(h, i)
+		for {
+			old := atomic.LoadUint64(w)
+			if (old>>shift)&0xF == 0xF {
+				break
+			}
+			if atomic.CompareAndSwapUint64(w, old, old+1<<shift) {
+				break
+			}
+		}
+	}
+	if s.samples.Add(1) >= s.resetAt && s.aging.CompareAndSwap(false, true) {
+		s.age()
+		s.aging.Store(false)
+	}
+}
+
+func (s *sketch) estimate(h uint64) uint64 {
+	est := uint64(0xF)
+	for i := range s.rows {
+		w, shift := s.slot(h, i)
+		est = min(est, (atomic.LoadUint64(w)>>shift)&0xF)
+	}
+	return est
+}
+
+func (s *sketch) age() {
+	for i := range s.rows {
+		for j := range s.rows[i] {
+			w := &s.rows[i][j]
+			for {
+				old := atomic.LoadUint64(w)
+				if atomic.CompareAndSwapUint64(w, old, (old>>1)&0x7777777777777777) {
+					break
+				}
+			}
+		}
+	}
+	s.samples.Store(0)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// snapshots are written on a clean shutdown as [magic:u32][version:u8][body]
+// [crc:u32] and removed once loaded, so a crash leaves none behind.
+const snapshotBuf = 256 * 1024
+
+var (
+	errBadSnapshot   = errors.New("damaged snapshot")
+	errSnapshotOther = errors.New("snapshot of another engine")
+)
+
+func writeSnapshot(path string, magic uint32, version byte, body func(w *bufio.Writer) error) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+"-*.tmp")
+	if err != nil {
+		return err
+	}
+
+	crc := crc32.NewIEEE()
+	w := bufio.NewWriterSize(io.MultiWriter(f, crc), snapshotBuf)
+	var hdr [5]byte
+	binary.LittleEndian.PutUint32(hdr[:], magic)
+	hdr[4] = version
+	w.Write(hdr[:])
+	err = body(w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = binary.Write(f, binary.LittleEndian, crc.Sum32())
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// readSnapshot's body must read all of it; what it built is only to be
+// trusted if readSnapshot returns nil.
+func readSnapshot(path string, magic uint32, version byte, body func(r *bufio.Reader) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		f.Close()
+		os.Remove(path)
+		syncDir(filepath.Dir(path))
+	}()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() < 9 {
+		return errBadSnapshot
+	}
+	crc := crc32.NewIEEE()
+	r := bufio.NewReaderSize(io.TeeReader(io.LimitReader(f, info.Size()-4), crc), snapshotBuf)
+
+	var hdr [5]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return errBadSnapshot
+	}
+	if binary.LittleEndian.Uint32(hdr[:]) != magic || hdr[4] != version {
+		return errBadSnapshot
+	}
+	if err := body(r); err == errSnapshotOther {
+		return err
+	} else if err != nil {
+		return errBadSnapshot
+	}
+	if _, err := r.Peek(1); err != io.EOF {
+		return errBadSnapshot
+	}
+
+	var sum uint32
+	if err := binary.Read(f, binary.LittleEndian, &sum); err != nil || sum != crc.Sum32() {
+		return errBadSnapshot
+	}
+	return nil
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// both snapshots start with [namelen:u8][name], the engine they were written
+// over. the index goes on with [count:u64]
+// ([keylen:u16][key][hash:u64][version][expires:u64][deleted:u8])*, the
+// warm-up file with [count:u64][hash:u64]*, hottest first.
+const (
+	indexSnapFile    = "index.snap"
+	indexSnapMagic   = 0x4D56494E
+	indexSnapVersion = 2
+	warmFile         = "warm.snap"
+	warmMagic        = 0x4D565757
+	warmVersion      = 2
+)
+
+func (s *Storage) writeEngine(w *bufio.Writer) {
+	w.WriteByte(byte(len(s.engine)))
+	w.WriteString(s.engine)
+}
+
+func (s *Storage) readEngine(r *bufio.Reader) error {
+	n, err := r.ReadByte()
+	if err != nil {
+		return err
+	}
+	name := make([]byte, n)
+	if _, err := io.ReadFull(r, name); err != nil {
+		return err
+	}
+	if string(name) != s.engine {
+		return errSnapshotOther
+	}
+	return nil
+}
+
+// loadIndex indexes nothing unless the whole snapshot checks out.
+func (s *Storage) loadIndex(path string) error {
+	var (
+		keys  []string
+		metas []keyMeta
+	)
+	err := readSnapshot(path, indexSnapMagic, indexSnapVersion, func(r *bufio.Reader) error {
+		if err := s.readEngine(r); err != nil {
+			return err
+		}
+		var buf [8 + versionLen + 9]byte
+		if _, err := io.ReadFull(r, buf[:8]); err != nil {
+			return err
+		}
+		n := binary.LittleEndian.Uint64(buf[:])
+		for range n {
+			if _, err := io.ReadFull(r, buf[:2]); err != nil {
+				return err
+			}
+			key := make([]byte, binary.LittleEndian.Uint16(buf[:]))
+			if _, err := io.ReadFull(r, key); err != nil {
+				return err
+			}
+			if _, err := io.ReadFull(r, buf[:]); err != nil {
+				return err
+			}
+			keys = append(keys, string(key))
+			metas = append(metas, keyMeta{
+				h:       binary.LittleEndian.Uint64(buf[:]),
+				ver:     readVersion(buf[8:]),
+				expires: int64(binary.LittleEndian.Uint64(buf[8+versionLen:])),
+				deleted: buf[16+versionLen] != 0,
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for i, key := range keys {
+		m := metas[i]
+		s.indexRecord(m.h, record{key: key, ver: m.ver, expires: m.expires, deleted: m.deleted})
+	}
+	return nil
+}
+
+func (s *Storage) saveIndex(path string) error {
+	keys, metas := s.index.snapshot()
+	return writeSnapshot(path, indexSnapMagic, indexSnapVersion, func(w *bufio.Writer) error {
+		s.writeEngine(w)
+		var buf [8 + versionLen + 9]byte
+		binary.LittleEndian.PutUint64(buf[:], uint64(len(keys)))
+		w.Write(buf[:8])
+		for i, key := range keys {
+			m := metas[i]
+			if len(key) > MaxKeySize {
+				return errKeyTooLong
+			}
+			binary.LittleEndian.PutUint16(buf[:], uint16(len(key)))
+			w.Write(buf[:2])
+			w.WriteString(key)
+			binary.LittleEndian.PutUint64(buf[:], m.h)
+			m.ver.put(buf[8:])
+			binary.LittleEndian.PutUint64(buf[8+versionLen:], uint64(m.expires))
+			buf[16+versionLen] = 0
+			if m.deleted {
+				buf[16+versionLen] = 1
+			}
+			if _, err := w.Write(buf[:]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *Storage) saveWarm(path string) error {
+	hashes := s.cache.hottest(s.maxSize)
+	return writeSnapshot(path, warmMagic, warmVersion, func(w *bufio.Writer) error {
+		s.writeEngine(w)
+		var buf [8]byte
+		binary.LittleEndian.PutUint64(buf[:], uint64(len(hashes)))
+		w.Write(buf[:])
+		for _, h := range hashes {
+			binary.LittleEndian.PutUint64(buf[:], h)
+			if _, err := w.Write(buf[:]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// warmUp runs alongside requests and skips records they cached meanwhile.
+func (s *Storage) warmUp() {
+	if s.dir == "" {
+		return
+	}
+	start := time.Now()
+	var hashes []uint64
+	err := readSnapshot(filepath.Join(s.dir, warmFile), warmMagic, warmVersion, func(r *bufio.Reader) error {
+		if err := s.readEngine(r); err != nil {
+			return err
+		}
+		var buf [8]byte
+		if _, err := io.ReadFull(r, buf[:]); err != nil {
+			return err
+		}
+		n := binary.LittleEndian.Uint64(buf[:])
+		for range n {
+			if _, err := io.ReadFull(r, buf[:]); err != nil {
+				return err
+			}
+			hashes = append(hashes, binary.LittleEndian.Uint64(buf[:]))
+		}
+		return nil
+	})
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("cache warm-up: %v", err)
+		}
+		return
+	}
+
+	warmed := 0
+	for _, h := range hashes {
+		select {
+		case <-s.done:
+			return
+		default:
+		}
+		if s.size.Load() >= s.maxSize {
+			break
+		}
+
+		mu := s.lock(h)
+		mu.Lock()
+		if !s.cache.has(h) {
+			data, err := s.backend.Get(h)
+			if rec := decodeRecord(data); err == nil && rec.storedAt(h) {
+				s.cache.set(h, data)
+				s.size.Store(s.cache.size.Load())
+				warmed++
+			}
+		}
+		mu.Unlock()
+	}
+	s.warmed.Store(int64(warmed))
+	log.Printf("cache warm-up: loaded %d of %d records in %v", warmed, len(hashes), time.Since(start).Round(time.Millisecond))
+}
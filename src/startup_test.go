@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStartupSnapshots(t *testing.T) {
+	for _, engine := range []string{"files", "segments"} {
+		t.Run(engine, func(t *testing.T) {
+			dir := t.TempDir()
+			s, err := NewStorageEngine(dir, engine, durGroup)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := range 300 {
+				if err := s.Set(fmt.Sprintf("k%03d", i), []byte(fmt.Sprintf("v%d", i))); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := s.SetTTL("ttl", []byte("x"), time.Hour); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Delete("k005"); err != nil {
+				t.Fatal(err)
+			}
+			for range 5 {
+				for i := range 10 {
+					s.Get(fmt.Sprintf("k%03d", i))
+				}
+			}
+			wantKeys, wantMetas := s.index.snapshot()
+			s.warmup = true
+			s.maxSize = 8 * 40
+			s.Close()
+			for _, f := range []string{indexSnapFile, warmFile} {
+				if _, err := os.Stat(filepath.Join(dir, f)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if s, err = NewStorageEngine(dir, engine, durGroup); err != nil {
+				t.Fatal(err)
+			}
+			if s.indexFrom != "snapshot" {
+				t.Fatalf("index from %s after a clean close", s.indexFrom)
+			}
+			if e, ok := s.backend.(*segmentBackend); ok && e.keysFrom != "snapshot" {
+				t.Fatalf("keydir from %s after a clean close", e.keysFrom)
+			}
+			keys, metas := s.index.snapshot()
+			if len(keys) != len(wantKeys) {
+				t.Fatalf("%d keys indexed, want %d", len(keys), len(wantKeys))
+			}
+			for i := range keys {
+				if keys[i] != wantKeys[i] || metas[i] != wantMetas[i] {
+					t.Fatalf("%s: %+v, want %s %+v", keys[i], metas[i], wantKeys[i], wantMetas[i])
+				}
+			}
+			if v, err := s.Get("k123"); err != nil || string(v) != "v123" {
+				t.Fatalf("k123: %q %v", v, err)
+			}
+			if _, err := s.Get("k005"); err == nil {
+				t.Fatal("deleted key is back")
+			}
+
+			if s.cache.has(hash64str("k003")) {
+				t.Fatal("hot key cached before the warm-up")
+			}
+			s.warmUp()
+			if s.warmed.Load() == 0 || !s.cache.has(hash64str("k003")) || s.cache.has(hash64str("k200")) {
+				t.Fatalf("warmed %d: %v", s.warmed.Load(), s.startupStats())
+			}
+
+			if err := s.Set("new", []byte("n")); err != nil {
+				t.Fatal(err)
+			}
+			crashed := t.TempDir()
+			copyDir(t, dir, crashed)
+			s.Close()
+			if s, err = NewStorageEngine(crashed, engine, durGroup); err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			if s.indexFrom != "scan" {
+				t.Fatalf("index from %s after a crash", s.indexFrom)
+			}
+			if v, err := s.Get("new"); err != nil || string(v) != "n" {
+				t.Fatalf("new: %q %v", v, err)
+			}
+			if n := s.index.len(); n != len(wantKeys)+1 {
+				t.Fatalf("%d keys indexed, want %d", n, len(wantKeys)+1)
+			}
+		})
+	}
+}
+
+func TestStartupOtherEngine(t *testing.T) {
+	dir := t.TempDir()
+	open := func(engine string) *Storage {
+		t.Helper()
+		s, err := NewStorageEngine(dir, engine, durGroup)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.warmup = true
+		return s
+	}
+
+	s := open("memory")
+	s.Set("a", []byte("1"))
+	s.Get("a")
+	s.Close()
+	if _, err := os.Stat(filepath.Join(dir, indexSnapFile)); err == nil {
+		t.Fatal("memory engine wrote a snapshot")
+	}
+
+	s = open("files")
+	s.Set("b", []byte("2"))
+	s.Get("b")
+	s.Close()
+
+	s = open("memory")
+	if s.index.len() != 0 || s.indexFrom != "scan" {
+		t.Fatalf("memory engine indexed %d keys from %s", s.index.len(), s.indexFrom)
+	}
+	s.Close()
+
+	s = open("segments")
+	if s.indexFrom != "scan" || s.index.len() != 0 {
+		t.Fatalf("segments indexed %d keys from %s", s.index.len(), s.indexFrom)
+	}
+	s.warmUp()
+	if s.warmed.Load() != 0 {
+		t.Fatal("warmed from another engine's file")
+	}
+	for _, f := range []string{indexSnapFile, warmFile} {
+		if _, err := os.Stat(filepath.Join(dir, f)); err == nil {
+			t.Fatalf("%s kept", f)
+		}
+	}
+	s.Close()
+
+	s = open("files")
+	defer s.Close()
+	if s.indexFrom != "scan" {
+		t.Fatalf("index from %s", s.indexFrom)
+	}
+	if v, err := s.Get("b"); err != nil || string(v) != "2" {
+		t.Fatalf("b: %q %v", v, err)
+	}
+}
@@ -1,156 +1,323 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"log"
 	"os"
 	"path/filepath"
+	"sync"
 	"sync/atomic"
+	"time"
+)
+
+var (
+	errStale      = errors.New("stale version")
+	errConflict   = errors.New("condition failed")
+	errKeyTooLong = errors.New("key too long")
 )
 
 type Storage struct {
-	dir     string
-	cache   *cache
-	wal     *wal
-	size    atomic.Int64
-	maxSize int64
+	cache        *cache
+	backend      Backend
+	index        *keyIndex
+	clock        hlc
+	node         uint32
+	locks        [shards]sync.Mutex
+	expiry       expiryQueue
+	size         atomic.Int64
+	maxSize      int64
+	txs          txTable
+	tombstoneTTL time.Duration
+	done         chan struct{}
+
+	// snapshots for the next start go to dir, if set.
+	dir       string
+	engine    string
+	warmup    bool
+	indexFrom string
+	loadTime  time.Duration
+	warmed    atomic.Int64
 }
 
 func NewStorage(dir string) (*Storage, error) {
+	return NewStorageEngine(dir, "files", durGroup)
+}
+
+func NewStorageEngine(dir, engine string, mode durability) (*Storage, error) {
 	if err := os.MkdirAll(dir, 0755); err != nil {
 		return nil, err
 	}
 
-	w, err := newWAL(dir)
+	b, err := OpenBackend(engine, dir, mode)
 	if err != nil {
 		return nil, err
 	}
+	if engine == "memory" {
+		// memory starts empty, so no snapshots.
+		return openStorage(b, "", "")
+	}
+	return openStorage(b, engine, dir)
+}
+
+func NewStorageOn(b Backend) (*Storage, error) {
+	return openStorage(b, "", "")
+}
 
+func openStorage(b Backend, engine, dir string) (*Storage, error) {
 	s := &Storage{
-		dir:     dir,
 		cache:   newCache(100000),
-		wal:     w,
+		backend: b,
+		index:   newKeyIndex(),
 		maxSize: MaxCacheSize,
-	}
+		done:    make(chan struct{}),
+		dir:     dir,
+		engine:  engine,
 
-	if err := s.replayWAL(); err != nil {
-		return nil, err
+		tombstoneTTL: TombstoneTTL,
 	}
 
 	if err := s.load(); err != nil {
 		return nil, err
 	}
 
-	if err := w.truncate(); err != nil {
-		return nil, err
-	}
-
+	go s.reaper()
 	return s, nil
 }
 
-func (s *Storage) replayWAL() error {
-	entries := make(map[uint64][]byte)
-	if err := s.wal.replay(func(h uint64, data []byte) error {
-		entries[h] = data
-		return nil
-	}); err != nil {
-		return err
+// load builds the index from the last clean shutdown's snapshot, or else by
+// reading every record's head.
+func (s *Storage) load() error {
+	start := time.Now()
+	defer func() { s.loadTime = time.Since(start) }()
+
+	if s.dir != "" {
+		err := s.loadIndex(filepath.Join(s.dir, indexSnapFile))
+		if err == nil {
+			s.indexFrom = "snapshot"
+			return nil
+		}
+		if !os.IsNotExist(err) {
+			log.Printf("index snapshot: %v, scanning records", err)
+		}
 	}
 
-	for h, data := range entries {
-		if len(data) == 0 {
-			path := s.getPath(h)
-			os.Remove(path)
-		} else {
-			path := s.getPath(h)
-			if err := os.WriteFile(path, data, 0644); err != nil {
-				return err
-			}
-			s.cache.set(h, data)
+	s.indexFrom = "scan"
+	return s.backend.Scan(func(h uint64) {
+		if rec, err := s.readHead(h); err == nil {
+			s.indexRecord(h, rec)
 		}
+	})
+}
+
+func (s *Storage) indexRecord(h uint64, rec record) {
+	s.clock.observe(rec.ver.ts)
+	if rec.key == "" {
+		return
+	}
+	s.index.put(rec.key, keyMeta{h: h, ver: rec.ver, expires: rec.expires, deleted: rec.deleted})
+	if rec.expires != 0 {
+		s.expiry.push(rec.key, rec.expires)
 	}
-	s.size.Store(s.cache.size.Load())
-	return nil
 }
 
-func (s *Storage) load() error {
-	return filepath.Walk(s.dir, func(path string, info os.FileInfo, err error) error {
-		if err != nil || info.IsDir() || filepath.Ext(path) == ".log" || filepath.Ext(path) == ".tmp" {
-			return nil
-		}
+func (s *Storage) readHead(h uint64) (record, error) {
+	r, err := s.backend.Open(h)
+	if err != nil {
+		return record{}, err
+	}
+	defer r.Close()
 
-		if s.size.Load() >= s.maxSize {
-			return nil
-		}
+	head, _ := readHead(r)
+	if head == nil {
+		return record{}, nil
+	}
+	if rec := decodeRecord(head); rec.storedAt(h) {
+		return rec, nil
+	}
+	return record{}, nil
+}
 
-		h := parseHex(filepath.Base(path))
-		if !s.cache.has(h) {
-			if data, err := os.ReadFile(path); err == nil {
-				s.cache.set(h, data)
-			}
-		}
-		return nil
-	})
+func (s *Storage) newRecord(key string, value []byte) record {
+	return record{key: key, ver: version{ts: s.clock.now(), node: s.node}, value: value}
 }
 
-func (s *Storage) getPath(h uint64) string {
-	hex := fmtHex(h)
-	subdir := filepath.Join(s.dir, hex[:2])
-	os.MkdirAll(subdir, 0755)
-	return filepath.Join(subdir, hex)
+// tombstone turns rec into a delete of its key as of its version, kept for
+// tombstoneTTL so replicas that missed it still learn about it.
+func (s *Storage) tombstone(rec record) record {
+	return record{
+		key:     rec.key,
+		ver:     rec.ver,
+		deleted: true,
+		expires: time.Now().Add(s.tombstoneTTL).UnixMilli(),
+	}
+}
+
+func (s *Storage) lock(h uint64) *sync.Mutex {
+	return &s.locks[h%shards]
 }
 
 func (s *Storage) Set(key string, value []byte) error {
-	if len(value) > MaxValueSize {
+	return s.put(s.newRecord(key, value))
+}
+
+func (s *Storage) SetTTL(key string, value []byte, ttl time.Duration) error {
+	rec := s.newRecord(key, value)
+	if ttl > 0 {
+		rec.expires = time.Now().Add(ttl).UnixMilli()
+	}
+	return s.put(rec)
+}
+
+// put returns errStale when the key already holds rec's version or a newer one.
+func (s *Storage) put(rec record) error {
+	return s.putIf(rec, condition{})
+}
+
+func (s *Storage) putIf(rec record, cond condition) error {
+	if len(rec.key) > MaxKeySize {
+		return errKeyTooLong
+	}
+	if len(rec.value) > MaxValueSize {
 		return fmt.Errorf("too large")
 	}
+	s.clock.observe(rec.ver.ts)
 
-	h := hash64str(key)
-	s.wal.append(h, value)
-	s.cache.set(h, value)
-	s.size.Store(s.cache.size.Load())
+	h := hash64str(rec.key)
+	mu := s.lock(h)
+	mu.Lock()
+	defer mu.Unlock()
 
-	path := s.getPath(h)
-	if err := os.WriteFile(path, value, 0644); err != nil {
+	if s.txs.holder(rec.key, time.Now()) != "" {
+		return errConflict
+	}
+	cur, ok := s.index.get(rec.key)
+	if !cond.holds(cur.ver, ok && cur.live(time.Now())) {
+		return errConflict
+	}
+	if ok && !cur.ver.less(rec.ver) {
+		return errStale
+	}
+
+	data := rec.encode()
+	if err := s.backend.Set(h, data); err != nil {
 		return err
 	}
+	s.store(h, rec, data)
+	return nil
+}
+
+func (s *Storage) store(h uint64, rec record, data []byte) {
+	s.cache.set(h, data)
+	s.indexRecord(h, rec)
+	s.size.Store(s.cache.size.Load())
 
 	if s.size.Load() > s.maxSize {
 		freed := s.cache.evict(s.maxSize)
 		s.size.Add(-freed)
 	}
-
-	return nil
 }
 
+// Get returns the cached buffer, which callers must not modify.
 func (s *Storage) Get(key string) ([]byte, error) {
-	h := hash64str(key)
+	data, ok := s.fetch(key)
+	if !ok {
+		return nil, fmt.Errorf("not found")
+	}
+	return decodeRecord(data).value, nil
+}
 
-	if data, ok := s.cache.get(h); ok {
-		return data, nil
+func (s *Storage) fetch(key string) ([]byte, bool) {
+	data, ok := s.lookup(key)
+	if !ok || isTombstone(data) {
+		return nil, false
 	}
+	return data, true
+}
+
+// lookup is fetch that also returns tombstones.
+func (s *Storage) lookup(key string) ([]byte, bool) {
+	h := hash64str(key)
 
-	path := s.getPath(h)
-	data, err := os.ReadFile(path)
-	if err == nil {
+	data, ok := s.cache.get(h)
+	if !ok {
+		var err error
+		if data, err = s.backend.Get(h); err != nil {
+			return nil, false
+		}
+		if rec := decodeRecord(data); !rec.storedAt(h) {
+			data = (&record{key: key, value: data}).encode()
+		}
 		s.cache.set(h, data)
-		return data, nil
 	}
 
-	return nil, fmt.Errorf("not found")
+	rec := decodeRecord(data)
+	if !rec.matches(key) || expired(rec.expires, time.Now()) {
+		return nil, false
+	}
+	return data, true
 }
 
 func (s *Storage) Delete(key string) error {
-	h := hash64str(key)
+	return s.deleteIf(key, condition{})
+}
+
+func (s *Storage) deleteIf(key string, cond condition) error {
+	if err := s.putIf(s.tombstone(s.newRecord(key, nil)), cond); err != errStale {
+		return err
+	}
+	return nil
+}
+
+// remove drops key without leaving a tombstone.
+func (s *Storage) remove(key string, h uint64) {
+	s.backend.Delete(h)
+	s.forget(key, h)
+}
 
-	s.wal.append(h, nil)
+func (s *Storage) forget(key string, h uint64) {
+	s.index.del(key)
 	freed := s.cache.del(h)
 	s.size.Add(-freed)
-	os.Remove(s.getPath(h))
-	return nil
 }
 
+// Scan lists only the keys this node holds; see Cluster.scan.
+func (s *Storage) Scan(prefix, cursor string, limit int) ([]string, string) {
+	return s.index.scan(prefix, cursor, limit)
+}
+
+// Close takes every key lock first, so no write is caught halfway between
+// the backend and the index it saves.
 func (s *Storage) Close() {
-	s.wal.close()
+	close(s.done)
+	for i := range s.locks {
+		s.locks[i].Lock()
+		defer s.locks[i].Unlock()
+	}
+
+	if err := s.backend.Close(); err != nil {
+		log.Printf("close: %v", err)
+		return
+	}
+	if s.dir == "" {
+		return
+	}
+	if err := s.saveIndex(filepath.Join(s.dir, indexSnapFile)); err != nil {
+		log.Printf("index snapshot: %v", err)
+	}
+	if s.warmup {
+		if err := s.saveWarm(filepath.Join(s.dir, warmFile)); err != nil {
+			log.Printf("cache warm-up: %v", err)
+		}
+	}
+}
+
+func (s *Storage) startupStats() map[string]interface{} {
+	return map[string]interface{}{
+		"index":   s.indexFrom,
+		"load_ms": s.loadTime.Milliseconds(),
+		"warmed":  s.warmed.Load(),
+	}
 }
 
 func fmtHex(h uint64) string {
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestKeysListedAfterRestart(t *testing.T) {
+	want := []string{"a/1", "a/2", "a/3", "b/1"}
+	for _, restart := range []string{"Clean", "Crash"} {
+		t.Run(restart, func(t *testing.T) {
+			dir := t.TempDir()
+			s, err := NewStorage(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, k := range want {
+				if err := s.Set(k, []byte("v")); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if restart == "Crash" {
+				crashed := t.TempDir()
+				copyDir(t, dir, crashed)
+				dir = crashed
+			}
+			s.Close()
+
+			s, err = NewStorage(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			if keys, next := s.Scan("", "", 10); !slices.Equal(keys, want) || next != "" {
+				t.Fatalf("scan: %v %q", keys, next)
+			}
+			keys, next := s.Scan("a/", "", 2)
+			if !slices.Equal(keys, want[:2]) || next != "a/2" {
+				t.Fatalf("first page: %v %q", keys, next)
+			}
+			if keys, next = s.Scan("a/", next, 2); !slices.Equal(keys, want[2:3]) || next != "" {
+				t.Fatalf("second page: %v %q", keys, next)
+			}
+		})
+	}
+}
+
+func TestKeyTooLong(t *testing.T) {
+	s, err := NewStorage(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	long := strings.Repeat("k", MaxKeySize+1)
+	if err := s.Set(long, []byte("v")); err != errKeyTooLong {
+		t.Fatalf("set: %v", err)
+	}
+	if err := s.SetFrom(long, strings.NewReader("v"), 0); err != errKeyTooLong {
+		t.Fatalf("stream: %v", err)
+	}
+	max := strings.Repeat("m", MaxKeySize)
+	if err := s.Set(max, []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	if keys, _ := s.Scan("", "", 10); len(keys) != 1 || keys[0] != max {
+		t.Fatalf("scan: %d keys", len(keys))
+	}
+}
+
+func TestLegacyFiles(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string][]byte{
+		// values that happen to start with the record magic.
+		"legacy1": (&record{key: "zz", value: []byte("tail")}).encode(),
+		"legacy2": []byte("MV\x00\x00\x00rest"),
+		"legacy3": []byte("plain"),
+	}
+	for k, v := range files {
+		h := fmtHex(hash64str(k))
+		path := filepath.Join(dir, h[:2], h)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, v, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s, err := NewStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if keys, _ := s.Scan("", "", 10); len(keys) != 0 {
+		t.Fatalf("legacy files indexed: %v", keys)
+	}
+	for k, v := range files {
+		if got, err := s.Get(k); err != nil || !bytes.Equal(got, v) {
+			t.Fatalf("%s: %q %v", k, got, err)
+		}
+		s.cache.del(hash64str(k))
+		var buf bytes.Buffer
+		if _, err := s.GetTo(k, &buf); err != nil || !bytes.Equal(buf.Bytes(), v) {
+			t.Fatalf("%s streamed: %q %v", k, buf.Bytes(), err)
+		}
+	}
+	if _, err := s.Get("zz"); err == nil {
+		t.Fatal("key of a legacy value found")
+	}
+}
+
+func TestEmptyValueAndTombstoneRestart(t *testing.T) {
+	for _, engine := range []string{"files", "segments"} {
+		for _, restart := range []string{"Clean", "Crash"} {
+			t.Run(engine+"/"+restart, func(t *testing.T) {
+				dir := t.TempDir()
+				s, err := NewStorageEngine(dir, engine, durGroup)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := s.Set("empty", []byte{}); err != nil {
+					t.Fatal(err)
+				}
+				if err := s.Set("gone", []byte("v")); err != nil {
+					t.Fatal(err)
+				}
+				if err := s.Delete("gone"); err != nil {
+					t.Fatal(err)
+				}
+				stale := s.newRecord("gone", []byte("stale"))
+				stale.ver.ts = 1
+
+				if restart == "Crash" {
+					crashed := t.TempDir()
+					copyDir(t, dir, crashed)
+					s.Close()
+					dir = crashed
+				} else {
+					s.Close()
+				}
+
+				s, err = NewStorageEngine(dir, engine, durGroup)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer s.Close()
+				if restart == "Crash" && s.indexFrom != "scan" {
+					t.Fatalf("index from %s after a crash", s.indexFrom)
+				}
+
+				if v, err := s.Get("empty"); err != nil || len(v) != 0 {
+					t.Fatalf("empty value: %q %v", v, err)
+				}
+				if m, ok := s.index.get("empty"); !ok || m.deleted {
+					t.Fatalf("empty value indexed as %+v, %v", m, ok)
+				}
+				if _, err := s.Get("gone"); err == nil {
+					t.Fatal("deleted key is back")
+				}
+				if m, ok := s.index.get("gone"); !ok || !m.deleted {
+					t.Fatalf("tombstone lost: %+v, %v", m, ok)
+				}
+				if err := s.put(stale); err != errStale {
+					t.Fatalf("write older than the delete: %v", err)
+				}
+				if keys, _ := s.Scan("", "", 10); len(keys) != 1 || keys[0] != "empty" {
+					t.Fatalf("scan: %v", keys)
+				}
+			})
+		}
+	}
+}
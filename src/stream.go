@@ -0,0 +1,591 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+)
+
+const (
+	streamChunk    = 256 * 1024
+	streamChunkMax = 1024 * 1024
+)
+
+// valueWriter writes the head up front, so the version is fixed when the
+// stream opens.
+type valueWriter struct {
+	s   *Storage
+	rec record
+	h   uint64
+	f   *os.File
+	n   int64
+}
+
+func (s *Storage) create(rec record) (*valueWriter, error) {
+	if len(rec.key) > MaxKeySize {
+		return nil, errKeyTooLong
+	}
+	h := hash64str(rec.key)
+	f, err := s.backend.Create(h)
+	if err != nil {
+		return nil, err
+	}
+
+	rec.value = nil
+	if _, err := f.Write(rec.encode()); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return &valueWriter{s: s, rec: rec, h: h, f: f}, nil
+}
+
+func (w *valueWriter) Write(p []byte) (int, error) {
+	if w.n+int64(len(p)) > MaxValueSize {
+		return 0, fmt.Errorf("too large")
+	}
+	n, err := w.f.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+func (w *valueWriter) abort() {
+	w.f.Close()
+	os.Remove(w.f.Name())
+}
+
+// commit leaves the value out of the cache.
+func (w *valueWriter) commit() error {
+	if err := w.f.Sync(); err != nil {
+		w.abort()
+		return err
+	}
+	if err := w.f.Close(); err != nil {
+		os.Remove(w.f.Name())
+		return err
+	}
+
+	s := w.s
+	s.clock.observe(w.rec.ver.ts)
+
+	mu := s.lock(w.h)
+	mu.Lock()
+	defer mu.Unlock()
+
+	if s.txs.holder(w.rec.key, time.Now()) != "" {
+		os.Remove(w.f.Name())
+		return errConflict
+	}
+	if cur, ok := s.index.get(w.rec.key); ok && !cur.ver.less(w.rec.ver) {
+		os.Remove(w.f.Name())
+		return errStale
+	}
+	if err := s.backend.Commit(w.h, w.f.Name(), w.rec); err != nil {
+		return err
+	}
+
+	freed := s.cache.del(w.h)
+	s.size.Add(-freed)
+	s.indexRecord(w.h, w.rec)
+	return nil
+}
+
+func (s *Storage) SetFrom(key string, r io.Reader, ttl time.Duration) error {
+	rec := s.newRecord(key, nil)
+	if ttl > 0 {
+		rec.expires = time.Now().Add(ttl).UnixMilli()
+	}
+	w, err := s.create(rec)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		w.abort()
+		return err
+	}
+	return w.commit()
+}
+
+func (s *Storage) GetTo(key string, w io.Writer) (int64, error) {
+	r, err := s.open(key)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	return io.Copy(w, r)
+}
+
+func (s *Storage) open(key string) (io.ReadCloser, error) {
+	h := hash64str(key)
+	if data, ok := s.cache.get(h); ok {
+		rec := decodeRecord(data)
+		if !rec.matches(key) || rec.deleted || expired(rec.expires, time.Now()) {
+			return nil, fmt.Errorf("not found")
+		}
+		return io.NopCloser(bytes.NewReader(rec.value)), nil
+	}
+
+	f, err := s.backend.Open(h)
+	if err != nil {
+		return nil, fmt.Errorf("not found")
+	}
+	head, _ := readHead(f)
+	if rec := decodeRecord(head); head == nil || !rec.storedAt(h) {
+		f.Close()
+		if f, err = s.backend.Open(h); err != nil {
+			return nil, fmt.Errorf("not found")
+		}
+		return f, nil
+	}
+	rec := decodeRecord(head)
+	if !rec.matches(key) || rec.deleted || expired(rec.expires, time.Now()) {
+		f.Close()
+		return nil, fmt.Errorf("not found")
+	}
+	return f, nil
+}
+
+// lookupHead is lookup without the value.
+func (s *Storage) lookupHead(key string) ([]byte, bool) {
+	h := hash64str(key)
+	if data, ok := s.cache.get(h); ok {
+		rec := decodeRecord(data)
+		if !rec.matches(key) || expired(rec.expires, time.Now()) {
+			return nil, false
+		}
+		return data[:headLen(data)], true
+	}
+
+	f, err := s.backend.Open(h)
+	if err != nil {
+		return nil, false
+	}
+	defer f.Close()
+	head, _ := readHead(f)
+	rec := decodeRecord(head)
+	if head == nil || !rec.storedAt(h) {
+		return (&record{key: key}).encode(), true
+	}
+	if !rec.matches(key) || expired(rec.expires, time.Now()) {
+		return nil, false
+	}
+	return head, true
+}
+
+// clusterStream drops owners that fail and fails itself once fewer than a
+// quorum are left.
+type clusterStream struct {
+	local  *valueWriter
+	peers  []*streamConn
+	owners int
+	failed int
+}
+
+func (c *Cluster) openStream(key string, ttl time.Duration) (*clusterStream, error) {
+	nodes := c.hash(key, ReplicaCount)
+	if len(nodes) == 0 {
+		return nil, fmt.Errorf("no nodes")
+	}
+	rec := c.storage.newRecord(key, nil)
+	if ttl > 0 {
+		rec.expires = time.Now().Add(ttl).UnixMilli()
+	}
+	return c.streamTo(rec, nodes)
+}
+
+func (c *Cluster) streamTo(rec record, nodes []string) (*clusterStream, error) {
+	st := &clusterStream{owners: len(nodes)}
+	head := rec.encode()
+	for _, n := range nodes {
+		if n == c.self {
+			w, err := c.storage.create(rec)
+			if err != nil {
+				st.failed++
+				continue
+			}
+			st.local = w
+			continue
+		}
+		p, err := c.client.OpenSync(n, c.authKey, head)
+		if err != nil {
+			st.failed++
+			continue
+		}
+		st.peers = append(st.peers, p)
+	}
+	if !st.quorate() {
+		st.abort()
+		return nil, fmt.Errorf("quorum not reached")
+	}
+	return st, nil
+}
+
+func (st *clusterStream) quorate() bool {
+	return st.owners-st.failed >= st.owners/2+1
+}
+
+func (st *clusterStream) Write(p []byte) (int, error) {
+	if st.local != nil {
+		if _, err := st.local.Write(p); err != nil {
+			st.local.abort()
+			st.local = nil
+			st.failed++
+		}
+	}
+	live := st.peers[:0]
+	for _, peer := range st.peers {
+		if _, err := peer.Write(p); err != nil {
+			peer.abort()
+			st.failed++
+			continue
+		}
+		live = append(live, peer)
+	}
+	st.peers = live
+
+	if !st.quorate() {
+		return 0, fmt.Errorf("quorum not reached")
+	}
+	return len(p), nil
+}
+
+func (st *clusterStream) commit() error {
+	ok := 0
+	if st.local != nil {
+		if err := st.local.commit(); err == nil || err == errStale {
+			ok++
+		}
+		st.local = nil
+	}
+	for _, peer := range st.peers {
+		if peer.end() == nil {
+			ok++
+		}
+	}
+	st.peers = nil
+
+	if ok < st.owners/2+1 {
+		return fmt.Errorf("quorum not reached")
+	}
+	return nil
+}
+
+func (st *clusterStream) abort() {
+	if st.local != nil {
+		st.local.abort()
+		st.local = nil
+	}
+	for _, peer := range st.peers {
+		peer.abort()
+	}
+	st.peers = nil
+}
+
+// openValue asks a quorum of owners for the head of their copy and streams
+// the value from the one with the newest version.
+func (c *Cluster) openValue(key string) (io.ReadCloser, error) {
+	if c.readQuorum <= 1 && c.owners(key, c.self) {
+		if r, err := c.storage.open(key); err == nil {
+			return r, nil
+		}
+	}
+
+	nodes := c.hash(key, ReplicaCount)
+	if len(nodes) == 0 {
+		return nil, fmt.Errorf("no nodes")
+	}
+	got, _, _, err := c.query(key, nodes, c.fetchHead)
+	if err != nil {
+		return nil, err
+	}
+	best := resolve(got)
+	if !best.found || isTombstone(best.data) {
+		return nil, fmt.Errorf("not found")
+	}
+	for _, r := range got {
+		if !r.found || r.ver.less(best.ver) {
+			go c.read(key)
+			break
+		}
+	}
+
+	if best.node == c.self {
+		return c.storage.open(key)
+	}
+	return c.client.FetchStream(best.node, key, c.authKey)
+}
+
+func (c *Cluster) fetchHead(node, key string) readResult {
+	r := readResult{node: node}
+	if node == c.self {
+		r.data, r.found = c.storage.lookupHead(key)
+	} else {
+		r.data, r.found, r.err = c.client.FetchHead(node, key, c.authKey)
+	}
+	if r.found {
+		r.ver = decodeRecord(r.data).ver
+	}
+	return r
+}
+
+// writeChunks sends ([status:u8][len:u32][chunk])* ending with an empty chunk.
+func writeChunks(w io.Writer, r io.Reader, buf []byte) error {
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			if err := writeResp(w, 0x00, buf[:n]); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return writeResp(w, 0x00, nil)
+		}
+		if err != nil {
+			return writeErr(w)
+		}
+	}
+}
+
+type streamConn struct {
+	pool *connPool
+	conn net.Conn
+	hdr  [5]byte
+}
+
+func (c *BinaryClient) openStream(addr, authKey string, req []byte) (*streamConn, error) {
+	pool := c.getPool(addr)
+	conn, err := pool.Get()
+	if err != nil {
+		return nil, err
+	}
+	if err := authenticate(conn, authKey); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	s := &streamConn{pool: pool, conn: conn}
+	if err := s.send(req); err != nil {
+		s.abort()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (c *BinaryClient) OpenSync(addr, authKey string, head []byte) (*streamConn, error) {
+	return c.openStream(addr, authKey, syncRequest(OpSyncBegin, decodeRecord(head).key, nil, head))
+}
+
+func (c *BinaryClient) OpenSet(addr, key, authKey string, ttl time.Duration) (*streamConn, error) {
+	n := 3 + len(key)
+	req := make([]byte, n+5, n+9)
+	req[0] = OpSetBegin
+	binary.LittleEndian.PutUint16(req[1:3], uint16(len(key)))
+	copy(req[3:], key)
+	if ttl > 0 {
+		req[n+4] = valTTL
+		req = binary.LittleEndian.AppendUint32(req, uint32(ttl/time.Second))
+	}
+	return c.openStream(addr, authKey, req)
+}
+
+func (s *streamConn) send(req []byte) error {
+	s.conn.SetDeadline(time.Now().Add(WriteTimeout))
+	if _, err := s.conn.Write(req); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(s.conn, s.hdr[:]); err != nil {
+		return err
+	}
+	if n := binary.LittleEndian.Uint32(s.hdr[1:]); n > 0 {
+		if _, err := io.CopyN(io.Discard, s.conn, int64(n)); err != nil {
+			return err
+		}
+	}
+	if s.hdr[0] != 0x00 {
+		return fmt.Errorf("stream failed")
+	}
+	return nil
+}
+
+func (s *streamConn) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := min(len(p), streamChunk)
+		req := make([]byte, 8+n)
+		req[0] = OpSetChunk
+		binary.LittleEndian.PutUint32(req[3:], uint32(n))
+		copy(req[8:], p[:n])
+		if err := s.send(req); err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+func (s *streamConn) end() error {
+	if err := s.send([]byte{OpSetEnd, 0, 0}); err != nil {
+		s.abort()
+		return err
+	}
+	s.conn.SetDeadline(time.Time{})
+	s.pool.Put(s.conn)
+	return nil
+}
+
+func (s *streamConn) abort() {
+	s.conn.Close()
+}
+
+func (c *BinaryClient) SetStream(addr, key, authKey string, r io.Reader, ttl time.Duration) error {
+	s, err := c.OpenSet(addr, key, authKey, ttl)
+	if err != nil {
+		return err
+	}
+	if _, err := io.CopyBuffer(s, r, make([]byte, streamChunk)); err != nil {
+		s.abort()
+		return err
+	}
+	return s.end()
+}
+
+func (c *BinaryClient) FetchStream(addr, key, authKey string) (io.ReadCloser, error) {
+	pool := c.getPool(addr)
+	conn, err := pool.Get()
+	if err != nil {
+		return nil, err
+	}
+	if err := authenticate(conn, authKey); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := conn.Write(keyRequest(OpFetchStream, key, 0)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	r := &chunkReader{pool: pool, conn: conn}
+	if err := r.next(); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("not found")
+	}
+	return r, nil
+}
+
+type chunkReader struct {
+	pool *connPool
+	conn net.Conn
+	left uint32
+	err  error
+}
+
+func (r *chunkReader) next() error {
+	var hdr [5]byte
+	r.conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := io.ReadFull(r.conn, hdr[:]); err != nil {
+		return r.fail(err)
+	}
+	n := binary.LittleEndian.Uint32(hdr[1:])
+	if n == 0 {
+		r.conn.SetDeadline(time.Time{})
+		r.pool.Put(r.conn)
+		r.conn = nil
+		if hdr[0] != 0x00 {
+			return r.fail(fmt.Errorf("stream failed"))
+		}
+		return r.fail(io.EOF)
+	}
+	if hdr[0] != 0x00 {
+		return r.fail(fmt.Errorf("stream failed"))
+	}
+	if n > streamChunkMax {
+		return r.fail(fmt.Errorf("too large"))
+	}
+	r.left = n
+	return nil
+}
+
+func (r *chunkReader) fail(err error) error {
+	r.err = err
+	r.Close()
+	return err
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	if r.left == 0 {
+		if err := r.next(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.conn.Read(p[:min(len(p), int(r.left))])
+	r.left -= uint32(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		r.fail(err)
+	}
+	return n, err
+}
+
+func (r *chunkReader) Close() error {
+	if r.conn != nil {
+		r.conn.Close()
+		r.conn = nil
+	}
+	return nil
+}
+
+func (c *BinaryClient) GetStream(addr, key string, w io.Writer) (int64, error) {
+	pool := c.getPool(addr)
+	conn, err := pool.Get()
+	if err != nil {
+		return 0, err
+	}
+
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := conn.Write(keyRequest(OpGetStream, key, 0)); err != nil {
+		conn.Close()
+		return 0, err
+	}
+
+	var hdr [5]byte
+	var total int64
+	for {
+		if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+			conn.Close()
+			return total, err
+		}
+		n := binary.LittleEndian.Uint32(hdr[1:])
+		if hdr[0] != 0x00 || n == 0 {
+			conn.SetDeadline(time.Time{})
+			pool.Put(conn)
+			if hdr[0] != 0x00 && total == 0 {
+				return total, fmt.Errorf("not found")
+			}
+			if hdr[0] != 0x00 {
+				return total, fmt.Errorf("stream failed")
+			}
+			return total, nil
+		}
+		if n > streamChunkMax {
+			conn.Close()
+			return total, fmt.Errorf("too large")
+		}
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+		m, err := io.CopyN(w, conn, int64(n))
+		total += m
+		if err != nil {
+			conn.Close()
+			return total, err
+		}
+	}
+}
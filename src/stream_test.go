@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestStream(t *testing.T) {
+	nodes := startCluster(t, 3, 1)
+	big := make([]byte, 3*1024*1024+17)
+	rand.Read(big)
+	c := NewBinaryClient()
+	if err := c.SetStream(nodes[0].addr, "big", "", bytes.NewReader(big), 0); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "replication", func() bool {
+		for _, n := range nodes {
+			if _, ok := n.v.storage.fetch("big"); !ok {
+				return false
+			}
+		}
+		return true
+	})
+	for _, n := range nodes {
+		var buf bytes.Buffer
+		if _, err := c.GetStream(n.addr, "big", &buf); err != nil || !bytes.Equal(buf.Bytes(), big) {
+			t.Fatalf("%s: streamed %d bytes, %v", n.addr, buf.Len(), err)
+		}
+		if v, err := c.Get(n.addr, "big"); err != nil || !bytes.Equal(v, big) {
+			t.Fatalf("%s: got %d bytes, %v", n.addr, len(v), err)
+		}
+		buf.Reset()
+		if _, err := n.v.storage.GetTo("big", &buf); err != nil || !bytes.Equal(buf.Bytes(), big) {
+			t.Fatalf("%s: local %d bytes, %v", n.addr, buf.Len(), err)
+		}
+	}
+	if _, err := c.GetStream(nodes[1].addr, "nope", io.Discard); err == nil {
+		t.Fatal("missing key streamed")
+	}
+
+	if err := c.SetStream(nodes[1].addr, "small", "", bytes.NewReader([]byte("hi")), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if _, err := c.GetStream(nodes[2].addr, "small", &buf); err != nil || buf.String() != "hi" {
+		t.Fatalf("small: %q %v", buf.String(), err)
+	}
+}
+
+func TestStreamRestart(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Set("k", []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetFrom("k", bytes.NewReader([]byte("streamed")), 0); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	if s, err = NewStorage(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if v, err := s.Get("k"); err != nil || string(v) != "streamed" {
+		t.Fatalf("after restart: %q %v", v, err)
+	}
+}
+
+func TestStreamNewestOwner(t *testing.T) {
+	nodes := startCluster(t, 3, 3)
+	c := NewBinaryClient()
+	if err := c.SetStream(nodes[0].addr, "big", "", bytes.NewReader(bytes.Repeat([]byte("o"), 2*1024*1024)), 0); err != nil {
+		t.Fatal(err)
+	}
+	s := nodes[2].v.storage
+	newer := bytes.Repeat([]byte("n"), 1024*1024+3)
+	if err := s.put(s.newRecord("big", newer)); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if _, err := c.GetStream(nodes[0].addr, "big", &buf); err != nil || !bytes.Equal(buf.Bytes(), newer) {
+		t.Fatalf("streamed %d bytes, %v", buf.Len(), err)
+	}
+	waitFor(t, "read repair", func() bool {
+		v, _ := nodes[0].v.storage.Get("big")
+		return bytes.Equal(v, newer)
+	})
+
+	s = nodes[1].v.storage
+	if err := s.put(s.tombstone(s.newRecord("big", nil))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.GetStream(nodes[0].addr, "big", io.Discard); err == nil {
+		t.Fatal("tombstone streamed")
+	}
+
+	t.Run("Fetch", func(t *testing.T) {
+		cl := nodes[0].v.cluster.client
+		if r, err := cl.FetchStream(nodes[2].addr, "none", ""); err == nil {
+			r.Close()
+			t.Fatal("missing key fetched")
+		}
+		if err := nodes[2].v.storage.Set("e", []byte{}); err != nil {
+			t.Fatal(err)
+		}
+		r, err := cl.FetchStream(nodes[2].addr, "e", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		if b, err := io.ReadAll(r); err != nil || len(b) != 0 {
+			t.Fatalf("empty value: %q %v", b, err)
+		}
+	})
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+const reapInterval = time.Second
+
+type expiryItem struct {
+	at  int64
+	key string
+}
+
+type expiryHeap []expiryItem
+
+func (h expiryHeap) Len() int           { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].at < h[j].at }
+func (h expiryHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *expiryHeap) Push(x any)        { *h = append(*h, x.(expiryItem)) }
+func (h *expiryHeap) Pop() any {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[0 : n-1]
+	return x
+}
+
+// expiryQueue entries are checked against the index when reaped, never
+// removed.
+type expiryQueue struct {
+	mu sync.Mutex
+	h  expiryHeap
+}
+
+func (q *expiryQueue) push(key string, at int64) {
+	q.mu.Lock()
+	heap.Push(&q.h, expiryItem{at: at, key: key})
+	q.mu.Unlock()
+}
+
+func (q *expiryQueue) due(now int64) []expiryItem {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var items []expiryItem
+	for len(q.h) > 0 && q.h[0].at <= now {
+		items = append(items, heap.Pop(&q.h).(expiryItem))
+	}
+	return items
+}
+
+func (s *Storage) reaper() {
+	ticker := time.NewTicker(reapInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.reap(time.Now())
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func (s *Storage) reap(now time.Time) int {
+	n := 0
+	for _, item := range s.expiry.due(now.UnixMilli()) {
+		h := hash64str(item.key)
+		mu := s.lock(h)
+		mu.Lock()
+		if cur, ok := s.index.get(item.key); ok && cur.expires == item.at {
+			s.remove(item.key, h)
+			n++
+		}
+		mu.Unlock()
+	}
+	return n
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTTL(t *testing.T) {
+	s, err := NewStorage(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if err := s.SetTTL("a", []byte("1"), 20*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetTTL("b", []byte("2"), 20*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Set("c", []byte("3")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get("a"); err != nil {
+		t.Fatal(err)
+	}
+	// rewritten with a later expiry, which the queued one must not cut short.
+	if err := s.SetTTL("b", []byte("2"), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if _, err := s.Get("a"); err == nil {
+		t.Fatal("expired key still served")
+	}
+	if keys, _ := s.Scan("", "", 10); len(keys) != 2 {
+		t.Fatalf("scan: %v", keys)
+	}
+	if n := s.reap(time.Now()); n != 1 {
+		t.Fatalf("reaped %d keys", n)
+	}
+	if _, ok := s.index.get("a"); ok || s.index.len() != 2 {
+		t.Fatalf("index holds %d keys", s.index.len())
+	}
+	if v, err := s.Get("b"); err != nil || string(v) != "2" {
+		t.Fatalf("b: %q %v", v, err)
+	}
+
+	if err := s.Delete("c"); err != nil {
+		t.Fatal(err)
+	}
+	if n := s.reap(time.Now().Add(TombstoneTTL + time.Minute)); n != 2 {
+		t.Fatalf("reaped %d keys", n)
+	}
+	if s.index.len() != 0 {
+		t.Fatalf("index holds %d keys", s.index.len())
+	}
+}
@@ -0,0 +1,584 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// txTimeout is how long a prepared transaction keeps its keys reserved.
+const txTimeout = 10 * time.Second
+
+type txOp struct {
+	rec  record
+	del  bool
+	cond condition
+}
+
+func validTx(ops []txOp) error {
+	if len(ops) == 0 || len(ops) > maxBatchKeys {
+		return fmt.Errorf("invalid transaction size")
+	}
+	seen := make(map[string]bool, len(ops))
+	for _, op := range ops {
+		if op.rec.key == "" || len(op.rec.key) > MaxKeySize || seen[op.rec.key] {
+			return fmt.Errorf("invalid transaction key")
+		}
+		if len(op.rec.value) > MaxValueSize {
+			return fmt.Errorf("too large")
+		}
+		seen[op.rec.key] = true
+	}
+	return nil
+}
+
+// txTable holds prepared transactions and the keys they reserve.
+type txTable struct {
+	mu       sync.Mutex
+	pending  atomic.Int32
+	prepared map[string]*preparedTx
+	reserved map[string]string
+}
+
+type preparedTx struct {
+	ops      []txOp
+	deadline time.Time
+}
+
+func (t *txTable) holder(key string, now time.Time) string {
+	if t.pending.Load() == 0 {
+		return ""
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	id, ok := t.reserved[key]
+	if !ok {
+		return ""
+	}
+	if tx := t.prepared[id]; tx == nil || now.After(tx.deadline) {
+		t.dropLocked(id)
+		return ""
+	}
+	return id
+}
+
+func (t *txTable) reserve(id string, ops []txOp, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.prepared == nil {
+		t.prepared = make(map[string]*preparedTx)
+		t.reserved = make(map[string]string)
+	}
+	for old, tx := range t.prepared {
+		if old == id || now.After(tx.deadline) {
+			t.dropLocked(old)
+		}
+	}
+
+	t.prepared[id] = &preparedTx{ops: ops, deadline: now.Add(txTimeout)}
+	for _, op := range ops {
+		t.reserved[op.rec.key] = id
+	}
+	t.pending.Add(1)
+}
+
+func (t *txTable) get(id string, now time.Time) []txOp {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	tx := t.prepared[id]
+	if tx == nil || now.After(tx.deadline) {
+		return nil
+	}
+	return tx.ops
+}
+
+// release reports whether the transaction was still live.
+func (t *txTable) release(id string, now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	tx := t.prepared[id]
+	if tx == nil {
+		return false
+	}
+	t.dropLocked(id)
+	return !now.After(tx.deadline)
+}
+
+func (t *txTable) dropLocked(id string) {
+	tx := t.prepared[id]
+	if tx == nil {
+		return
+	}
+	for _, op := range tx.ops {
+		if t.reserved[op.rec.key] == id {
+			delete(t.reserved, op.rec.key)
+		}
+	}
+	delete(t.prepared, id)
+	t.pending.Add(-1)
+}
+
+// lockKeys takes the key locks of ops in lock order and returns the unlock.
+func (s *Storage) lockKeys(ops []txOp) func() {
+	idx := make([]uint64, 0, len(ops))
+	for _, op := range ops {
+		idx = append(idx, hash64str(op.rec.key)%shards)
+	}
+	slices.Sort(idx)
+	idx = slices.Compact(idx)
+
+	for _, i := range idx {
+		s.locks[i].Lock()
+	}
+	return func() {
+		for _, i := range idx {
+			s.locks[i].Unlock()
+		}
+	}
+}
+
+func (s *Storage) checkTx(id string, ops []txOp) error {
+	now := time.Now()
+	for _, op := range ops {
+		if h := s.txs.holder(op.rec.key, now); h != "" && h != id {
+			return errConflict
+		}
+		cur, ok := s.index.get(op.rec.key)
+		if !op.cond.holds(cur.ver, ok && cur.live(now)) {
+			return errConflict
+		}
+	}
+	return nil
+}
+
+// applyTx skips writes older than what their key holds, as put does.
+func (s *Storage) applyTx(ops []txOp) error {
+	entries := make([]walEntry, 0, len(ops))
+	recs := make([]record, 0, len(ops))
+	for _, op := range ops {
+		s.clock.observe(op.rec.ver.ts)
+		cur, ok := s.index.get(op.rec.key)
+		if ok && !cur.ver.less(op.rec.ver) {
+			continue
+		}
+		rec := op.rec
+		if op.del {
+			rec = s.tombstone(rec)
+		}
+		entries = append(entries, walEntry{hash: hash64str(rec.key), data: rec.encode()})
+		recs = append(recs, rec)
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+
+	if err := s.backend.Batch(entries); err != nil {
+		return err
+	}
+	for i, rec := range recs {
+		s.store(entries[i].hash, rec, entries[i].data)
+	}
+	return nil
+}
+
+func (s *Storage) commitTx(ops []txOp) error {
+	if err := validTx(ops); err != nil {
+		return err
+	}
+	unlock := s.lockKeys(ops)
+	defer unlock()
+
+	if err := s.checkTx("", ops); err != nil {
+		return err
+	}
+	return s.applyTx(ops)
+}
+
+func (s *Storage) prepareTx(id string, ops []txOp) error {
+	if err := validTx(ops); err != nil {
+		return err
+	}
+	unlock := s.lockKeys(ops)
+	defer unlock()
+
+	if err := s.checkTx(id, ops); err != nil {
+		return err
+	}
+	s.txs.reserve(id, ops, time.Now())
+	return nil
+}
+
+func (s *Storage) commitPrepared(id string) error {
+	ops := s.txs.get(id, time.Now())
+	if ops == nil {
+		return fmt.Errorf("unknown transaction")
+	}
+	unlock := s.lockKeys(ops)
+	defer unlock()
+
+	if !s.txs.release(id, time.Now()) {
+		return fmt.Errorf("unknown transaction")
+	}
+	return s.applyTx(ops)
+}
+
+func (s *Storage) abortTx(id string) {
+	s.txs.release(id, time.Now())
+}
+
+func (c *Cluster) transact(ops []txOp) (version, error) {
+	ver, err := c.commitOps(ops)
+	c.countTx(err == nil)
+	return ver, err
+}
+
+// commitOps runs two-phase commit with the owners of ops: it commits once
+// every key has a quorum of owners that prepared, and aborts otherwise.
+func (c *Cluster) commitOps(ops []txOp) (version, error) {
+	if err := validTx(ops); err != nil {
+		return version{}, err
+	}
+
+	ver := version{ts: c.storage.clock.now(), node: c.storage.node}
+	owners := make([][]string, len(ops))
+	for i := range ops {
+		ops[i].rec.ver = ver
+		owners[i] = c.hash(ops[i].rec.key, ReplicaCount)
+		if len(owners[i]) == 0 {
+			return version{}, fmt.Errorf("no nodes")
+		}
+	}
+
+	groups := groupByOwner(owners)
+	if _, ok := groups[c.self]; ok && len(groups) == 1 {
+		if err := c.storage.commitTx(ops); err != nil {
+			return version{}, err
+		}
+		return ver, nil
+	}
+
+	id := c.self + "/" + ver.String()
+	share := func(idx []int) []txOp {
+		sub := make([]txOp, len(idx))
+		for j, i := range idx {
+			sub[j] = ops[i]
+		}
+		return sub
+	}
+
+	votes := make(map[string]error, len(groups))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for node, idx := range groups {
+		wg.Add(1)
+		go func(node string, idx []int) {
+			defer wg.Done()
+			var err error
+			if node == c.self {
+				err = c.storage.prepareTx(id, share(idx))
+			} else {
+				err = c.client.TxPrepare(node, c.authKey, id, encodeTxOps(share(idx)))
+			}
+			mu.Lock()
+			votes[node] = err
+			mu.Unlock()
+		}(node, idx)
+	}
+	wg.Wait()
+
+	commit, conflict := true, false
+	for i := range ops {
+		yes := 0
+		for _, n := range owners[i] {
+			switch votes[n] {
+			case nil:
+				yes++
+			case errConflict:
+				conflict = true
+			}
+		}
+		if yes < len(owners[i])/2+1 {
+			commit = false
+		}
+	}
+
+	var logged string
+	var logErr error
+	if commit && len(ops) > 1 {
+		if logged, logErr = c.logTx(id, groups, share); logErr != nil {
+			commit = false
+		}
+	}
+
+	for node, idx := range groups {
+		wg.Add(1)
+		go func(node string, idx []int) {
+			defer wg.Done()
+			c.finishTx(node, id, share(idx), votes[node], commit)
+		}(node, idx)
+	}
+	wg.Wait()
+	if logged != "" {
+		os.Remove(logged)
+	}
+
+	if commit {
+		return ver, nil
+	}
+	if logErr != nil {
+		return version{}, fmt.Errorf("transaction aborted: %v", logErr)
+	}
+	if conflict {
+		return version{}, errConflict
+	}
+	return version{}, fmt.Errorf("transaction aborted")
+}
+
+// finishTx hints owners that missed a committed transaction or voted
+// against it.
+func (c *Cluster) finishTx(node, id string, ops []txOp, vote error, commit bool) {
+	if !commit {
+		// a prepare that failed in transport may still have gone through.
+		switch {
+		case node == c.self:
+			c.storage.abortTx(id)
+		case vote != errConflict:
+			c.client.TxAbort(node, c.authKey, id)
+		}
+		return
+	}
+
+	err := vote
+	if vote != errConflict {
+		if node == c.self {
+			err = c.storage.commitPrepared(id)
+		} else {
+			err = c.client.TxCommit(node, c.authKey, id)
+		}
+	}
+	if err == nil {
+		return
+	}
+	for _, op := range ops {
+		rec := c.txRecord(op)
+		c.hint(node, rec.encode())
+	}
+}
+
+// logTx records the decision before phase 2, so a coordinator crash can't
+// leave a transaction applied on some owners only.
+func (c *Cluster) logTx(id string, groups map[string][]int, share func([]int) []txOp) (string, error) {
+	if c.hints == nil {
+		return "", nil
+	}
+	var targets []string
+	var recs [][]byte
+	for node, idx := range groups {
+		for _, op := range share(idx) {
+			rec := c.txRecord(op)
+			targets = append(targets, node)
+			recs = append(recs, rec.encode())
+		}
+	}
+	return c.hints.logTx(id, targets, recs)
+}
+
+func (c *Cluster) txRecord(op txOp) record {
+	if op.del {
+		return c.storage.tombstone(op.rec)
+	}
+	return op.rec
+}
+
+func (c *Cluster) countTx(committed bool) {
+	if committed {
+		c.txCommitted.Add(1)
+	} else {
+		c.txAborted.Add(1)
+	}
+}
+
+// encodeTxOps frames a transaction's writes between nodes as
+// [count:u32]([del:u8][cond:13][reclen:u32][record])*.
+func encodeTxOps(ops []txOp) []byte {
+	recs := make([][]byte, len(ops))
+	size := 4
+	for i, op := range ops {
+		recs[i] = op.rec.encode()
+		size += 1 + condLen + 4 + len(recs[i])
+	}
+	buf := make([]byte, size)
+	binary.LittleEndian.PutUint32(buf, uint32(len(ops)))
+	n := 4
+	for i, op := range ops {
+		if op.del {
+			buf[n] = 1
+		}
+		op.cond.put(buf[n+1:])
+		n += 1 + condLen
+		binary.LittleEndian.PutUint32(buf[n:], uint32(len(recs[i])))
+		n += 4
+		n += copy(buf[n:], recs[i])
+	}
+	return buf
+}
+
+func decodeTxOps(b []byte) ([]txOp, error) {
+	if len(b) < 4 {
+		return nil, fmt.Errorf("truncated transaction")
+	}
+	count := binary.LittleEndian.Uint32(b)
+	if count > maxBatchKeys {
+		return nil, fmt.Errorf("too many keys")
+	}
+	b = b[4:]
+	ops := make([]txOp, 0, count)
+	for range count {
+		if len(b) < 1+condLen+4 {
+			return nil, fmt.Errorf("truncated transaction")
+		}
+		cond, err := readCondition(b[1:])
+		if err != nil {
+			return nil, err
+		}
+		del := b[0] == 1
+		n := int(binary.LittleEndian.Uint32(b[1+condLen:]))
+		b = b[1+condLen+4:]
+		if n > len(b) {
+			return nil, fmt.Errorf("truncated transaction")
+		}
+		// prepared writes outlive the request buffer.
+		rec := decodeRecord(bytes.Clone(b[:n]))
+		if rec.key == "" {
+			return nil, fmt.Errorf("invalid record")
+		}
+		ops = append(ops, txOp{rec: rec, del: del, cond: cond})
+		b = b[n:]
+	}
+	return ops, nil
+}
+
+// encodeTxRequest frames a client transaction as
+// [count:u32]([del:u8][cond:13][keylen:u16][key][vallen:u32][value])*.
+func encodeTxRequest(ops []txOp) []byte {
+	size := 4
+	for _, op := range ops {
+		size += 1 + condLen + 2 + len(op.rec.key) + 4 + len(op.rec.value)
+	}
+	buf := make([]byte, size)
+	binary.LittleEndian.PutUint32(buf, uint32(len(ops)))
+	n := 4
+	for _, op := range ops {
+		if op.del {
+			buf[n] = 1
+		}
+		op.cond.put(buf[n+1:])
+		n += 1 + condLen
+		binary.LittleEndian.PutUint16(buf[n:], uint16(len(op.rec.key)))
+		n += 2
+		n += copy(buf[n:], op.rec.key)
+		binary.LittleEndian.PutUint32(buf[n:], uint32(len(op.rec.value)))
+		n += 4
+		n += copy(buf[n:], op.rec.value)
+	}
+	return buf
+}
+
+func decodeTxRequest(b []byte) ([]txOp, error) {
+	if len(b) < 4 {
+		return nil, fmt.Errorf("truncated transaction")
+	}
+	count := binary.LittleEndian.Uint32(b)
+	if count > maxBatchKeys {
+		return nil, fmt.Errorf("too many keys")
+	}
+	b = b[4:]
+	ops := make([]txOp, 0, count)
+	for range count {
+		if len(b) < 1+condLen+2 {
+			return nil, fmt.Errorf("truncated transaction")
+		}
+		cond, err := readCondition(b[1:])
+		if err != nil {
+			return nil, err
+		}
+		op := txOp{del: b[0] == 1, cond: cond}
+		b = b[1+condLen:]
+
+		kl := int(binary.LittleEndian.Uint16(b))
+		if 2+kl+4 > len(b) {
+			return nil, fmt.Errorf("truncated transaction")
+		}
+		vl := int(binary.LittleEndian.Uint32(b[2+kl:]))
+		if 2+kl+4+vl > len(b) {
+			return nil, fmt.Errorf("truncated transaction")
+		}
+		op.rec = record{key: string(b[2 : 2+kl]), value: b[2+kl+4 : 2+kl+4+vl]}
+		ops = append(ops, op)
+		b = b[2+kl+4+vl:]
+	}
+	return ops, nil
+}
+
+// Transact sends only key, value, del and cond of each op.
+func (c *BinaryClient) Transact(addr, authKey string, ops []txOp, ttl time.Duration) (version, error) {
+	body := encodeTxRequest(ops)
+	req := keyRequest(OpTx, "", 5)
+	binary.LittleEndian.PutUint32(req[3:], uint32(len(body)))
+	if ttl > 0 {
+		req[7] = valTTL
+		req = binary.LittleEndian.AppendUint32(req, uint32(ttl/time.Second))
+	}
+	req = append(req, body...)
+
+	status, payload, err := c.call(addr, authKey, req)
+	if err != nil {
+		return version{}, err
+	}
+	switch {
+	case status == 0x00 && len(payload) == versionLen:
+		return readVersion(payload), nil
+	case status == statusConflict:
+		return version{}, errConflict
+	}
+	return version{}, fmt.Errorf("transaction failed")
+}
+
+func (c *BinaryClient) TxPrepare(addr, authKey, id string, ops []byte) error {
+	status, _, err := c.call(addr, authKey, syncRequest(OpTxPrepare, id, nil, ops))
+	if err != nil {
+		return err
+	}
+	switch status {
+	case 0x00:
+		return nil
+	case statusConflict:
+		return errConflict
+	}
+	return fmt.Errorf("prepare failed")
+}
+
+func (c *BinaryClient) TxCommit(addr, authKey, id string) error {
+	status, _, err := c.call(addr, authKey, keyRequest(OpTxCommit, id, 0))
+	if err != nil {
+		return err
+	}
+	if status != 0x00 {
+		return fmt.Errorf("commit failed")
+	}
+	return nil
+}
+
+func (c *BinaryClient) TxAbort(addr, authKey, id string) error {
+	_, _, err := c.call(addr, authKey, keyRequest(OpTxAbort, id, 0))
+	return err
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTxLocal(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Set("a", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	ops := []txOp{
+		{rec: s.newRecord("a", []byte("2")), cond: condition{kind: condPresent}},
+		{rec: s.newRecord("b", []byte("3")), cond: condition{kind: condAbsent}},
+	}
+	if err := s.commitTx(ops); err != nil {
+		t.Fatal(err)
+	}
+	ops = []txOp{
+		{rec: s.newRecord("a", []byte("9"))},
+		{rec: s.newRecord("b", []byte("9")), cond: condition{kind: condAbsent}},
+	}
+	if err := s.commitTx(ops); err != errConflict {
+		t.Fatalf("failed precondition: %v", err)
+	}
+	if v, _ := s.Get("a"); string(v) != "2" {
+		t.Fatalf("partially applied: a is %q", v)
+	}
+	ops = []txOp{
+		{rec: record{key: "a", ver: version{ts: s.clock.now()}}, del: true},
+		{rec: s.newRecord("c", []byte("4"))},
+	}
+	if err := s.commitTx(ops); err != nil {
+		t.Fatal(err)
+	}
+
+	crashed := t.TempDir()
+	copyDir(t, dir, crashed)
+	s.Close()
+	if s, err = NewStorage(crashed); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for k, want := range map[string]string{"b": "3", "c": "4"} {
+		if v, err := s.Get(k); err != nil || string(v) != want {
+			t.Fatalf("%s after a crash: %q %v", k, v, err)
+		}
+	}
+	if _, err := s.Get("a"); err == nil {
+		t.Fatal("deleted key is back")
+	}
+}
+
+func TestTxCluster(t *testing.T) {
+	nodes := startCluster(t, 3, 2)
+	c := NewBinaryClient()
+	ops := []txOp{
+		{rec: record{key: "u1", value: []byte("user")}},
+		{rec: record{key: "idx:x", value: []byte("u1")}, cond: condition{kind: condAbsent}},
+	}
+	if ver, err := c.Transact(nodes[0].addr, "", ops, 0); err != nil || ver.isZero() {
+		t.Fatalf("commit: %v %v", ver, err)
+	}
+	for _, n := range nodes {
+		if v, err := n.v.storage.Get("idx:x"); err != nil || string(v) != "u1" {
+			t.Fatalf("%s: %q %v", n.addr, v, err)
+		}
+	}
+
+	ops = []txOp{
+		{rec: record{key: "u2", value: []byte("user")}},
+		{rec: record{key: "idx:x", value: []byte("u2")}, cond: condition{kind: condAbsent}},
+	}
+	if _, err := c.Transact(nodes[1].addr, "", ops, 0); err != errConflict {
+		t.Fatalf("failed precondition: %v", err)
+	}
+	for _, n := range nodes {
+		if _, err := n.v.storage.Get("u2"); err == nil {
+			t.Fatalf("%s: aborted write applied", n.addr)
+		}
+		if n.v.storage.txs.pending.Load() != 0 {
+			t.Fatalf("%s: reservation left behind", n.addr)
+		}
+	}
+}
+
+func TestTxReservation(t *testing.T) {
+	s, err := NewStorage(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err := s.prepareTx("x", []txOp{{rec: s.newRecord("r", []byte("1"))}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.prepareTx("y", []txOp{{rec: s.newRecord("r", []byte("1"))}}); err != errConflict {
+		t.Fatalf("second prepare: %v", err)
+	}
+	if err := s.Set("r", []byte("2")); err != errConflict {
+		t.Fatalf("write to a reserved key: %v", err)
+	}
+	s.abortTx("x")
+	if err := s.Set("r", []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.commitPrepared("x"); err == nil {
+		t.Fatal("aborted transaction committed")
+	}
+}
+
+func TestTxDecisionLog(t *testing.T) {
+	nodes := startCluster(t, 3, 1)
+	c := nodes[0].v.cluster
+	dir := filepath.Join(t.TempDir(), "hints")
+	h, err := newHints(dir, 1<<20, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.hints = h
+	ops := []txOp{{rec: c.storage.newRecord("d1", []byte("1"))}, {rec: c.storage.newRecord("d2", nil)}}
+	ops[1].del = true
+	groups := map[string][]int{nodes[1].addr: {0, 1}, nodes[2].addr: {0}}
+	path, err := c.logTx("t1", groups, func(idx []int) []txOp {
+		var share []txOp
+		for _, i := range idx {
+			share = append(share, ops[i])
+		}
+		return share
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); err != nil || h.count.Load() != 0 {
+		t.Fatalf("decision not logged apart from hints: %v, %d hints", err, h.count.Load())
+	}
+
+	if h, err = newHints(dir, 1<<20, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) || h.count.Load() != 3 {
+		t.Fatalf("after restart: %v, %d hints", err, h.count.Load())
+	}
+	got := map[string]int{}
+	h.replay(func(target string, rec []byte) error {
+		got[target+" "+decodeRecord(rec).key]++
+		return nil
+	})
+	if len(got) != 3 || got[nodes[1].addr+" d1"] != 1 || got[nodes[1].addr+" d2"] != 1 || got[nodes[2].addr+" d1"] != 1 {
+		t.Fatalf("replayed %v", got)
+	}
+
+	c.hints = h
+	if _, err := c.transact([]txOp{{rec: record{key: "t1", value: []byte("1")}}, {rec: record{key: "t2", value: []byte("2")}}}); err != nil {
+		t.Fatal(err)
+	}
+	if logs, _ := os.ReadDir(filepath.Join(dir, hintTxDir)); len(logs) != 0 || h.count.Load() != 0 {
+		t.Fatalf("after a commit: %d logs, %d hints", len(logs), h.count.Load())
+	}
+}
+
+func TestHTTPTx(t *testing.T) {
+	h := newTestHTTP(t)
+	if w := do(h, "PUT", "/u1", "v", nil); w.Code != 200 {
+		t.Fatal(w.Code, w.Body)
+	}
+	w := do(h, "POST", "/_/tx", `{"ops":[{"op":"set","key":"h1","value":{"a":1}},{"op":"delete","key":"u1"}]}`, nil)
+	if w.Code != 200 || w.Header().Get("ETag") == "" {
+		t.Fatal(w.Code, w.Body)
+	}
+	if w := do(h, "POST", "/_/tx", `{"ops":[{"op":"set","key":"h1","value":2,"if_none_match":"*"}]}`, nil); w.Code != 412 {
+		t.Fatal(w.Code, w.Body)
+	}
+	if w := do(h, "POST", "/_/tx", `{"ops":[{"op":"set","key":"_/x","value":2}]}`, nil); w.Code != 400 {
+		t.Fatal(w.Code, w.Body)
+	}
+	if w := do(h, "GET", "/h1", "", nil); w.Body.String() != `{"a":1}` {
+		t.Fatal(w.Body)
+	}
+	if w := do(h, "GET", "/u1", "", nil); w.Code != 404 {
+		t.Fatal(w.Code, w.Body)
+	}
+}
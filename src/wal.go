@@ -1,7 +1,11 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"hash/crc32"
 	"io"
 	"os"
@@ -10,29 +14,107 @@ import (
 	"time"
 )
 
+// log entries are written in version 2 of the format:
+//
+//	[magic:u16][version:u8][type:u8][seq:u64][hash:u64][len:u32][crc:u32][payload]
+//
+// the crc covers the payload, then the header before it, so a streamed
+// payload can be summed before its seq is known.
+//
+// version 1 entries, still read, are [magic:u16][hash:u64][len:u32][crc16:u16]
+// [payload]; an empty payload is a delete.
 const (
-	walMagic      = 0xDEAD
-	walMaxBatch   = 1000
-	walFlushMs    = 10
-	walMaxBytes   = 1024 * 1024
-	walCompactMin = 40 * 1024
+	walMagic     = 0x5657
+	walVersion   = 2
+	walHdrLen    = 28
+	walMagicV1   = 0xDEAD
+	walTxMagicV1 = 0xDEAE
+	walHdrLenV1  = 16
+	walMaxBatch  = 1000
+	walFlushMs   = 10
+	walMaxBytes  = 1024 * 1024
+
+	walCheckpointBytes    = 16 * 1024 * 1024
+	walCheckpointInterval = 30 * time.Second
 )
 
+var (
+	errWALClosed = errors.New("wal closed")
+	errDamaged   = errors.New("damaged log entry")
+)
+
+type recType byte
+
+const (
+	recPut recType = iota + 1
+	recDelete
+	recBatch
+	recTombstone
+)
+
+type durability int
+
+const (
+	// durAsync can lose the last walFlushMs of acknowledged writes.
+	durAsync durability = iota
+	// durGroup shares one fsync between writes that arrive together.
+	durGroup
+	durSync
+)
+
+func parseDurability(s string) (durability, error) {
+	switch s {
+	case "async":
+		return durAsync, nil
+	case "group":
+		return durGroup, nil
+	case "sync":
+		return durSync, nil
+	}
+	return 0, fmt.Errorf("invalid durability: %s (use: async, group, sync)", s)
+}
+
+func (d durability) String() string {
+	switch d {
+	case durAsync:
+		return "async"
+	case durSync:
+		return "sync"
+	}
+	return "group"
+}
+
+// walEntry is one write, or a transaction when ops is set. a transaction is
+// logged as one recBatch entry with the number of writes in its hash field
+// and ([type:u8][hash:u64][len:u32][data])* as payload.
 type walEntry struct {
 	hash uint64
 	data []byte
+	ops  []walEntry
+	done chan error
+}
+
+func (e walEntry) size() int {
+	n := len(e.data)
+	for _, op := range e.ops {
+		n += 12 + len(op.data)
+	}
+	return n
 }
 
 type wal struct {
-	dir   string
-	file  *os.File
-	mu    sync.Mutex
-	batch []walEntry
-	ch    chan walEntry
-	done  chan struct{}
+	dir    string
+	mode   durability
+	seq    uint64 // of the last entry written, under mu
+	file   *os.File
+	mu     sync.Mutex
+	batch  []walEntry
+	ch     chan walEntry
+	done   chan struct{}
+	closed chan struct{}
 }
 
-func newWAL(dir string) (*wal, error) {
+func newWAL(dir string, mode durability) (*wal, error) {
 	if err := os.MkdirAll(dir, 0755); err != nil {
 		return nil, err
 	}
@@ -44,25 +126,65 @@ func newWAL(dir string) (*wal, error) {
 	}
 
 	w := &wal{
-		dir:   dir,
-		file:  f,
-		batch: make([]walEntry, 0, walMaxBatch),
-		ch:    make(chan walEntry, walMaxBatch*2),
-		done:  make(chan struct{}),
+		dir:    dir,
+		mode:   mode,
+		file:   f,
+		batch:  make([]walEntry, 0, walMaxBatch),
+		ch:     make(chan walEntry, walMaxBatch*2),
+		done:   make(chan struct{}),
+		closed: make(chan struct{}),
 	}
 
 	go w.flusher()
 	return w, nil
 }
 
-func (w *wal) append(h uint64, data []byte) {
+func (w *wal) append(h uint64, data []byte) error {
+	return w.submit(walEntry{hash: h, data: data})
+}
+
+func (w *wal) appendTx(ops []walEntry) error {
+	return w.submit(walEntry{ops: ops})
+}
+
+func (w *wal) submit(e walEntry) error {
+	switch w.mode {
+	case durSync:
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		w.batch = append(w.batch, e)
+		return w.flushLocked()
+	case durGroup:
+		e.done = make(chan error, 1)
+		if err := w.enqueue(e); err != nil {
+			return err
+		}
+		select {
+		case err := <-e.done:
+			return err
+		case <-w.closed:
+			select {
+			case err := <-e.done:
+				return err
+			default:
+				return errWALClosed
+			}
+		}
+	}
+	return w.enqueue(e)
+}
+
+func (w *wal) enqueue(e walEntry) error {
 	select {
-	case w.ch <- walEntry{hash: h, data: data}:
-	default:
+	case w.ch <- e:
+		return nil
+	case <-w.closed:
+		return errWALClosed
 	}
 }
 
 func (w *wal) flusher() {
+	defer close(w.closed)
 	ticker := time.NewTicker(walFlushMs * time.Millisecond)
 	defer ticker.Stop()
 	bytes := 0
@@ -72,8 +194,11 @@ func (w *wal) flusher() {
 		case e := <-w.ch:
 			w.mu.Lock()
 			w.batch = append(w.batch, e)
-			bytes += len(e.data)
-			if len(w.batch) >= walMaxBatch || bytes >= walMaxBytes {
+			bytes += e.size()
+			if e.done != nil {
+				w.drainLocked()
+			}
+			if e.done != nil || len(w.batch) >= walMaxBatch || bytes >= walMaxBytes {
 				w.flushLocked()
 				bytes = 0
 			}
@@ -87,7 +212,13 @@ func (w *wal) flusher() {
 			w.mu.Unlock()
 		case <-w.done:
 			w.mu.Lock()
-			w.flushLocked()
+			for {
+				w.drainLocked()
+				if len(w.batch) == 0 {
+					break
+				}
+				w.flushLocked()
+			}
 			w.mu.Unlock()
 			w.file.Close()
 			return
@@ -95,140 +226,412 @@ func (w *wal) flusher() {
 	}
 }
 
-func (w *wal) flushLocked() {
+func (w *wal) drainLocked() {
+	for len(w.batch) < walMaxBatch {
+		select {
+		case e := <-w.ch:
+			w.batch = append(w.batch, e)
+		default:
+			return
+		}
+	}
+}
+
+func (w *wal) flushLocked() error {
 	if len(w.batch) == 0 {
-		return
+		return nil
 	}
 
-	dedup := make(map[uint64][]byte, len(w.batch))
+	// only the last write of a key is kept; transactions are kept whole.
+	last := make(map[uint64]int, len(w.batch))
+	for i, e := range w.batch {
+		if e.ops == nil {
+			last[e.hash] = i
+		}
+	}
+
+	var err error
+	for i, e := range w.batch {
+		var werr error
+		if e.ops != nil {
+			w.seq++
+			werr = writeEntry(w.file, recBatch, w.seq, uint64(len(e.ops)), encodeTxEntry(e.ops))
+		} else if last[e.hash] == i {
+			w.seq++
+			werr = writeEntry(w.file, e.typ(), w.seq, e.hash, e.data)
+		}
+		if err == nil {
+			err = werr
+		}
+	}
+
+	if serr := w.file.Sync(); err == nil {
+		err = serr
+	}
 	for _, e := range w.batch {
-		dedup[e.hash] = e.data
+		if e.done != nil {
+			e.done <- err
+		}
 	}
+	clear(w.batch)
+	w.batch = w.batch[:0]
+	return err
+}
 
-	var buf [16]byte
-	for hash, data := range dedup {
-		binary.LittleEndian.PutUint16(buf[0:2], walMagic)
-		binary.LittleEndian.PutUint64(buf[2:10], hash)
-		binary.LittleEndian.PutUint32(buf[10:14], uint32(len(data)))
-		binary.LittleEndian.PutUint16(buf[14:16], uint16(crc32.ChecksumIEEE(data)&0xFFFF))
+func (e walEntry) typ() recType {
+	switch {
+	case e.data == nil:
+		return recDelete
+	case isTombstone(e.data):
+		return recTombstone
+	}
+	return recPut
+}
+
+// frameEntry returns the header without its crc.
+func frameEntry(typ recType, seq, hash uint64, n int) [walHdrLen]byte {
+	var hdr [walHdrLen]byte
+	binary.LittleEndian.PutUint16(hdr[0:2], walMagic)
+	hdr[2] = walVersion
+	hdr[3] = byte(typ)
+	binary.LittleEndian.PutUint64(hdr[4:12], seq)
+	binary.LittleEndian.PutUint64(hdr[12:20], hash)
+	binary.LittleEndian.PutUint32(hdr[20:24], uint32(n))
+	return hdr
+}
 
-		w.file.Write(buf[:])
-		w.file.Write(data)
+func encodeEntry(typ recType, seq, hash uint64, data []byte) []byte {
+	hdr := frameEntry(typ, seq, hash, len(data))
+	buf := make([]byte, walHdrLen+len(data))
+	copy(buf, hdr[:])
+	copy(buf[walHdrLen:], data)
+	binary.LittleEndian.PutUint32(buf[24:28], crc32.Update(crc32.ChecksumIEEE(data), crc32.IEEETable, buf[:24]))
+	return buf
+}
+
+func writeEntry(f *os.File, typ recType, seq, hash uint64, data []byte) error {
+	_, err := f.Write(encodeEntry(typ, seq, hash, data))
+	return err
+}
+
+func encodeTxEntry(ops []walEntry) []byte {
+	size := 0
+	for _, op := range ops {
+		size += 13 + len(op.data)
+	}
+	buf := make([]byte, size)
+	n := 0
+	for _, op := range ops {
+		buf[n] = byte(op.typ())
+		binary.LittleEndian.PutUint64(buf[n+1:], op.hash)
+		binary.LittleEndian.PutUint32(buf[n+9:], uint32(len(op.data)))
+		n += 13
+		n += copy(buf[n:], op.data)
 	}
+	return buf
+}
 
-	w.file.Sync()
-	w.batch = w.batch[:0]
+type walRecord struct {
+	typ    recType
+	seq    uint64
+	hash   uint64
+	data   []byte
+	hdrLen int
+}
 
-	if info, err := w.file.Stat(); err == nil && info.Size() > walCompactMin {
-		w.compact()
+// walOp is one write of a record. a delete has nil data, an empty value
+// empty data.
+type walOp struct {
+	typ  recType
+	hash uint64
+	off  int
+	data []byte
+}
+
+func (r walRecord) ops() (ops []walOp, ok bool) {
+	if r.typ != recBatch {
+		op := walOp{typ: r.typ, hash: r.hash, data: r.data}
+		if r.typ == recDelete {
+			op.data = nil
+		}
+		return []walOp{op}, true
+	}
+
+	// version 1 batches have no type byte per write.
+	v1 := r.hdrLen == walHdrLenV1
+	skip := 13
+	if v1 {
+		skip = 12
+	}
+	b := r.data
+	pos := 0
+	for pos < len(b) {
+		if len(b)-pos < skip {
+			return nil, false
+		}
+		op := walOp{typ: recPut}
+		if !v1 {
+			op.typ = recType(b[pos])
+			pos++
+		}
+		op.hash = binary.LittleEndian.Uint64(b[pos:])
+		n := int(binary.LittleEndian.Uint32(b[pos+8:]))
+		pos += 12
+		if n > len(b)-pos {
+			return nil, false
+		}
+		op.off = pos
+		if v1 && n == 0 {
+			op.typ = recDelete
+		}
+		if op.typ != recDelete {
+			op.data = b[pos : pos+n]
+		}
+		ops = append(ops, op)
+		pos += n
 	}
+	return ops, true
 }
 
-func (w *wal) compact() {
-	entries := make(map[uint64][]byte)
-	w.replay(func(h uint64, data []byte) error {
-		if len(data) == 0 {
-			delete(entries, h)
-		} else {
-			entries[h] = data
+// readEntry returns io.EOF at a clean end and errDamaged for a torn or
+// corrupt entry.
+func readEntry(r io.Reader, limit int64) (walRecord, error) {
+	var hdr [walHdrLen]byte
+	if _, err := io.ReadFull(r, hdr[:2]); err != nil {
+		if err == io.EOF {
+			return walRecord{}, io.EOF
 		}
-		return nil
-	})
+		return walRecord{}, errDamaged
+	}
 
-	tmpPath := filepath.Join(w.dir, "wal.log.tmp")
-	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
-	if err != nil {
-		return
+	var rec walRecord
+	switch binary.LittleEndian.Uint16(hdr[0:2]) {
+	case walMagic:
+		if _, err := io.ReadFull(r, hdr[2:]); err != nil || hdr[2] != walVersion {
+			return rec, errDamaged
+		}
+		rec = walRecord{
+			typ:    recType(hdr[3]),
+			seq:    binary.LittleEndian.Uint64(hdr[4:12]),
+			hash:   binary.LittleEndian.Uint64(hdr[12:20]),
+			hdrLen: walHdrLen,
+		}
+		if rec.typ < recPut || rec.typ > recTombstone {
+			return rec, errDamaged
+		}
+	case walMagicV1, walTxMagicV1:
+		if _, err := io.ReadFull(r, hdr[2:walHdrLenV1]); err != nil {
+			return rec, errDamaged
+		}
+		rec = walRecord{typ: recPut, hash: binary.LittleEndian.Uint64(hdr[2:10]), hdrLen: walHdrLenV1}
+		if binary.LittleEndian.Uint16(hdr[0:2]) == walTxMagicV1 {
+			rec.typ = recBatch
+		}
+	default:
+		return rec, errDamaged
 	}
 
-	var buf [16]byte
-	for hash, data := range entries {
-		if len(data) > 0 {
-			binary.LittleEndian.PutUint16(buf[0:2], walMagic)
-			binary.LittleEndian.PutUint64(buf[2:10], hash)
-			binary.LittleEndian.PutUint32(buf[10:14], uint32(len(data)))
-			binary.LittleEndian.PutUint16(buf[14:16], uint16(crc32.ChecksumIEEE(data)&0xFFFF))
+	var n int64
+	if rec.hdrLen == walHdrLen {
+		n = int64(binary.LittleEndian.Uint32(hdr[20:24]))
+	} else {
+		n = int64(binary.LittleEndian.Uint32(hdr[10:14]))
+	}
+	if n > limit-int64(rec.hdrLen) {
+		return rec, errDamaged
+	}
+	rec.data = make([]byte, n)
+	if _, err := io.ReadFull(r, rec.data); err != nil {
+		return rec, errDamaged
+	}
 
-			if _, err := f.Write(buf[:]); err != nil {
-				f.Close()
-				os.Remove(tmpPath)
-				return
-			}
-			if _, err := f.Write(data); err != nil {
-				f.Close()
-				os.Remove(tmpPath)
-				return
-			}
+	if rec.hdrLen == walHdrLen {
+		sum := crc32.Update(crc32.ChecksumIEEE(rec.data), crc32.IEEETable, hdr[:24])
+		if sum != binary.LittleEndian.Uint32(hdr[24:28]) {
+			return rec, errDamaged
+		}
+	} else {
+		if uint16(crc32.ChecksumIEEE(rec.data)&0xFFFF) != binary.LittleEndian.Uint16(hdr[14:16]) {
+			return rec, errDamaged
+		}
+		if rec.typ == recPut && n == 0 {
+			rec.typ = recDelete
 		}
 	}
-	if err := f.Sync(); err != nil {
-		f.Close()
-		os.Remove(tmpPath)
-		return
+	if _, ok := rec.ops(); !ok {
+		return rec, errDamaged
 	}
-	f.Close()
+	return rec, nil
+}
+
+type replayReport struct {
+	records   int
+	v1        int
+	discarded int
+	lostBytes int64
+	lastSeq   uint64
+}
+
+func (r *replayReport) add(o replayReport) {
+	r.records += o.records
+	r.v1 += o.v1
+	r.discarded += o.discarded
+	r.lostBytes += o.lostBytes
+	r.lastSeq = max(r.lastSeq, o.lastSeq)
+}
+
+func (r replayReport) String() string {
+	s := fmt.Sprintf("%d records recovered (%d in the version 1 format)", r.records, r.v1)
+	if r.lostBytes > 0 {
+		s += fmt.Sprintf(", %d records discarded in the last %d bytes", r.discarded, r.lostBytes)
+	}
+	return s
+}
+
+func (r replayReport) stats() map[string]interface{} {
+	return map[string]interface{}{
+		"recovered":       r.records,
+		"recovered_v1":    r.v1,
+		"discarded":       r.discarded,
+		"discarded_bytes": r.lostBytes,
+		"last_seq":        r.lastSeq,
+	}
+}
+
+// scanLog stops at the first damaged entry. what follows can't be trusted,
+// so it is only counted.
+func scanLog(r io.Reader, size int64, fn func(off int64, rec walRecord) error) (int64, replayReport, error) {
+	var rep replayReport
+	br := bufio.NewReaderSize(r, 1024*1024)
+	var off int64
+	for {
+		rec, err := readEntry(br, size-off)
+		if err == io.EOF {
+			return off, rep, nil
+		}
+		if err != nil {
+			rest, _ := io.ReadAll(br)
+			rep.lostBytes = size - off
+			rep.discarded = 1 + countEntries(rest)
+			return off, rep, nil
+		}
+
+		rep.records++
+		if rec.hdrLen == walHdrLenV1 {
+			rep.v1++
+		}
+		rep.lastSeq = max(rep.lastSeq, rec.seq)
+		if err := fn(off, rec); err != nil {
+			return off, rep, err
+		}
+		off += int64(rec.hdrLen + len(rec.data))
+	}
+}
+
+func countEntries(b []byte) int {
+	n := 0
+	for i := 0; i+walHdrLen <= len(b); i++ {
+		if binary.LittleEndian.Uint16(b[i:]) != walMagic || b[i+2] != walVersion {
+			continue
+		}
+		rec, err := readEntry(bytes.NewReader(b[i:]), int64(len(b)-i))
+		if err != nil {
+			continue
+		}
+		n++
+		i += rec.hdrLen + len(rec.data) - 1
+	}
+	return n
+}
+
+func (w *wal) size() int64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	info, err := w.file.Stat()
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+// cut drops the first off bytes, which a checkpoint made redundant, by
+// renaming a copy of the rest over the log.
+func (w *wal) cut(off int64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
 
-	w.file.Close()
 	path := filepath.Join(w.dir, "wal.log")
-	if err := os.Rename(tmpPath, path); err != nil {
-		return
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	if _, err := src.Seek(off, io.SeekStart); err != nil {
+		return err
+	}
+
+	tmpPath := filepath.Join(w.dir, "wal.log.tmp")
+	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, src)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := syncDir(w.dir); err != nil {
+		return err
 	}
 
 	newFile, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
 	if err != nil {
-		return
+		return err
 	}
+	w.file.Close()
 	w.file = newFile
+	return nil
 }
 
 func (w *wal) close() {
 	close(w.done)
+	<-w.closed
 }
 
-func (w *wal) replay(fn func(h uint64, data []byte) error) error {
+func (w *wal) replay(fn func(seq, h uint64, data []byte) error) (replayReport, error) {
 	path := filepath.Join(w.dir, "wal.log")
 	f, err := os.Open(path)
 	if os.IsNotExist(err) {
-		return nil
+		return replayReport{}, nil
 	}
 	if err != nil {
-		return err
+		return replayReport{}, err
 	}
 	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return replayReport{}, err
+	}
 
-	var buf [16]byte
-	for {
-		if _, err := io.ReadFull(f, buf[:]); err != nil {
-			if err == io.EOF {
-				break
+	_, rep, err := scanLog(f, info.Size(), func(off int64, rec walRecord) error {
+		ops, _ := rec.ops()
+		for _, op := range ops {
+			if err := fn(rec.seq, op.hash, op.data); err != nil {
+				return err
 			}
-			return err
-		}
-
-		magic := binary.LittleEndian.Uint16(buf[0:2])
-		if magic != walMagic {
-			break
-		}
-
-		hash := binary.LittleEndian.Uint64(buf[2:10])
-		dataLen := binary.LittleEndian.Uint32(buf[10:14])
-		checksum := binary.LittleEndian.Uint16(buf[14:16])
-
-		data := make([]byte, dataLen)
-		if _, err := io.ReadFull(f, data); err != nil {
-			return err
-		}
-
-		if uint16(crc32.ChecksumIEEE(data)&0xFFFF) != checksum {
-			break
-		}
-
-		if err := fn(hash, data); err != nil {
-			return err
 		}
-	}
-
-	return nil
+		return nil
+	})
+	return rep, err
 }
 
 func (w *wal) truncate() error {
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// v1Entry frames payload as a version 1 log entry.
+func v1Entry(magic uint16, h uint64, payload []byte) []byte {
+	b := make([]byte, walHdrLenV1+len(payload))
+	binary.LittleEndian.PutUint16(b, magic)
+	binary.LittleEndian.PutUint64(b[2:], h)
+	binary.LittleEndian.PutUint32(b[10:], uint32(len(payload)))
+	binary.LittleEndian.PutUint16(b[14:], uint16(crc32.ChecksumIEEE(payload)))
+	copy(b[walHdrLenV1:], payload)
+	return b
+}
+
+func TestWALReplayV1(t *testing.T) {
+	dir := t.TempDir()
+	ver := version{ts: uint64(time.Now().UnixNano()), node: 1}
+	put := record{key: "old", value: []byte("v1value"), ver: ver}
+	gone := record{key: "gone", value: []byte("x"), ver: ver}
+	txRec := record{key: "tx", value: []byte("txv"), ver: ver}
+
+	var tx []byte
+	tx = binary.LittleEndian.AppendUint64(tx, hash64str("tx"))
+	tx = binary.LittleEndian.AppendUint32(tx, uint32(len(txRec.encode())))
+	tx = append(tx, txRec.encode()...)
+
+	var log []byte
+	log = append(log, v1Entry(walMagicV1, hash64str("old"), put.encode())...)
+	log = append(log, v1Entry(walMagicV1, hash64str("gone"), gone.encode())...)
+	log = append(log, v1Entry(walMagicV1, hash64str("gone"), nil)...)
+	log = append(log, v1Entry(walTxMagicV1, 1, tx)...)
+	if err := os.WriteFile(filepath.Join(dir, "wal.log"), log, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rep := s.backend.(*fileBackend).report
+	if rep.records != 4 || rep.v1 != 4 || rep.discarded != 0 {
+		t.Fatalf("replay report %+v", rep)
+	}
+	check := func(s *Storage) {
+		t.Helper()
+		if v, err := s.Get("old"); err != nil || string(v) != "v1value" {
+			t.Fatalf("old: %q %v", v, err)
+		}
+		if v, err := s.Get("tx"); err != nil || string(v) != "txv" {
+			t.Fatalf("tx: %q %v", v, err)
+		}
+		if _, err := s.Get("gone"); err == nil {
+			t.Fatal("deleted key is back")
+		}
+	}
+	check(s)
+	if err := s.Set("new", []byte("v2value")); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	s, err = NewStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if rep := s.backend.(*fileBackend).report; rep.v1 != 0 {
+		t.Fatalf("version 1 entries left in the log: %+v", rep)
+	}
+	check(s)
+	if v, err := s.Get("new"); err != nil || string(v) != "v2value" {
+		t.Fatalf("new: %q %v", v, err)
+	}
+}
+
+func TestWALReplayDamagedTail(t *testing.T) {
+	// write lays down five entries and returns the log's path and the size
+	// of one entry.
+	write := func(t *testing.T, dir string) (string, int) {
+		w, err := newWAL(dir, durSync)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := range 5 {
+			if err := w.append(uint64(i+1), []byte("abc")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		w.close()
+		path := filepath.Join(dir, "wal.log")
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return path, int(info.Size()) / 5
+	}
+	replay := func(t *testing.T, dir string) ([]uint64, replayReport) {
+		w, err := newWAL(dir, durSync)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer w.close()
+		var seqs []uint64
+		rep, err := w.replay(func(seq, h uint64, data []byte) error {
+			seqs = append(seqs, seq)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return seqs, rep
+	}
+
+	t.Run("Torn", func(t *testing.T) {
+		dir := t.TempDir()
+		path, _ := write(t, dir)
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write([]byte{0x57, 0x56, walVersion, 1, 2})
+		f.Close()
+
+		seqs, rep := replay(t, dir)
+		if len(seqs) != 5 || rep.records != 5 || rep.lastSeq != 5 {
+			t.Fatalf("recovered %v, report %+v", seqs, rep)
+		}
+		if rep.discarded != 1 || rep.lostBytes != 5 {
+			t.Fatalf("report %+v", rep)
+		}
+	})
+
+	t.Run("Corrupt", func(t *testing.T) {
+		dir := t.TempDir()
+		path, size := write(t, dir)
+		b, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b[2*size+walHdrLen+1] ^= 0xFF
+		if err := os.WriteFile(path, b, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		seqs, rep := replay(t, dir)
+		if len(seqs) != 2 || seqs[1] != 2 || rep.lastSeq != 2 {
+			t.Fatalf("recovered %v, report %+v", seqs, rep)
+		}
+		if rep.discarded != 3 || rep.lostBytes != int64(3*size) {
+			t.Fatalf("report %+v", rep)
+		}
+	})
+}
+
+func TestDurabilityModes(t *testing.T) {
+	for _, engine := range []string{"files", "segments"} {
+		for _, mode := range []durability{durAsync, durGroup, durSync} {
+			t.Run(engine+"/"+mode.String(), func(t *testing.T) {
+				dir := t.TempDir()
+				s, err := NewStorageEngine(dir, engine, mode)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var wg sync.WaitGroup
+				for g := range 8 {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						for i := range 100 {
+							k := fmt.Sprintf("k%d-%d", g, i)
+							if err := s.Set(k, []byte("v"+k)); err != nil {
+								t.Error(err)
+								return
+							}
+						}
+					}()
+				}
+				wg.Wait()
+				s.Close()
+				filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+					if filepath.Ext(path) == ".tmp" {
+						t.Errorf("temp file left: %s", path)
+					}
+					return nil
+				})
+
+				if s, err = NewStorageEngine(dir, engine, mode); err != nil {
+					t.Fatal(err)
+				}
+				defer s.Close()
+				for g := range 8 {
+					for i := range 100 {
+						k := fmt.Sprintf("k%d-%d", g, i)
+						if v, err := s.Get(k); err != nil || string(v) != "v"+k {
+							t.Fatalf("%s: %q %v", k, v, err)
+						}
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestWALNoDrop(t *testing.T) {
+	dir := t.TempDir()
+	w, err := newWAL(dir, durAsync)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range 20000 {
+		if err := w.append(uint64(i), []byte("x")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.close()
+
+	if w, err = newWAL(dir, durAsync); err != nil {
+		t.Fatal(err)
+	}
+	defer w.close()
+	n := 0
+	w.replay(func(seq, h uint64, data []byte) error {
+		n++
+		return nil
+	})
+	if n != 20000 {
+		t.Fatalf("replayed %d of 20000 entries", n)
+	}
+}
+
+func TestWALCheckpoint(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	val := make([]byte, 1024)
+	for i := range 1000 {
+		if err := s.Set(fmt.Sprintf("k%d", i), val); err != nil {
+			t.Fatal(err)
+		}
+	}
+	e := s.backend.(*fileBackend)
+	if err := e.checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Set("tail", []byte("y")); err != nil {
+		t.Fatal(err)
+	}
+	if size := e.wal.size(); size == 0 || size > 1000 {
+		t.Fatalf("log is %d bytes after a checkpoint", size)
+	}
+
+	crashed := t.TempDir()
+	copyDir(t, dir, crashed)
+	s.Close()
+	if s, err = NewStorage(crashed); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for _, k := range []string{"k0", "k999", "tail"} {
+		if _, err := s.Get(k); err != nil {
+			t.Fatalf("%s after a crash: %v", k, err)
+		}
+	}
+}